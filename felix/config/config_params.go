@@ -246,6 +246,7 @@ type Config struct {
 	IptablesBackend                    string            `config:"oneof(legacy,nft,auto);auto"`
 	RouteRefreshInterval               time.Duration     `config:"seconds;90"`
 	InterfaceRefreshInterval           time.Duration     `config:"seconds;90"`
+	IfaceMonitorFlapDelay              time.Duration     `config:"seconds;0.1;local"`
 	DeviceRouteSourceAddress           net.IP            `config:"ipv4;"`
 	DeviceRouteSourceAddressIPv6       net.IP            `config:"ipv6;"`
 	DeviceRouteProtocol                int               `config:"int;3"`
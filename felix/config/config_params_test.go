@@ -293,6 +293,12 @@ var _ = DescribeTable("Config parsing",
 		"123", 123*time.Millisecond),
 	Entry("IptablesLockProbeIntervalMillis garbage", "IptablesLockProbeIntervalMillis",
 		"garbage", 50*time.Millisecond),
+	Entry("IfaceMonitorFlapDelay", "IfaceMonitorFlapDelay",
+		"0.25", 250*time.Millisecond),
+	Entry("IfaceMonitorFlapDelay zero", "IfaceMonitorFlapDelay",
+		"0", time.Duration(0)),
+	Entry("IfaceMonitorFlapDelay garbage", "IfaceMonitorFlapDelay",
+		"garbage", 100*time.Millisecond),
 
 	Entry("DefaultEndpointToHostAction", "DefaultEndpointToHostAction",
 		"RETURN", "RETURN"),
@@ -205,6 +205,9 @@ func StartDataplaneDriver(configParams *config.Config,
 				InterfaceExcludes: configParams.InterfaceExclude,
 				ResyncInterval:    configParams.InterfaceRefreshInterval,
 				NetlinkTimeout:    configParams.NetlinkTimeoutSecs,
+				FlapDampingDelay:  configParams.IfaceMonitorFlapDelay,
+				// A delay of 0 configures no damping, rather than the default.
+				DisableFlapDamping: configParams.IfaceMonitorFlapDelay == 0,
 			},
 			RulesConfig: rules.Config{
 				WorkloadIfacePrefixes: configParams.InterfacePrefixes(),
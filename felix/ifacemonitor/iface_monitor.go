@@ -34,6 +34,7 @@ type netlinkStub interface {
 	Subscribe(
 		linkUpdates chan netlink.LinkUpdate,
 		routeUpdates chan netlink.RouteUpdate,
+		errorCallback func(error),
 	) (cancel chan struct{}, err error)
 	LinkList() ([]netlink.Link, error)
 	ListLocalRoutes(link netlink.Link, family int) ([]netlink.Route, error)
@@ -57,6 +58,11 @@ type Config struct {
 	// ResyncInterval is the interval at which we rescan all the interfaces.  If <0 rescan is disabled.
 	ResyncInterval time.Duration
 	NetlinkTimeout time.Duration
+	// FlapDampingDelay is how long address removals and links going down are held back in case
+	// they're flaps; see UpdateFilter.  If zero, the default FlapDampingDelay is used.
+	FlapDampingDelay time.Duration
+	// DisableFlapDamping turns off flap damping, passing updates through as soon as they arrive.
+	DisableFlapDamping bool
 }
 
 type InterfaceMonitor struct {
@@ -113,33 +119,43 @@ func IsInterfacePresent(name string) bool {
 	return link != nil
 }
 
+// filterOptions returns the UpdateFilter options for the monitor's Config.
+func (m *InterfaceMonitor) filterOptions() []UpdateFilterOp {
+	if m.DisableFlapDamping {
+		return []UpdateFilterOp{WithDampingEnabled(false)}
+	}
+	if m.FlapDampingDelay > 0 {
+		return []UpdateFilterOp{WithFlapDampingDelay(m.FlapDampingDelay)}
+	}
+	return nil
+}
+
 func (m *InterfaceMonitor) MonitorInterfaces() {
 	log.Info("Interface monitoring thread started.")
 
 	// Reconnection loop.
 	for {
-		var nlCancelC chan struct{}
 		filterUpdatesCtx, filterUpdatesCancel := context.WithCancel(context.Background())
 		filteredUpdates := make(chan netlink.LinkUpdate, 10)
 		filteredRouteUpdates := make(chan netlink.RouteUpdate, 10)
-		{
-			updates := make(chan netlink.LinkUpdate, 10)
-			routeUpdates := make(chan netlink.RouteUpdate, 10)
-			var err error
-			if nlCancelC, err = m.netlinkStub.Subscribe(updates, routeUpdates); err != nil {
-				// If we can't even subscribe, something must have gone very wrong.  Bail.
-				m.fatalErrCallback(fmt.Errorf("failed to subscribe to netlink: %w", err))
-				filterUpdatesCancel()
-				return
-			}
-			go FilterUpdates(filterUpdatesCtx, filteredRouteUpdates, routeUpdates, filteredUpdates, updates)
+		src, err := NewNetlinkLinkAddrSourceWithStub(m.netlinkStub)
+		if err != nil {
+			// If we can't even subscribe, something must have gone very wrong.  Bail.
+			m.fatalErrCallback(fmt.Errorf("failed to subscribe to netlink: %w", err))
+			filterUpdatesCancel()
+			return
 		}
+		go func() {
+			filter := NewUpdateFilter(m.filterOptions()...)
+			err := filter.FilterUpdatesFromSource(filterUpdatesCtx, filteredRouteUpdates, filteredUpdates, src)
+			log.WithError(err).Debug("Netlink update filter stopped.")
+		}()
 		log.Info("Subscribed to netlink updates.")
 
 		// Do a resync to notify all our existing interfaces.  We also do periodic
 		// resyncs because it's not clear what the ordering guarantees are for our netlink
 		// subscription vs a list operation as used by resync().
-		err := m.resync()
+		err = m.resync()
 		if err != nil {
 			m.fatalErrCallback(fmt.Errorf("failed to read from netlink (initial resync): %w", err))
 			filterUpdatesCancel()
@@ -175,13 +191,13 @@ func (m *InterfaceMonitor) MonitorInterfaces() {
 				err := m.resync()
 				if err != nil {
 					m.fatalErrCallback(fmt.Errorf("failed to read from netlink (resync): %w", err))
-					close(nlCancelC)
+					src.Close()
 					filterUpdatesCancel()
 					return
 				}
 			}
 		}
-		close(nlCancelC)
+		src.Close()
 		filterUpdatesCancel()
 		log.Warn("Reconnecting to netlink after a failure...")
 	}
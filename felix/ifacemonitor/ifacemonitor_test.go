@@ -47,6 +47,7 @@ type netlinkTest struct {
 	routeUpdates   chan netlink.RouteUpdate
 	userSubscribed chan int
 	cancel         chan struct{}
+	errorCallback  func(error)
 
 	nextIndex int
 	links     map[string]linkModel
@@ -228,9 +229,11 @@ func (nl *netlinkTest) signalAddr(name string, addr string, exists bool) {
 func (nl *netlinkTest) Subscribe(
 	linkUpdates chan netlink.LinkUpdate,
 	routeUpdates chan netlink.RouteUpdate,
+	errorCallback func(error),
 ) (chan struct{}, error) {
 	nl.linkUpdates = linkUpdates
 	nl.routeUpdates = routeUpdates
+	nl.errorCallback = errorCallback
 	nl.cancel = make(chan struct{})
 	nl.userSubscribed <- 1
 	return nl.cancel, nil
@@ -0,0 +1,188 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// LinkAddrSource is a source of link and address updates for UpdateFilter.FilterUpdatesFromSource.
+// Address updates are delivered as local route updates.  Errors carries errors from the underlying
+// subscription.  NetlinkLinkAddrSource reads from the kernel; FakeLinkAddrSource is provided for
+// tests.
+type LinkAddrSource interface {
+	RouteUpdates() <-chan netlink.RouteUpdate
+	LinkUpdates() <-chan netlink.LinkUpdate
+	Errors() <-chan error
+}
+
+// ErrSourceFailed marks a fatal LinkAddrSource error.  A source that can no longer deliver updates
+// should send an error wrapping ErrSourceFailed on its error channel, for example
+// fmt.Errorf("socket closed: %w", ErrSourceFailed).  Other errors are treated as transient.
+var ErrSourceFailed = errors.New("update source failed")
+
+// SourceErrorCallback is called for each error reported by a LinkAddrSource.  fatal is true if the
+// error wraps ErrSourceFailed, in which case FilterUpdatesFromSource returns after the callback.
+type SourceErrorCallback func(err error, fatal bool)
+
+// NetlinkLinkAddrSource is a LinkAddrSource backed by netlink link and route subscriptions.  Errors
+// reported by the netlink library are passed on as transient errors.  If a subscription's socket
+// fails, the library closes the corresponding update channel, which stops the filter.
+type NetlinkLinkAddrSource struct {
+	routeC  chan netlink.RouteUpdate
+	linkC   chan netlink.LinkUpdate
+	errC    chan error
+	cancelC chan struct{}
+}
+
+// NewNetlinkLinkAddrSource subscribes to netlink link and route updates.  Call Close to
+// unsubscribe.
+func NewNetlinkLinkAddrSource() (*NetlinkLinkAddrSource, error) {
+	// Subscribing doesn't use the real netlink's handle manager, so there's no need to create one.
+	return NewNetlinkLinkAddrSourceWithStub(&netlinkReal{})
+}
+
+// NewNetlinkLinkAddrSourceWithStub is as NewNetlinkLinkAddrSource but subscribes through the given
+// netlink stub.
+func NewNetlinkLinkAddrSourceWithStub(netlinkStub netlinkStub) (*NetlinkLinkAddrSource, error) {
+	s := &NetlinkLinkAddrSource{
+		routeC: make(chan netlink.RouteUpdate, 10),
+		linkC:  make(chan netlink.LinkUpdate, 10),
+		errC:   make(chan error, 10),
+	}
+	cancelC, err := netlinkStub.Subscribe(s.linkC, s.routeC, s.onError)
+	if err != nil {
+		return nil, err
+	}
+	s.cancelC = cancelC
+	return s, nil
+}
+
+func (s *NetlinkLinkAddrSource) onError(err error) {
+	select {
+	case s.errC <- err:
+	default:
+		log.WithError(err).Warn("Netlink reported an error but the error channel is full, dropping it.")
+	}
+}
+
+func (s *NetlinkLinkAddrSource) RouteUpdates() <-chan netlink.RouteUpdate {
+	return s.routeC
+}
+
+func (s *NetlinkLinkAddrSource) LinkUpdates() <-chan netlink.LinkUpdate {
+	return s.linkC
+}
+
+func (s *NetlinkLinkAddrSource) Errors() <-chan error {
+	return s.errC
+}
+
+// Close cancels the netlink subscriptions.  The netlink library closes the update channels once
+// the subscriptions have shut down.
+func (s *NetlinkLinkAddrSource) Close() {
+	close(s.cancelC)
+}
+
+// FakeLinkAddrSource is a LinkAddrSource for use in tests.  Tests send updates and errors on its
+// exported channels.
+type FakeLinkAddrSource struct {
+	RouteC chan netlink.RouteUpdate
+	LinkC  chan netlink.LinkUpdate
+	ErrC   chan error
+}
+
+// NewFakeLinkAddrSource creates a FakeLinkAddrSource whose channels each buffer up to 10 items.
+func NewFakeLinkAddrSource() *FakeLinkAddrSource {
+	return &FakeLinkAddrSource{
+		RouteC: make(chan netlink.RouteUpdate, 10),
+		LinkC:  make(chan netlink.LinkUpdate, 10),
+		ErrC:   make(chan error, 10),
+	}
+}
+
+func (f *FakeLinkAddrSource) RouteUpdates() <-chan netlink.RouteUpdate {
+	return f.RouteC
+}
+
+func (f *FakeLinkAddrSource) LinkUpdates() <-chan netlink.LinkUpdate {
+	return f.LinkC
+}
+
+func (f *FakeLinkAddrSource) Errors() <-chan error {
+	return f.ErrC
+}
+
+// FilterUpdatesFromSource is a variant of FilterUpdates that reads its input from a LinkAddrSource.
+// Errors from the source are logged, counted and passed to the SourceErrorCallback, if one is
+// configured.  If the source reports a fatal error (one that wraps ErrSourceFailed), the filter
+// closes its outputs and returns the error so that the caller can resubscribe.  Otherwise, it
+// returns the same error as FilterUpdates once the context is done or the source's update channels
+// are closed.
+func (u *UpdateFilter) FilterUpdatesFromSource(ctx context.Context,
+	routeOutC chan<- netlink.RouteUpdate, linkOutC chan<- netlink.LinkUpdate,
+	src LinkAddrSource,
+) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	errLoopDone := make(chan struct{})
+	go func() {
+		defer close(errLoopDone)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-src.Errors():
+				if !ok {
+					return
+				}
+				if u.onSourceError(err) {
+					// FilterUpdates returns the cause.
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+	err := u.FilterUpdates(ctx, routeOutC, src.RouteUpdates(), linkOutC, src.LinkUpdates())
+	cancel(nil)
+	<-errLoopDone
+	return err
+}
+
+// onSourceError handles an error from a LinkAddrSource, returning true if it is fatal.
+func (u *UpdateFilter) onSourceError(err error) bool {
+	fatal := errors.Is(err, ErrSourceFailed)
+	countSourceErrors.Inc()
+	if fatal {
+		u.logCtx.WithError(err).Error("FilterUpdates: update source failed, stopping.")
+	} else {
+		u.logCtx.WithError(err).Warn("FilterUpdates: update source reported an error.")
+	}
+	if u.notify.sourceErrorCallback != nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					u.logCtx.WithField("panic", r).Error("FilterUpdates: panic from source error callback, ignoring.")
+				}
+			}()
+			u.notify.sourceErrorCallback(err, fatal)
+		}()
+	}
+	return fatal
+}
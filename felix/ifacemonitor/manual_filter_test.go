@@ -0,0 +1,72 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor_test
+
+import (
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/calico/felix/ifacemonitor"
+	"github.com/projectcalico/calico/felix/timeshim/mocktime"
+)
+
+// ManualTestFilter drives an UpdateFilter synchronously against a virtual clock.  Unlike running
+// FilterUpdates with a mock time shim, there's no need to wait for the filter goroutine to pick up
+// an update before advancing time.  ExpectQueueDrained makes gomega assertions so callers must
+// register gomega with their test first.
+type ManualTestFilter struct {
+	Filter *ifacemonitor.UpdateFilter
+
+	now      time.Time
+	nextWake time.Time
+}
+
+// NewManualTestFilter creates a ManualTestFilter whose virtual clock starts at mocktime.StartTime.
+func NewManualTestFilter(opts ...ifacemonitor.UpdateFilterOp) *ManualTestFilter {
+	return &ManualTestFilter{
+		Filter: ifacemonitor.NewUpdateFilter(opts...),
+		now:    mocktime.StartTime,
+	}
+}
+
+// Now returns the current virtual time.
+func (m *ManualTestFilter) Now() time.Time {
+	return m.now
+}
+
+// Send passes the update to the filter at the current virtual time and returns any updates that
+// the filter emitted as a result.
+func (m *ManualTestFilter) Send(upd interface{}) []interface{} {
+	emit, nextWake := m.Filter.FilterOne(m.now, upd)
+	m.nextWake = nextWake
+	return emit
+}
+
+// Advance moves the virtual clock forward, firing the filter's timer if it became due.  Returns
+// any updates that the filter released.
+func (m *ManualTestFilter) Advance(d time.Duration) []interface{} {
+	m.now = m.now.Add(d)
+	if m.nextWake.IsZero() || m.nextWake.After(m.now) {
+		return nil
+	}
+	return m.Send(nil)
+}
+
+// ExpectQueueDrained asserts that the filter is holding no updates and has no timer scheduled.
+func (m *ManualTestFilter) ExpectQueueDrained() {
+	ExpectWithOffset(1, m.Filter.QueueSnapshot()).To(BeEmpty(), "Filter still has queued updates")
+	ExpectWithOffset(1, m.nextWake.IsZero()).To(BeTrue(), "Filter still has a timer scheduled")
+}
@@ -39,26 +39,23 @@ func newRealNetlink(featureDetector environment.FeatureDetectorIface, timeout ti
 func (nl *netlinkReal) Subscribe(
 	linkUpdates chan netlink.LinkUpdate,
 	routeUpdates chan netlink.RouteUpdate,
+	errorCallback func(error),
 ) (chan struct{}, error) {
 	// Note: this method doesn't use the HandleManager because each subscription gets its own
 	// socket under the covers.
 	cancel := make(chan struct{})
 
 	if err := netlink.LinkSubscribeWithOptions(linkUpdates, cancel, netlink.LinkSubscribeOptions{
-		ErrorCallback: func(err error) {
-			// Not necessarily fatal (can be an unexpected message, which the library will drop).
-			log.WithError(err).Warn("Netlink reported an error.")
-		},
+		// Not necessarily fatal (can be an unexpected message, which the library will drop).
+		ErrorCallback: errorCallback,
 	}); err != nil {
 		log.WithError(err).Error("Failed to subscribe to link updates")
 		close(cancel)
 		return nil, err
 	}
 	if err := netlink.RouteSubscribeWithOptions(routeUpdates, cancel, netlink.RouteSubscribeOptions{
-		ErrorCallback: func(err error) {
-			// Not necessarily fatal (can be an unexpected message, which the library will drop).
-			log.WithError(err).Warn("Netlink reported an error.")
-		},
+		// Not necessarily fatal (can be an unexpected message, which the library will drop).
+		ErrorCallback: errorCallback,
 	}); err != nil {
 		log.WithError(err).Error("Failed to subscribe to route updates")
 		close(cancel)
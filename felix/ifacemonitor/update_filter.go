@@ -15,13 +15,24 @@
 package ifacemonitor
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"golang.org/x/sys/unix"
 
 	"github.com/projectcalico/calico/felix/timeshim"
@@ -29,16 +40,561 @@ import (
 
 const FlapDampingDelay = 100 * time.Millisecond
 
-type updateFilter struct {
-	Time timeshim.Interface
+const (
+	// DefaultFlapStormThreshold and DefaultFlapStormWindow define a flap storm: an address that is
+	// squashed more than DefaultFlapStormThreshold times within DefaultFlapStormWindow.
+	DefaultFlapStormThreshold = 5
+	DefaultFlapStormWindow    = time.Minute
+)
+
+const (
+	// adaptiveDampingWeight is the weight given to each new down-time sample in the moving average
+	// maintained by WithAdaptiveDamping.
+	adaptiveDampingWeight = 0.25
+	// adaptiveDampingHeadroom is the factor by which the adaptive damping delay exceeds the average
+	// down-time, so that flaps that take a little longer than average are still suppressed.
+	adaptiveDampingHeadroom = 1.5
+)
+
+// DefaultMinRetryDelay is the default for WithMinRetryDelay.
+const DefaultMinRetryDelay = time.Millisecond
+
+// DefaultMicroCoalesceWindow is the default for WithMicroCoalesceWindow.
+const DefaultMicroCoalesceWindow = time.Millisecond
+
+// DefaultShutdownTimeout is the default for WithShutdownTimeout.
+const DefaultShutdownTimeout = 100 * time.Millisecond
+
+// nilTimerPollInterval is the longest that the filter waits before re-checking the queue if its
+// time shim fails to provide a timer.
+const nilTimerPollInterval = 10 * time.Millisecond
+
+// maxRecentAddrsPerIface limits the size of the per-interface cache used by
+// WithIgnoreLifetimeOnlyChanges.
+const maxRecentAddrsPerIface = 64
+
+// UpdateFilter filters out updates that occur when IPs are quickly removed and re-added.  See
+// FilterUpdates for details of the algorithm.
+type UpdateFilter struct {
+	time           timeshim.Interface
+	logCtx         *logrus.Entry
+	tracer         trace.Tracer
+	dampingEnabled bool
+	rand           *rand.Rand
+	// initialDumpCount is the WithInitialDumpCount count.
+	initialDumpCount int
+
+	// The remaining options, grouped by what they control.
+	delays   delayOptions
+	addrs    addrOptions
+	ifaces   ifaceOptions
+	delivery deliveryOptions
+	storm    stormOptions
+	notify   notifyOptions
+
+	// breakerWindowStart and breakerWindowCount track the ingress rate for the circuit breaker; the
+	// count is the number of updates received since the start of the current window.
+	breakerWindowStart time.Time
+	breakerWindowCount int
+	// breakerOpen is set while the circuit breaker has disabled damping.
+	breakerOpen bool
+	// graceEnd is the end of the startup grace period, or the zero time if there isn't one.  Set
+	// when FilterUpdates starts, or by the first update if the filter is driven by FilterOne.
+	graceEnd time.Time
+
+	// updatesByIfaceIdx holds the queue of pending updates for each interface.  It only holds
+	// non-empty queues and it is only changed through setQueue (or, for changes to queued updates in
+	// place, markQueueChanged), which maintains the fields below.
+	updatesByIfaceIdx map[int][]timestampedUpd
+	// numQueued is the total number of queued updates.
+	numQueued int
+	// queuedIdxs holds the indexes of the interfaces that have queued updates, in ascending order.
+	queuedIdxs []int
+	// changedQueues holds the interfaces whose queues have changed since the snapshot was last
+	// published.
+	changedQueues map[int]bool
+	// queuedAddrSeqs indexes the queued address updates for each interface by coalesce key, giving
+	// the Seq of the update.  Each queue holds at most one address update per key since a new update
+	// squashes the old one.
+	queuedAddrSeqs map[int]map[string]int64
+	// nextQueueSeq is the Seq to give the next update that is queued.
+	nextQueueSeq int64
+	// nextWake is the time at which the queue next needs to be processed, or the zero time if the
+	// queue is empty.
+	nextWake time.Time
+	// lastReleaseAt is the time at which we last released an update from the queue.  Only
+	// maintained if minEmitInterval is set.
+	lastReleaseAt time.Time
+
+	// lastShimNow is the time shim's clock at the previous call to monotonicNow and monoNow is the
+	// filter's own clock at that point.  See monotonicNow.
+	lastShimNow time.Time
+	monoNow     time.Time
+
+	// warnedNilTimer is set once we've logged that the time shim returned a nil timer channel.
+	warnedNilTimer bool
+
+	// flushIfaceC carries requests from FlushInterface to the filter's goroutine.
+	flushIfaceC chan int
+	// ifaceModeC carries requests from SetInterfaceMode to the filter's goroutine.
+	ifaceModeC chan ifaceModeReq
+	// resyncC carries requests from TriggerResync to the filter's goroutine.
+	resyncC chan struct{}
+	// startupCompleteC carries the signal from StartupComplete to the filter's goroutine.
+	startupCompleteC chan struct{}
+	// pauseC wakes the filter's goroutine when Pause or Resume changes pauseRequested.
+	pauseC         chan struct{}
+	pauseRequested atomic.Bool
+	// freezeC is the channel passed to WithFreezeChan.
+	freezeC <-chan bool
+
+	// injectC carries updates from InjectForTest to the filter's goroutine.
+	injectC chan interface{}
+
+	// stopC carries the request from StopAndDrain to the filter's goroutine, which closes stoppedC
+	// when it returns.
+	stopC            chan struct{}
+	stoppedC         chan struct{}
+	forceDrainOnStop bool
+
+	// generation is the generation of the last update sent by FilterUpdatesWithGenerations.
+	generation atomic.Uint64
+
+	// primingRemaining is the number of address updates left in the initial dump.  Only meaningful
+	// while priming is set.
+	primingRemaining int
+	priming          bool
+
+	// ifaceNamesByIdx caches interface names learned from link updates so that we can map the
+	// link index that we key the queue on back to a name.
+	ifaceNamesByIdx map[int]string
+	// ifaceNameLastSeen holds the time at which we last saw an update for each interface in
+	// ifaceNamesByIdx.  Only maintained if ifaceNameTTL is set.
+	ifaceNameLastSeen map[int]time.Time
+	// nextIfaceNameEviction is the earliest time at which we next scan ifaceNamesByIdx for expired
+	// entries.
+	nextIfaceNameEviction time.Time
+
+	// recentAddrsByIfaceIdx holds the addresses most recently added to each interface (and not since
+	// deleted).  Only maintained if ignoreLifetimeOnly is set.
+	recentAddrsByIfaceIdx map[int][]netlink.Route
+
+	// flapTimesByAddr records the times at which updates for each address were recently squashed,
+	// for flap storm detection.
+	flapTimesByAddr map[flapStormKey][]time.Time
+
+	// lastSeqByAddr holds the sequence number of the newest update that we've seen for each address.
+	// Only maintained if sequenceFunc is set.
+	lastSeqByAddr map[flapStormKey]uint64
+
+	// addrDelTimesByAddr and avgDownTimeByIface are only maintained if adaptive damping is enabled.
+	// addrDelTimesByAddr records when each address was deleted, until it is re-added or the deletion
+	// is older than the maximum delay.  avgDownTimeByIface holds the moving average of the observed
+	// down-times for each interface.
+	addrDelTimesByAddr map[flapStormKey]time.Time
+	avgDownTimeByIface map[int]time.Duration
+
+	// shortCircuitedAdds records the last add for each address that we sent without queueing it, so
+	// that duplicates that arrive within the micro-coalescing window can be dropped.  Entries that
+	// have aged out of the window are swept at most once per window, at microCoalesceSweptAt.
+	shortCircuitedAdds   map[flapStormKey]shortCircuitedAdd
+	microCoalesceSweptAt time.Time
+
+	// The fields below are only maintained if netlinkHeaderLogging is set.  lastIngressID is the ID
+	// given to the most recent update from our inputs; curIngressKey identifies it while it is being
+	// processed.  takenIngressIDs holds the IDs of the updates taken from the queue in the current
+	// pass, so that we can log them when they're emitted.
+	lastIngressID   uint64
+	curIngressKey   ingressKey
+	takenIngressIDs map[ingressKey]uint64
+
+	// adminDownIfaces and suppressedAddrsByIface are only maintained if suppressDownIfaces is set.
+	// adminDownIfaces holds the interfaces whose most recent link update showed them to be
+	// administratively down.  suppressedAddrsByIface holds the latest address update for each
+	// address that changed while its interface was down, in the order that they were received.
+	adminDownIfaces        map[int]bool
+	suppressedAddrsByIface map[int][]netlink.RouteUpdate
+
+	// bypassedIfaces holds the interfaces that match bypassIface, according to the name in their
+	// most recent link update.
+	bypassedIfaces map[int]bool
+	// ignoredIfaces holds the interfaces that don't match allowIface, according to the name in
+	// their most recent link update.
+	ignoredIfaces map[int]bool
+	// untrackedIfaces holds the interfaces that were switched to pass-through because the queue
+	// already held maxTrackedIfaces interfaces when they first needed queueing.  They stay that way
+	// until they're deleted or the queue drops back below the limit.
+	untrackedIfaces map[int]bool
+
+	// macsByIface holds the hardware address from each interface's most recent link update.  Only
+	// maintained if macChangeC is set.
+	macsByIface map[int]net.HardwareAddr
+
+	// linkStatesByIface holds the name and masked flags from each interface's most recent link
+	// update.  Only maintained if linkFlagMask is set.
+	linkStatesByIface map[int]linkFlagState
+
+	// addrsSentDownstream holds the addresses whose most recent update released by the filter
+	// was an add.  Only maintained if collapseReAdds is set.
+	addrsSentDownstream map[flapStormKey]bool
+
+	// settledIfaces holds the interfaces whose queues have drained since the settled callback was
+	// last called.  Only maintained if settledCallback is set.
+	settledIfaces []int
+
+	// linksUpDownstream holds the interfaces whose most recent link update released by the filter
+	// had the link up.  Only maintained if linkFlapDamping is set.
+	linksUpDownstream map[int]bool
+
+	// snapshotLock protects the fields below, which are published by the filter's goroutine for
+	// other goroutines to read.
+	snapshotLock      sync.Mutex
+	queueDepthByIface map[int]int
+	// pendingCIDRsByIface holds the addresses of the queued address updates that weren't yet ready
+	// to send when the snapshot was published.
+	pendingCIDRsByIface map[int][]net.IPNet
+	// emittedAddrsByIface holds the addresses that are present on each interface according to the
+	// updates that the filter has forwarded downstream.  For each address, it holds the most recent
+	// add that was forwarded.
+	emittedAddrsByIface map[int][]netlink.RouteUpdate
+	// ifaceModes holds the modes set by SetInterfaceMode, other than InterfaceModeDamped.  Only the
+	// filter's goroutine writes to it so it may read it without the lock.
+	ifaceModes map[int]InterfaceMode
+
+	// stats holds counters that may be read from any goroutine via Stats().
+	stats filterStats
+	// heartbeat holds the state of the liveness and downstream heartbeats.
+	heartbeat heartbeatState
+	// outputs holds the outputs that are registered in addition to FilterUpdates' output channels.
+	outputs outputSinks
+	// primed is the published inverse of priming.  Read via Primed().
+	primed atomic.Bool
+	// nextWakeNanos is the published copy of nextWake, converted to the time shim's clock, as
+	// nanoseconds since the epoch, or 0 if the queue is empty.  Read via NextWake().
+	nextWakeNanos atomic.Int64
+}
+
+// flushIfaceReq is passed to processUpdate to make all of an interface's queued updates ready.
+type flushIfaceReq int
+
+// ErrInputClosed is wrapped by the error that FilterUpdates returns if one of its input channels is
+// closed.
+var ErrInputClosed = errors.New("input channel closed")
+
+var (
+	errLinkInputClosed  = fmt.Errorf("link updates: %w", ErrInputClosed)
+	errRouteInputClosed = fmt.Errorf("route updates: %w", ErrInputClosed)
+)
+
+// startupCompleteReq is passed to processUpdate to end the priming phase.
+type startupCompleteReq struct{}
+
+// resyncReq is passed to processUpdate to send all queued updates followed by a snapshot of the
+// addresses.
+type resyncReq struct{}
+
+// stopReq is passed to processUpdate when StopAndDrain is called.
+type stopReq struct{}
+
+type timestampedUpd struct {
+	QueuedAt time.Time
+	ReadyAt  time.Time
+	Update   interface{} // RouteUpdate or LinkUpdate
+	// Key is the coalesce key of a RouteUpdate, cached so that we don't recalculate it each time
+	// we scan the queue.  Unused for a LinkUpdate.
+	Key string
+	// IngressID identifies the update in the decision logs.  Only set if netlinkHeaderLogging is.
+	IngressID uint64
+	// Seq increases along each queue so that an update can be found by binary search.
+	Seq int64
+}
+
+// FlapCallback is called when the filter suppresses an address flap.  goneFor is the time between the
+// address being deleted and it being re-added.
+type FlapCallback func(ifaceIdx int, addr net.IPNet, goneFor time.Duration)
+
+// Decision describes what the filter decided to do with an update.  Each decision is logged with a
+// stable message (see the LogMsg constants) and the following fields, so that log pipelines can
+// parse them:
+//
+//   - ifaceIdx: the index of the interface.
+//   - addr: the address (CIDR) that the update applies to, or "" for a link update.
+//   - decision: the Decision.
+//   - readyAt: for a delay, when the update is due to be sent; for a squash, when the squashed update
+//     would have been sent; otherwise, the time of the decision.
+//   - queueDepth: the number of updates queued for the interface when the decision was made.
+type Decision string
+
+const (
+	DecisionDelay    Decision = "delay"
+	DecisionSquash   Decision = "squash"
+	DecisionEmit     Decision = "emit"
+	DecisionOverflow Decision = "overflow"
+)
+
+// Messages used for the filter's decision logs.  Overflows are logged at Warning level; the other
+// decisions at Debug level.
+const (
+	LogMsgDelay    = "FilterUpdates: delaying update"
+	LogMsgSquash   = "FilterUpdates: squashed queued update"
+	LogMsgEmit     = "FilterUpdates: emitting update"
+	LogMsgOverflow = "FilterUpdates: interface queue full, emitting update early"
+)
+
+// LogMsgPassSummary is the message of the log that WithPassSummaryLogging enables.
+const LogMsgPassSummary = "FilterUpdates: processed queue"
+
+var logMsgsByDecision = map[Decision]string{
+	DecisionDelay:    LogMsgDelay,
+	DecisionSquash:   LogMsgSquash,
+	DecisionEmit:     LogMsgEmit,
+	DecisionOverflow: LogMsgOverflow,
+}
+
+// SuppressionKind describes how the filter held back an update.
+type SuppressionKind string
+
+const (
+	// SuppressionKindDelayed means that the update was queued to damp a potential flap.
+	SuppressionKindDelayed SuppressionKind = "delayed"
+	// SuppressionKindSquashed means that a queued update was discarded in favour of a later update
+	// for the same object.
+	SuppressionKindSquashed SuppressionKind = "squashed"
+)
+
+// SuppressionEvent describes an update that the filter delayed or squashed.  Addr is nil for link
+// updates.  OldReadyAt is the time at which the affected update was due to be sent: for a squashed
+// update, the time it would have been sent had it not been squashed; for a delayed update, the time
+// that it was queued until.
+type SuppressionEvent struct {
+	IfaceIdx   int
+	Addr       *net.IPNet
+	Kind       SuppressionKind
+	OldReadyAt time.Time
+}
+
+// FlapStormCallback is called when an address flaps persistently.  numFlaps is the number of times
+// the address's updates were squashed within the flap storm window.
+type FlapStormCallback func(ifaceIdx int, addr net.IPNet, numFlaps int)
+
+type flapStormKey struct {
+	ifaceIdx    int
+	coalesceKey string
+}
+
+// ingressKey identifies a queued update for the purpose of finding its ingress ID.  The queue holds
+// at most one link update per interface and one address update per coalesce key.
+type ingressKey struct {
+	ifaceIdx    int
+	coalesceKey string
+	isLink      bool
 }
 
-type UpdateFilterOp func(filter *updateFilter)
+type shortCircuitedAdd struct {
+	route  netlink.Route
+	sentAt time.Time
+}
+
+func NewUpdateFilter(options ...UpdateFilterOp) *UpdateFilter {
+	u := &UpdateFilter{
+		time:           timeshim.RealTime(),
+		logCtx:         logrus.WithField("component", "ifacemonitor"),
+		tracer:         noop.NewTracerProvider().Tracer(""),
+		dampingEnabled: true,
+		delays: delayOptions{
+			dampingDelay:        FlapDampingDelay,
+			minRetryDelay:       DefaultMinRetryDelay,
+			microCoalesceWindow: DefaultMicroCoalesceWindow,
+		},
+		addrs: addrOptions{
+			coalesceKey:    defaultCoalesceKey,
+			coalescePolicy: CoalesceAddWins,
+		},
+		storm: stormOptions{
+			flapStormThreshold: DefaultFlapStormThreshold,
+			flapStormWindow:    DefaultFlapStormWindow,
+		},
+		updatesByIfaceIdx: map[int][]timestampedUpd{},
+		changedQueues:     map[int]bool{},
+		queueDepthByIface: map[int]int{},
+		queuedAddrSeqs:    map[int]map[string]int64{},
+		ifaceNamesByIdx:   map[int]string{},
+		ifaceNameLastSeen: map[int]time.Time{},
+		flushIfaceC:       make(chan int, 10),
+		ifaceModeC:        make(chan ifaceModeReq, 10),
+		resyncC:           make(chan struct{}, 1),
+		startupCompleteC:  make(chan struct{}, 1),
+		pauseC:            make(chan struct{}, 1),
+		injectC:           make(chan interface{}, 10),
+		stopC:             make(chan struct{}, 1),
+		stoppedC:          make(chan struct{}),
+
+		recentAddrsByIfaceIdx: map[int][]netlink.Route{},
+		pendingCIDRsByIface:   map[int][]net.IPNet{},
+		flapTimesByAddr:       map[flapStormKey][]time.Time{},
+		lastSeqByAddr:         map[flapStormKey]uint64{},
+		addrDelTimesByAddr:    map[flapStormKey]time.Time{},
+		shortCircuitedAdds:    map[flapStormKey]shortCircuitedAdd{},
+		takenIngressIDs:       map[ingressKey]uint64{},
+		avgDownTimeByIface:    map[int]time.Duration{},
+		emittedAddrsByIface:   map[int][]netlink.RouteUpdate{},
+		ifaceModes:            map[int]InterfaceMode{},
+
+		adminDownIfaces:        map[int]bool{},
+		suppressedAddrsByIface: map[int][]netlink.RouteUpdate{},
+		bypassedIfaces:         map[int]bool{},
+		untrackedIfaces:        map[int]bool{},
+		ignoredIfaces:          map[int]bool{},
+		macsByIface:            map[int]net.HardwareAddr{},
+		linkStatesByIface:      map[int]linkFlagState{},
+		addrsSentDownstream:    map[flapStormKey]bool{},
+		linksUpDownstream:      map[int]bool{},
+	}
+	for _, op := range options {
+		op(u)
+	}
+	if u.rand == nil {
+		u.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if u.delays.dampingDelay < 0 {
+		u.logCtx.WithField("delay", u.delays.dampingDelay).Warn(
+			"FilterUpdates: negative flap damping delay, clamping to zero.")
+		u.delays.dampingDelay = 0
+	}
+	u.priming = u.dampingEnabled && u.initialDumpCount > 0
+	u.primingRemaining = u.initialDumpCount
+	u.primed.Store(!u.priming)
+	return u
+}
+
+// Validate checks that the filter's options are coherent, returning an error describing any
+// conflicts.  FilterUpdates (and its variants) return the same error, without starting, if the
+// options conflict.
+func (u *UpdateFilter) Validate() error {
+	var errs []error
+	if !u.dampingEnabled {
+		for _, c := range []struct {
+			set  bool
+			name string
+		}{
+			{u.delays.dampingDelay != FlapDampingDelay, "flap damping delay"},
+			{u.delays.perInterfaceDelay != nil, "per-interface delay"},
+			{u.delays.linkDelay > 0, "link delay"},
+			{u.delays.linkFlapDamping > 0, "link flap damping"},
+			{len(u.delays.familyDelays) > 0, "family delay"},
+			{u.delays.secondaryDelay > 0, "separate secondary delay"},
+			{u.delays.addrDelay > 0, "address delay"},
+			{u.delays.adaptiveMaxDelay > 0, "adaptive damping"},
+			{u.delays.addDelay > 0, "add delay"},
+			{u.delays.timerJitter > 0, "timer jitter"},
+			{u.delays.maxDeferral > 0, "max deferral"},
+			{u.delays.minEmitInterval > 0, "minimum emit interval"},
+			{u.delivery.maxQueueDepth > 0, "max queue depth"},
+			{u.delivery.flushOnShutdown, "flush on shutdown"},
+			{u.delivery.shutdownTimeout != 0, "shutdown timeout"},
+			{u.forceDrainOnStop, "forced drain on stop"},
+			{u.freezeC != nil, "freeze channel"},
+			{u.ifaces.deletesOnIfaceRemoval, "deletes on interface removal"},
+			{u.ifaces.maxTrackedIfaces > 0, "max tracked interfaces"},
+			{u.ifaces.suppressDownIfaces, "suppress down interfaces"},
+			{u.ifaces.bypassIface != nil, "bypass interfaces"},
+			{u.ifaces.allowIface != nil, "interface allowlist"},
+			{u.initialDumpCount > 0, "initial dump count"},
+			{u.ifaces.linkFlagMask != 0, "link flag filter"},
+			{u.addrs.collapseReAdds, "collapse re-adds"},
+			{u.addrs.coalescePolicy != CoalesceAddWins, "coalesce policy"},
+			{u.notify.passSummaryLogging, "pass summary logging"},
+			{u.ifaces.ifaceGroup != nil, "interface grouping"},
+			{u.storm.breakerWindow > 0, "circuit breaker"},
+			{u.delays.startupGracePeriod > 0, "startup grace period"},
+		} {
+			if c.set {
+				errs = append(errs, fmt.Errorf("%s is set but damping is disabled", c.name))
+			}
+		}
+	}
+	if (u.addrs.ignoreSecondary || u.delays.secondaryDelay > 0) && u.addrs.secondaryFunc == nil {
+		errs = append(errs, errors.New("secondary address handling is set but there is no secondary address function"))
+	}
+	if u.addrs.suppressTentative && u.addrs.tentativeFunc == nil {
+		errs = append(errs, errors.New("tentative address suppression is set but there is no tentative address function"))
+	}
+	for family := range u.delays.familyDelays {
+		if family != unix.AF_INET && family != unix.AF_INET6 {
+			errs = append(errs, fmt.Errorf("family delay set for unknown address family %d", family))
+		}
+	}
+	switch u.addrs.coalescePolicy {
+	case CoalesceAddWins, CoalesceDeleteWins, CoalesceNewest:
+	default:
+		errs = append(errs, fmt.Errorf("unknown coalesce policy %q", u.addrs.coalescePolicy))
+	}
+	if u.delays.adaptiveMaxDelay > 0 && u.delays.adaptiveMinDelay > u.delays.adaptiveMaxDelay {
+		errs = append(errs, fmt.Errorf("adaptive damping minimum delay (%v) is greater than its maximum (%v)",
+			u.delays.adaptiveMinDelay, u.delays.adaptiveMaxDelay))
+	}
+	if u.delivery.shutdownTimeout != 0 && !u.delivery.flushOnShutdown {
+		errs = append(errs, errors.New("shutdown timeout is set but flush on shutdown is not"))
+	}
+	if u.delivery.requeueOnSendTimeout && u.delivery.sendTimeout <= 0 {
+		errs = append(errs, errors.New("re-queue on send timeout is set but there is no send timeout"))
+	}
+	if u.notify.flapStormCallback != nil && u.storm.flapStormThreshold <= 0 {
+		errs = append(errs, errors.New("flap storm callback is set but flap storm detection is disabled"))
+	}
+	return errors.Join(errs...)
+}
+
+// ifaceLogCtx returns a log context for the given interface, including its name, if known.
+func (u *UpdateFilter) ifaceLogCtx(idx int) *logrus.Entry {
+	if name, ok := u.ifaceNamesByIdx[idx]; ok {
+		return u.logCtx.WithFields(logrus.Fields{
+			"ifaceIdx":  idx,
+			"ifaceName": name,
+		})
+	}
+	return u.logCtx.WithField("ifaceIdx", idx)
+}
 
-func WithTimeShim(t timeshim.Interface) UpdateFilterOp {
-	return func(filter *updateFilter) {
-		filter.Time = t
+// dampingDelayForIface returns the damping delay for the given link or address update.
+func (u *UpdateFilter) dampingDelayForIface(idx int, upd interface{}) time.Duration {
+	delay := u.delays.dampingDelay
+	switch upd := upd.(type) {
+	case netlink.LinkUpdate:
+		if u.delays.linkDelay > 0 {
+			delay = u.delays.linkDelay
+		}
+	case netlink.RouteUpdate:
+		if u.delays.addrDelay > 0 {
+			delay = u.delays.addrDelay
+		}
+		if d := u.delays.familyDelays[updateFamily(upd)]; d > 0 {
+			delay = d
+		}
+		if u.delays.secondaryDelay > 0 && u.isSecondary(upd) {
+			delay = u.delays.secondaryDelay
+		}
 	}
+	if avg, ok := u.avgDownTimeByIface[idx]; ok {
+		delay = time.Duration(float64(avg) * adaptiveDampingHeadroom)
+		if delay < u.delays.adaptiveMinDelay {
+			delay = u.delays.adaptiveMinDelay
+		}
+		if delay > u.delays.adaptiveMaxDelay {
+			delay = u.delays.adaptiveMaxDelay
+		}
+	}
+	if u.delays.perInterfaceDelay != nil {
+		if name, ok := u.ifaceNamesByIdx[idx]; ok {
+			if d := u.delays.perInterfaceDelay(name); d > 0 {
+				delay = d
+			}
+		}
+	}
+	if delay > 0 && u.delays.timerJitter > 0 {
+		delay += time.Duration(u.rand.Int63n(int64(u.delays.timerJitter)))
+	}
+	return delay
 }
 
 // FilterUpdates filters out updates that occur when IPs are quickly removed and re-added.
@@ -48,198 +604,2653 @@ func WithTimeShim(t timeshim.Interface) UpdateFilterOp {
 // * Maintain a queue of link and address updates per interface.
 // * When we see a potential flap (i.e. an IP deletion), defer processing the queue for a while.
 // * If the flap resolves itself (i.e. the IP is added back), suppress the IP deletion.
+// * Send each interface's updates in the order they were received, less any that were squashed.
+//
+// IPv4 and IPv6 address updates are damped independently so they may overtake each other.
+//
+// The return value is as for UpdateFilter.FilterUpdates.
 func FilterUpdates(ctx context.Context,
 	routeOutC chan<- netlink.RouteUpdate, routeInC <-chan netlink.RouteUpdate,
 	linkOutC chan<- netlink.LinkUpdate, linkInC <-chan netlink.LinkUpdate,
 	options ...UpdateFilterOp,
-) {
+) error {
+	return NewUpdateFilter(options...).FilterUpdates(ctx, routeOutC, routeInC, linkOutC, linkInC)
+}
+
+// validateVariant is Validate for the variants of FilterUpdates that run the filter with their own
+// sink.
+func (u *UpdateFilter) validateVariant() error {
+	return errors.Join(u.Validate(), u.checkVariantOutputs())
+}
+
+// checkVariantOutputs returns an error if the filter has additional or typed outputs.  Only
+// FilterUpdates sets those up; the variants would silently ignore them.
+func (u *UpdateFilter) checkVariantOutputs() error {
+	var err error
+	if len(u.outputs.additional) > 0 {
+		err = errors.Join(err, errAdditionalOutputsUnsupported)
+	}
+	if len(u.outputs.typed) > 0 {
+		err = errors.Join(err, errTypedOutputsUnsupported)
+	}
+	return err
+}
+
+var (
+	errAdditionalOutputsUnsupported = errors.New("additional outputs are only supported by UpdateFilter.FilterUpdates")
+	errTypedOutputsUnsupported      = errors.New("typed outputs are only supported by UpdateFilter.FilterUpdates")
+	errFilterStopped                = errors.New("filter has stopped")
+)
+
+// FilterUpdates runs the filter's main loop, reading updates from the input channels and writing
+// filtered updates to the output channels.  It returns when the context is done or one of the input
+// channels is closed, closing the output channels.
+//
+// If the context is done, FilterUpdates returns context.Cause(ctx), which allows the caller to tell
+// a deadline (context.DeadlineExceeded) from a cancellation.  If an input channel is closed, it
+// returns an error wrapping ErrInputClosed.  If the filter's options conflict, it returns the error
+// from Validate straight away.
+func (u *UpdateFilter) FilterUpdates(ctx context.Context,
+	routeOutC chan<- netlink.RouteUpdate, routeInC <-chan netlink.RouteUpdate,
+	linkOutC chan<- netlink.LinkUpdate, linkInC <-chan netlink.LinkUpdate,
+) error {
 	// Propagate failures to the downstream channels.
 	defer close(routeOutC)
 	defer close(linkOutC)
+	defer u.closeTypedOutputs()
 
-	u := &updateFilter{
-		Time: timeshim.RealTime(),
+	var sink updateSink = &chanSink{
+		filter:    u,
+		routeOutC: routeOutC,
+		linkOutC:  linkOutC,
 	}
-	for _, op := range options {
-		op(u)
+	if len(u.outputs.additional) > 0 {
+		outCtx, cancelOut := context.WithCancel(context.Background())
+		others := make([]*additionalOutput, len(u.outputs.additional))
+		for i, o := range u.outputs.additional {
+			others[i] = &additionalOutput{
+				consumer: i,
+				sink:     o,
+				pendingC: make(chan []interface{}, additionalOutputBufferSize),
+				done:     make(chan struct{}),
+			}
+			go others[i].run(outCtx)
+		}
+		defer func() {
+			// Stop the senders before closing their channels.  Anything still buffered is sent
+			// only if the consumer can accept it immediately.
+			cancelOut()
+			for _, o := range others {
+				close(o.pendingC)
+				<-o.done
+				close(o.sink.routeOutC)
+				close(o.sink.linkOutC)
+			}
+		}()
+		sink = &fanOutSink{
+			primary: sink,
+			others:  others,
+		}
 	}
+	return u.run(ctx, routeInC, linkInC, sink)
+}
 
-	logrus.Debug("FilterUpdates: starting")
-	var timerC <-chan time.Time
+// run is the main loop of FilterUpdates.  It is shared between UpdateFilter and
+// BatchingUpdateFilter, which differ only in how they send updates downstream.
+func (u *UpdateFilter) run(ctx context.Context,
+	routeInC <-chan netlink.RouteUpdate, linkInC <-chan netlink.LinkUpdate,
+	sink updateSink,
+) error {
+	defer close(u.stoppedC)
+	if err := u.Validate(); err != nil {
+		return fmt.Errorf("conflicting filter options: %w", err)
+	}
+	if !u.dampingEnabled {
+		u.logCtx.Info("FilterUpdates: flap damping disabled, passing updates through.")
+		return u.passThroughUpdates(ctx, routeInC, linkInC, sink)
+	}
 
-	type timestampedUpd struct {
-		ReadyAt time.Time
-		Update  interface{} // RouteUpdate or LinkUpdate
+	if u.outputs.tap != nil {
+		tap := &tapWorker{
+			filter:   u,
+			pendingC: make(chan []interface{}, tapBufferSize),
+		}
+		go tap.run()
+		// Don't wait for the tap to catch up; a slow tap mustn't hold up shutdown.
+		defer close(tap.pendingC)
+		sink = &tapSink{next: sink, tap: tap}
 	}
 
-	updatesByIfaceIdx := map[int][]timestampedUpd{}
+	u.logCtx.Debug("FilterUpdates: starting")
+	if u.delays.startupGracePeriod > 0 {
+		u.graceEnd = u.monotonicNow().Add(u.delays.startupGracePeriod)
+	}
+	// The timers are reused so that a busy filter doesn't allocate a new timer each time the queue's
+	// wake time changes, or each heartbeat.
+	var timer, pollTimer, heartbeatTimer, idleTimer reusableTimer
+	defer func() {
+		timer.stop()
+		pollTimer.stop()
+		heartbeatTimer.stop()
+		idleTimer.stop()
+	}()
+	var timerC <-chan time.Time
+	var timerDue time.Time
+	heartbeatC := u.heartbeatC(&heartbeatTimer)
+	u.heartbeat.lastEmitAt = u.monotonicNow()
+	idleC := u.idleC(&idleTimer)
+	// While paused or frozen, heldUpds holds the updates that the filter would have sent.
+	paused := u.pauseRequested.Load()
+	frozen := false
+	freezeC := u.freezeC
+	var heldUpds []interface{}
+	// Once StopAndDrain has been called, we stop reading our inputs and return once the queue is empty.
+	draining := false
+	injectC := u.injectC
 
-mainLoop:
 	for {
+		u.markActive()
+		var upd interface{}
 		select {
 		case <-ctx.Done():
-			logrus.Info("FilterUpdates: Context expired, stopping")
-			return
+			u.logCtx.Info("FilterUpdates: Context expired, stopping")
+			if u.delivery.flushOnShutdown {
+				if len(heldUpds) > 0 {
+					now := u.monotonicNow()
+					u.requeueUpdates(now, heldUpds, now)
+				}
+				u.flushQueuedUpdates(sink)
+			}
+			return context.Cause(ctx)
 		case linkUpd, ok := <-linkInC:
 			if !ok {
-				logrus.Error("FilterUpdates: link input channel closed.")
-				return
-			}
-			idx := int(linkUpd.Index)
-			linkIsUp := linkUpd.Header.Type == syscall.RTM_NEWLINK && LinkIsOperUp(linkUpd.Link)
-			var delay time.Duration
-			if linkIsUp {
-				if len(updatesByIfaceIdx[idx]) == 0 {
-					// Empty queue (so no flap in progress) and the link is up, no need to delay the message.
-					linkOutC <- linkUpd
-					continue mainLoop
-				}
-				// Link is up but potential flap in progress, queue the update behind the other messages.
-				delay = 0
-			} else {
-				// We delay link down updates because a flap can involve both a link down and an IP removal.
-				// Since we receive those two messages over separate channels, the two messages can race.
-				delay = FlapDampingDelay
+				u.logCtx.Error("FilterUpdates: link input channel closed.")
+				return errLinkInputClosed
 			}
-
-			updatesByIfaceIdx[idx] = append(updatesByIfaceIdx[idx],
-				timestampedUpd{
-					ReadyAt: u.Time.Now().Add(delay),
-					Update:  linkUpd,
-				})
+			countIngress(linkUpd)
+			upd = linkUpd
 		case routeUpd, ok := <-routeInC:
 			if !ok {
-				logrus.Error("FilterUpdates: route input channel closed.")
-				return
+				u.logCtx.Error("FilterUpdates: route input channel closed.")
+				return errRouteInputClosed
+			}
+			countIngress(routeUpd)
+			upd = routeUpd
+		case upd = <-injectC:
+			countIngress(upd)
+		case <-u.stopC:
+			u.logCtx.WithField("numQueuedIfaces", len(u.updatesByIfaceIdx)).Info(
+				"FilterUpdates: stop requested, draining queue.")
+			draining = true
+			routeInC, linkInC, injectC, freezeC = nil, nil, nil, nil
+			if paused || frozen {
+				// We'd never drain the queue while paused or frozen.
+				u.logCtx.WithField("numHeld", len(heldUpds)).Info("FilterUpdates: resuming to drain queue.")
+				paused, frozen = false, false
 			}
-			logrus.WithField("route", routeUpd).Debug("Route update")
-			if !routeIsLocalUnicast(routeUpd.Route) {
-				logrus.WithField("route", routeUpd).Debug("Ignoring non-local route.")
+			upd = stopReq{}
+		case <-timerC:
+			u.logCtx.Debug("FilterUpdates: timer popped.")
+			timerC = nil
+		case idx := <-u.flushIfaceC:
+			upd = flushIfaceReq(idx)
+		case req := <-u.ifaceModeC:
+			upd = req
+		case <-u.resyncC:
+			upd = resyncReq{}
+		case <-u.startupCompleteC:
+			upd = startupCompleteReq{}
+		case <-u.pauseC:
+			if draining || u.pauseRequested.Load() == paused {
 				continue
 			}
-			if routeUpd.LinkIndex == 0 {
-				logrus.WithField("route", routeUpd).Debug("Ignoring route with no link index.")
+			paused = !paused
+			if paused {
+				u.logCtx.Info("FilterUpdates: paused.")
+				timerC = nil
 				continue
 			}
-
-			idx := routeUpd.LinkIndex
-			oldUpds := updatesByIfaceIdx[idx]
-
-			var readyToSendTime time.Time
-			if routeUpd.Type == unix.RTM_NEWROUTE {
-				logrus.WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address ADD")
-				if len(oldUpds) == 0 {
-					// This is an add for a new IP and there's nothing else in the queue for this interface.
-					// Short circuit.  We care about flaps where IPs are temporarily removed so no need to
-					// delay an add.
-					logrus.Debug("FilterUpdates: add with empty queue, short circuit.")
-					routeOutC <- routeUpd
-					continue
-				}
-
-				// Else, there's something else in the queue, need to process the queue...
-				logrus.Debug("FilterUpdates: add with non-empty queue.")
-				// We don't actually need to delay the add itself so we don't set any delay here.  It will
-				// still be queued up behind other updates.
-				readyToSendTime = u.Time.Now()
-			} else {
-				// Got a delete, it might be a flap so queue the update.
-				logrus.WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address DEL")
-				readyToSendTime = u.Time.Now().Add(FlapDampingDelay)
-			}
-
-			// Coalesce updates for the same IP by squashing any previous updates for the same CIDR before
-			// we append this update to the queue.  We need to scan the whole queue because there may be
-			// updates for different IPs in flight.
-			upds := oldUpds[:0]
-			for _, upd := range oldUpds {
-				logrus.WithField("previous", upd).Debug("FilterUpdates: examining previous update.")
-				if oldAddrUpd, ok := upd.Update.(netlink.RouteUpdate); ok {
-					if ipNetsEqual(oldAddrUpd.Dst, routeUpd.Dst) {
-						// New update for the same IP, suppress the old update
-						logrus.WithField("address", oldAddrUpd.Dst.String()).Debug(
-							"Received update for same IP within a short time, squashed the old update.")
-						continue
-					}
-				}
-				upds = append(upds, upd)
+			// Process the queue, as if the timer had popped, and send what we held on to (unless
+			// we're still frozen).
+			u.logCtx.WithField("numHeld", len(heldUpds)).Info("FilterUpdates: resumed.")
+		case f, ok := <-freezeC:
+			if !ok {
+				u.logCtx.Info("FilterUpdates: freeze channel closed.")
+				freezeC = nil
+				f = false
 			}
-			upds = append(upds, timestampedUpd{ReadyAt: readyToSendTime, Update: routeUpd})
-			updatesByIfaceIdx[idx] = upds
-		case <-timerC:
-			logrus.Debug("FilterUpdates: timer popped.")
-			timerC = nil
+			if f == frozen {
+				continue
+			}
+			frozen = f
+			if frozen {
+				u.logCtx.Info("FilterUpdates: frozen.")
+				timerC = nil
+				continue
+			}
+			u.logCtx.WithField("numHeld", len(heldUpds)).Info("FilterUpdates: thawed.")
+		case <-heartbeatC:
+			heartbeatC = u.heartbeatC(&heartbeatTimer)
+			continue
+		case <-idleC:
+			if !paused && !frozen {
+				u.onIdleTimer(ctx, sink)
+			}
+			idleC = u.idleC(&idleTimer)
+			continue
 		}
 
-		if timerC != nil {
-			// Optimisation: we much have just queued an update but there's already a timer set and we know
-			// that timer must pop before the one for the new update.  Skip recalculating the timer.
-			logrus.Debug("FilterUpdates: timer already set.")
-			continue mainLoop
-		}
-
-		var nextUpdTime time.Time
-		for idx, upds := range updatesByIfaceIdx {
-			logrus.WithField("ifaceIdx", idx).Debug("FilterUpdates: examining updates for interface.")
-			for len(upds) > 0 {
-				firstUpd := upds[0]
-				if u.Time.Since(firstUpd.ReadyAt) >= 0 {
-					// Either update is old enough to prevent flapping or it's an address being added.
-					// Ready to send...
-					logrus.WithField("update", firstUpd).Debug("FilterUpdates: update ready to send.")
-					switch u := firstUpd.Update.(type) {
-					case netlink.RouteUpdate:
-						routeOutC <- u
-					case netlink.LinkUpdate:
-						linkOutC <- u
-					}
-					upds = upds[1:]
-				} else {
-					// Update is too new, figure out when it'll be safe to send it.
-					logrus.WithField("update", firstUpd).Debug("FilterUpdates: update not ready.")
-					if nextUpdTime.IsZero() || firstUpd.ReadyAt.Before(nextUpdTime) {
-						nextUpdTime = firstUpd.ReadyAt
-					}
-					break
+		_, span := u.tracer.Start(ctx, "ifacemonitor.FilterUpdates")
+		now := u.monotonicNow()
+		emit, nextWake := u.processUpdate(now, upd)
+		if paused || frozen {
+			// Hold on to the updates until we're resumed.  The timer stays off; updates that become
+			// ready in the meantime are sent on resume.
+			heldUpds = append(heldUpds, emit...)
+			span.End()
+			continue
+		}
+		if len(heldUpds) > 0 {
+			emit = append(heldUpds, emit...)
+			heldUpds = nil
+		}
+		unsent := sink.send(ctx, emit)
+		span.End()
+		u.onForwarded(emit, unsent)
+		if len(unsent) > 0 {
+			if ctx.Err() != nil {
+				u.logCtx.Info("FilterUpdates: Context expired while sending updates, stopping")
+				if u.delivery.flushOnShutdown {
+					// The unsent updates have already been taken off the queue; put them back so
+					// that the flush sees them.
+					now = u.monotonicNow()
+					u.requeueUpdates(now, unsent, now)
+					u.flushQueuedUpdates(sink)
 				}
+				return context.Cause(ctx)
 			}
-			if len(upds) == 0 {
-				logrus.WithField("ifaceIdx", idx).Debug("FilterUpdates: no more updates for interface.")
-				delete(updatesByIfaceIdx, idx)
-			} else {
-				logrus.WithField("ifaceIdx", idx).WithField("num", len(upds)).Debug(
-					"FilterUpdates: still updates for interface.")
-				updatesByIfaceIdx[idx] = upds
-			}
+			now = u.monotonicNow()
+			nextWake = u.onSendTimeout(now, unsent)
+		}
+		u.notifySettled()
+		if draining && len(u.updatesByIfaceIdx) == 0 {
+			u.logCtx.Info("FilterUpdates: queue drained, stopping")
+			return nil
 		}
 
-		if nextUpdTime.IsZero() {
+		if nextWake.IsZero() {
 			// Queue is empty so no need to schedule a timer.
-			continue mainLoop
+			continue
+		}
+		if timerC != nil && nextWake.Equal(timerDue) {
+			u.logCtx.Debug("FilterUpdates: timer already set.")
+			continue
 		}
 
 		// Schedule timer to process the rest of the queue.
-		delay := u.Time.Until(nextUpdTime)
-		if delay <= 0 {
-			delay = 1
+		delay := u.timerDelay(now, nextWake)
+		u.logCtx.WithField("delay", delay).Debug("FilterUpdates: calculated delay.")
+		timerC = timer.reset(u.time, delay)
+		if timerC == nil {
+			// Shouldn't happen with a real timer but a misbehaving time shim would otherwise leave
+			// us waiting forever.  Fall back to a real timer.  The shim's clock may not track real
+			// time so cap the delay and poll the queue until the update is ready.
+			if !u.warnedNilTimer {
+				u.logCtx.Warn("FilterUpdates: time shim returned nil timer channel, polling queue instead.")
+				u.warnedNilTimer = true
+			}
+			timerC = pollTimer.reset(timeshim.RealTime(), min(delay, nilTimerPollInterval))
 		}
-		logrus.WithField("delay", delay).Debug("FilterUpdates: calculated delay.")
-		timerC = u.Time.After(delay)
+		timerDue = nextWake
 	}
 }
 
-func ipNetsEqual(a *net.IPNet, b *net.IPNet) bool {
-	if a == b {
-		return true
+// reusableTimer is a timer from the time shim that is created on first use and then reset, so that
+// code that waits repeatedly (the main loop, and each send that has a timeout) doesn't allocate a
+// new timer each time.  It isn't safe for concurrent use.
+type reusableTimer struct {
+	timer timeshim.Timer
+}
+
+// reset arms the timer to fire after the given delay, using the given time shim to create it if
+// needed, and returns its channel.  The channel is nil if the shim didn't return a timer.  A tick
+// from the timer's previous use that wasn't received (because the caller stopped listening, for
+// example while paused) is discarded.
+func (r *reusableTimer) reset(shim timeshim.Interface, delay time.Duration) <-chan time.Time {
+	if r.timer == nil {
+		r.timer = shim.NewTimer(delay)
+		if r.timer == nil {
+			return nil
+		}
+		return r.timer.Chan()
 	}
-	if a == nil || b == nil {
-		return false
+	r.stop()
+	r.timer.Reset(delay)
+	return r.timer.Chan()
+}
+
+// stop stops the timer, if it has been created, discarding any tick that wasn't received.
+func (r *reusableTimer) stop() {
+	if r.timer == nil {
+		return
+	}
+	if !r.timer.Stop() {
+		select {
+		case <-r.timer.Chan():
+		default:
+		}
 	}
-	aSize, aBits := a.Mask.Size()
-	bSize, bBits := b.Mask.Size()
-	return a.IP.Equal(b.IP) && aSize == bSize && aBits == bBits
 }
 
-func routeIsLocalUnicast(route netlink.Route) bool {
-	return route.Type == unix.RTN_LOCAL
+// timerDelay returns how long to wait before processing the queue at nextWake, no less than the
+// minimum retry delay.
+func (u *UpdateFilter) timerDelay(now, nextWake time.Time) time.Duration {
+	delay := nextWake.Sub(now)
+	if delay < u.delays.minRetryDelay {
+		delay = u.delays.minRetryDelay
+	}
+	return delay
+}
+
+// FilterOne synchronously passes a single update through the filter, as if it had been received by
+// FilterUpdates at the given time.  upd should be a netlink.RouteUpdate or netlink.LinkUpdate, or nil
+// to simply process the queue (as FilterUpdates does when its timer pops).  It returns the updates that
+// should be sent downstream, in order, and the time at which the queue should next be processed (or
+// the zero time if the queue is empty).
+//
+// FilterOne is intended for testing the filter's decisions without channels or a time shim; it must
+// not be called concurrently with FilterUpdates.
+func (u *UpdateFilter) FilterOne(now time.Time, upd interface{}) (emit []interface{}, nextWake time.Time) {
+	defer u.notifySettled()
+	return u.processUpdate(now, upd)
+}
+
+// processUpdate is the core of the filter: it queues (or short-circuits) the given update and then,
+// if needed, sends any queued updates that have become ready.
+func (u *UpdateFilter) processUpdate(now time.Time, upd interface{}) (emit []interface{}, nextWake time.Time) {
+	defer u.publishSnapshot(now)
+	if u.notify.netlinkHeaderLogging {
+		u.onIngress(upd)
+	}
+	defer func() {
+		for _, e := range emit {
+			u.logDecision(DecisionEmit, e, u.emittedIngressID(e), now)
+			if u.addrs.collapseReAdds {
+				u.recordSentDownstream(e)
+			}
+			if u.delays.linkFlapDamping > 0 {
+				u.recordLinkSentDownstream(e)
+			}
+		}
+	}()
+	u.updateOldestPendingGauge(now)
+	if u.delays.startupGracePeriod > 0 && u.graceEnd.IsZero() {
+		u.graceEnd = now.Add(u.delays.startupGracePeriod)
+	}
+	if u.ifaces.ifaceNameTTL > 0 {
+		u.evictExpiredIfaceNames(now, upd)
+	}
+
+	// Set if we queue a delayed update that is due before the current wake time.  This can happen
+	// because the damping delay may vary per interface.
+	var dueBeforeWake bool
+	switch upd := upd.(type) {
+	case nil:
+		// Timer popped, always process the queue.
+		return u.drainReady(now), u.nextWake
+	case flushIfaceReq:
+		u.onFlushIface(now, int(upd))
+	case ifaceModeReq:
+		u.onIfaceModeReq(upd)
+	case resyncReq:
+		emit = u.onResync(now, emit)
+	case stopReq:
+		if u.forceDrainOnStop {
+			for _, idx := range u.queuedIfaceIdxs() {
+				u.onFlushIface(now, idx)
+			}
+		}
+	case startupCompleteReq:
+		if u.priming {
+			u.logCtx.WithField("numRemaining", u.primingRemaining).Info(
+				"FilterUpdates: startup complete, ending initial dump early.")
+			u.endPriming()
+		}
+	case netlink.LinkUpdate:
+		u.recordUpdate(now, upd)
+		if !u.checkIfaceIndex(upd) {
+			break
+		}
+		if u.ifaces.allowIface != nil && u.updateIgnored(upd) {
+			break
+		}
+		if len(u.ifaceModes) > 0 && upd.Header.Type != syscall.RTM_DELLINK {
+			var handled bool
+			if emit, handled = u.applyIfaceMode(int(upd.Index), upd, emit); handled {
+				break
+			}
+		}
+		if u.notify.macChangeC != nil {
+			u.checkMACChange(upd)
+		}
+		if u.ifaces.linkFlagMask != 0 && !u.linkFlagsChanged(upd) {
+			u.ifaceLogCtx(int(upd.Index)).Debug(
+				"FilterUpdates: link update doesn't change any flags of interest, dropping.")
+			break
+		}
+		if u.ifaces.bypassIface != nil && u.updateBypass(upd) {
+			// Send anything that was queued before the interface was bypassed first, to preserve
+			// ordering.
+			emit = u.takeQueuedUpdates(now, int(upd.Index), emit)
+			emit = append(emit, upd)
+			break
+		}
+		if u.storm.breakerWindow > 0 {
+			emit = u.updateCircuitBreaker(now, emit)
+			// The open breaker only stops updates from being queued; deletions still need the
+			// interface's state to be cleaned up, which onLinkUpdate does.
+			if u.breakerOpen && upd.Header.Type != syscall.RTM_DELLINK {
+				u.recordIfaceName(now, upd)
+				emit = append(emit, upd)
+				break
+			}
+		}
+		if u.ifaces.maxTrackedIfaces > 0 && upd.Header.Type != syscall.RTM_DELLINK && u.isUntrackedIface(int(upd.Index)) {
+			emit = append(emit, upd)
+			break
+		}
+		_, wasTracked := u.updatesByIfaceIdx[int(upd.Index)]
+		emit, dueBeforeWake = u.onLinkUpdate(now, upd, emit)
+		if u.ifaces.suppressDownIfaces {
+			var replayedDueBeforeWake bool
+			emit, replayedDueBeforeWake = u.onLinkAdminState(now, upd, emit)
+			dueBeforeWake = dueBeforeWake || replayedDueBeforeWake
+		}
+		if u.ifaces.maxTrackedIfaces > 0 && !wasTracked {
+			emit = u.enforceMaxTrackedIfaces(now, int(upd.Index), emit)
+		}
+	case netlink.RouteUpdate:
+		u.recordUpdate(now, upd)
+		if !u.checkIfaceIndex(upd) {
+			break
+		}
+		if u.ignoredIfaces[upd.LinkIndex] {
+			break
+		}
+		if len(u.ifaceModes) > 0 {
+			var handled bool
+			if emit, handled = u.applyIfaceMode(upd.LinkIndex, upd, emit); handled {
+				break
+			}
+		}
+		if u.bypassedIfaces[upd.LinkIndex] {
+			if u.shouldProcessRouteUpdate(upd) {
+				emit = append(emit, upd)
+			}
+			break
+		}
+		if u.priming {
+			emit = u.onPrimingRouteUpdate(now, upd, emit)
+			break
+		}
+		if u.storm.breakerWindow > 0 {
+			emit = u.updateCircuitBreaker(now, emit)
+			if u.breakerOpen {
+				if u.shouldProcessRouteUpdate(upd) {
+					emit = append(emit, upd)
+				}
+				break
+			}
+		}
+		if u.ifaces.maxTrackedIfaces > 0 && u.shouldProcessRouteUpdate(upd) && u.isUntrackedIface(upd.LinkIndex) {
+			emit = append(emit, upd)
+			break
+		}
+		_, wasTracked := u.updatesByIfaceIdx[upd.LinkIndex]
+		emit, dueBeforeWake = u.onRouteUpdate(now, upd, emit)
+		if u.ifaces.maxTrackedIfaces > 0 && !wasTracked {
+			emit = u.enforceMaxTrackedIfaces(now, upd.LinkIndex, emit)
+		}
+	default:
+		if _, ok := u.outputs.typed[reflect.TypeOf(upd)]; ok {
+			emit = append(emit, upd)
+			break
+		}
+		u.onUnknownUpdate(upd)
+	}
+
+	if u.delays.maxDeferral > 0 && now.Add(u.delays.maxDeferral).Before(u.nextWake) {
+		// The new update's deferral deadline comes before the current wake time.
+		dueBeforeWake = true
+	}
+	if !u.nextWake.IsZero() && !dueBeforeWake {
+		// Optimisation: we much have just queued an update but there's already a wake time set and we
+		// know that it must come before the one for the new update.  Skip processing the queue.
+		return emit, u.nextWake
+	}
+
+	emit, u.nextWake = u.sendReadyUpdates(now, emit)
+	return emit, u.nextWake
+}
+
+// onPrimingRouteUpdate handles an address update from the initial dump by sending it straight
+// away.  Anything already queued for the interface goes first so that the order is preserved.
+func (u *UpdateFilter) onPrimingRouteUpdate(now time.Time, routeUpd netlink.RouteUpdate, emit []interface{}) []interface{} {
+	if !u.shouldProcessRouteUpdate(routeUpd) {
+		return emit
+	}
+	emit = u.takeQueuedUpdates(now, routeUpd.LinkIndex, emit)
+	emit = append(emit, routeUpd)
+	u.primingRemaining--
+	if u.primingRemaining <= 0 {
+		u.logCtx.Info("FilterUpdates: initial dump complete.")
+		u.endPriming()
+	}
+	return emit
+}
+
+func (u *UpdateFilter) endPriming() {
+	u.priming = false
+	u.primed.Store(true)
+}
+
+// StartupComplete tells the filter that the initial dump configured by WithInitialDumpCount is over,
+// even if fewer address updates than expected have arrived.  It is safe to call from any goroutine
+// and has no effect if the filter has already finished priming.
+func (u *UpdateFilter) StartupComplete() {
+	select {
+	case u.startupCompleteC <- struct{}{}:
+	default:
+	}
+}
+
+// Pause stops the filter from sending updates, for example while the consumer does a large
+// reprogram.  While paused, the filter keeps reading and queueing updates, so its inputs never
+// block, but it holds on to the updates that it would have sent and it doesn't process the queue
+// when updates become ready.  Resume undoes Pause.  Pause and Resume are safe to call from any
+// goroutine; the filter acts on the most recent call.  If Pause is called before FilterUpdates,
+// the filter starts paused.  They have no effect if damping is disabled.
+func (u *UpdateFilter) Pause() {
+	u.pauseRequested.Store(true)
+	u.signalPause()
+}
+
+// Resume makes a paused filter send the updates that it held on to, followed by any queued updates
+// that are ready, and then carry on as normal.
+func (u *UpdateFilter) Resume() {
+	u.pauseRequested.Store(false)
+	u.signalPause()
+}
+
+func (u *UpdateFilter) signalPause() {
+	select {
+	case u.pauseC <- struct{}{}:
+	default:
+		// Already signalled; the filter will pick up the latest state.
+	}
+}
+
+// Primed returns true once the filter has finished handling the initial dump (or immediately if
+// WithInitialDumpCount isn't set).  It is safe to call from any goroutine.
+func (u *UpdateFilter) Primed() bool {
+	return u.primed.Load()
+}
+
+// evictExpiredIfaceNames refreshes the last-seen time of the interface that the update applies to
+// and, at most once per TTL, evicts the names of interfaces that we haven't seen recently.
+func (u *UpdateFilter) evictExpiredIfaceNames(now time.Time, upd interface{}) {
+	switch upd.(type) {
+	case netlink.LinkUpdate, netlink.RouteUpdate:
+		idx := updateIfaceIdx(upd)
+		if _, ok := u.ifaceNamesByIdx[idx]; ok {
+			u.ifaceNameLastSeen[idx] = now
+		}
+	}
+	if now.Before(u.nextIfaceNameEviction) {
+		return
+	}
+	u.nextIfaceNameEviction = now.Add(u.ifaces.ifaceNameTTL)
+	for idx := range u.ifaceNamesByIdx {
+		if len(u.updatesByIfaceIdx[idx]) > 0 {
+			continue
+		}
+		if lastSeen, ok := u.ifaceNameLastSeen[idx]; ok && now.Sub(lastSeen) < u.ifaces.ifaceNameTTL {
+			continue
+		}
+		u.ifaceLogCtx(idx).Debug("FilterUpdates: evicting cached interface name.")
+		delete(u.ifaceNamesByIdx, idx)
+		delete(u.ifaceNameLastSeen, idx)
+	}
+}
+
+// FlushInterface asks the filter to stop damping the given interface's queued updates and send them
+// on its next iteration.  For example, it can be used when the interface is known to be going away,
+// to avoid waiting out the damping delay on its address deletions.
+//
+// FlushInterface is safe to call from any goroutine.  It is only a hint: updates for the interface
+// that are still in flight from the kernel may arrive after the flush, in which case they are damped
+// as normal.  If the filter is not keeping up with requests, the request may be dropped.
+func (u *UpdateFilter) FlushInterface(idx int) {
+	select {
+	case u.flushIfaceC <- idx:
+	default:
+		u.logCtx.WithField("ifaceIdx", idx).Warn(
+			"FilterUpdates: too many pending flush requests, ignoring request to flush interface.")
+	}
+}
+
+// InjectForTest feeds a netlink.RouteUpdate or netlink.LinkUpdate, or an update of a type registered
+// with WithTypedOutput, into the running filter as if it had arrived on FilterUpdates' input
+// channels, so that tests of downstream code can drive the real filter without a kernel.  It is for
+// use in tests only.
+//
+// InjectForTest is safe to call from any goroutine.  Injected updates are processed in the order in
+// which they are injected but may be interleaved arbitrarily with updates from the input channels.
+// It blocks if the filter isn't keeping up (or hasn't started yet) until ctx is done.  It returns an
+// error if the update is of any other type, if the filter has stopped or if ctx is done first.
+func (u *UpdateFilter) InjectForTest(ctx context.Context, upd interface{}) error {
+	switch upd.(type) {
+	case netlink.RouteUpdate, netlink.LinkUpdate:
+	default:
+		if _, ok := u.outputs.typed[reflect.TypeOf(upd)]; !ok {
+			return fmt.Errorf("unsupported update type %T", upd)
+		}
+	}
+	// Check for a stopped filter first; otherwise, the update could be buffered but never read.
+	select {
+	case <-u.stoppedC:
+		return errFilterStopped
+	default:
+	}
+	select {
+	case u.injectC <- upd:
+		return nil
+	case <-u.stoppedC:
+		return errFilterStopped
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// StopAndDrain asks the filter to stop reading its inputs, send the updates that it has queued and
+// then return nil from FilterUpdates.  Queued updates are sent when their damping delays expire, as
+// usual, unless WithForcedDrainOnStop is set, in which case they're sent straight away.  A paused
+// filter is resumed.  StopAndDrain waits for FilterUpdates to return; it returns an error if ctx
+// expires first, in which case the filter carries on draining.  If the filter returns for another
+// reason while draining (for example, because its context is cancelled), StopAndDrain returns nil
+// and FilterUpdates returns the reason.
+//
+// StopAndDrain is safe to call from any goroutine.  Updates passed to InjectForTest after the filter
+// has started draining are never read and, once the filter has stopped, InjectForTest returns an
+// error.
+func (u *UpdateFilter) StopAndDrain(ctx context.Context) error {
+	select {
+	case u.stopC <- struct{}{}:
+	default:
+		u.logCtx.Debug("FilterUpdates: stop already requested.")
+	}
+	select {
+	case <-u.stoppedC:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("filter didn't finish draining its queue: %w", context.Cause(ctx))
+	}
+}
+
+// onFlushIface makes all of the queued updates of the interface, and of any other interfaces in its
+// group, ready to send.
+func (u *UpdateFilter) onFlushIface(now time.Time, idx int) {
+	for _, memberIdx := range append(u.queuedGroupMembers(idx), idx) {
+		upds := u.updatesByIfaceIdx[memberIdx]
+		u.ifaceLogCtx(memberIdx).WithField("numQueued", len(upds)).Debug("FilterUpdates: flushing interface.")
+		for i := range upds {
+			if upds[i].ReadyAt.After(now) {
+				upds[i].ReadyAt = now
+			}
+		}
+		u.markQueueChanged(memberIdx)
+	}
+	// Force the queue to be processed.
+	u.nextWake = time.Time{}
+}
+
+// TriggerResync asks the filter to resend its view of the addresses downstream.  On its next
+// iteration, the filter sends all of its queued updates, without waiting for their damping delays,
+// and then sends an add for every address that is present according to the updates that it has
+// forwarded (see AddressesForInterface).  It can be used by a consumer that suspects that it has
+// lost track of the address state.  Consumers will see adds for addresses that they already know
+// about, so they must treat adds as idempotent.
+//
+// TriggerResync is safe to call from any goroutine.  Requests that arrive while a resync is already
+// pending are merged with it.
+func (u *UpdateFilter) TriggerResync() {
+	select {
+	case u.resyncC <- struct{}{}:
+	default:
+		u.logCtx.Debug("FilterUpdates: resync already pending.")
+	}
+}
+
+// onResync takes all of the queued updates, appending them to emit, and then appends the snapshot
+// of the addresses.
+func (u *UpdateFilter) onResync(now time.Time, emit []interface{}) []interface{} {
+	u.logCtx.WithField("numIfacesQueued", len(u.updatesByIfaceIdx)).Info("FilterUpdates: resyncing addresses.")
+	emit = u.takeAllQueuedUpdates(now, emit)
+	return u.appendAddrSnapshot(emit)
+}
+
+// takeAllQueuedUpdates removes all the queued updates, appending them to emit, interface by
+// interface in index order.
+func (u *UpdateFilter) takeAllQueuedUpdates(now time.Time, emit []interface{}) []interface{} {
+	for _, idx := range u.queuedIfaceIdxs() {
+		emit = u.takeQueuedUpdates(now, idx, emit)
+	}
+	// Force the (now empty) queue to be processed so that nextWake gets cleared.
+	u.nextWake = time.Time{}
+	return emit
+}
+
+// queuedIfaceIdxs returns the indexes of the interfaces that have queued updates, in ascending order.
+// The filter sends queued updates for different interfaces in this order so that its output is
+// reproducible.
+func (u *UpdateFilter) queuedIfaceIdxs() []int {
+	// Return a copy since callers change the queue as they go.
+	return append([]int(nil), u.queuedIdxs...)
+}
+
+// setQueue replaces the given interface's queue, removing it if it is empty, and keeps numQueued,
+// queuedIdxs and changedQueues up to date.
+func (u *UpdateFilter) setQueue(idx int, upds []timestampedUpd) {
+	old, wasQueued := u.updatesByIfaceIdx[idx]
+	u.numQueued += len(upds) - len(old)
+	pos := sort.SearchInts(u.queuedIdxs, idx)
+	switch {
+	case len(upds) == 0 && wasQueued:
+		delete(u.updatesByIfaceIdx, idx)
+		u.queuedIdxs = append(u.queuedIdxs[:pos], u.queuedIdxs[pos+1:]...)
+	case len(upds) == 0:
+		return
+	case !wasQueued:
+		u.queuedIdxs = append(u.queuedIdxs, 0)
+		copy(u.queuedIdxs[pos+1:], u.queuedIdxs[pos:])
+		u.queuedIdxs[pos] = idx
+		fallthrough
+	default:
+		u.updatesByIfaceIdx[idx] = upds
+	}
+	u.markQueueChanged(idx)
+}
+
+// markQueueChanged records that the given interface's queue has changed, so that the next
+// publishSnapshot refreshes its entries.
+func (u *UpdateFilter) markQueueChanged(idx int) {
+	u.changedQueues[idx] = true
+}
+
+// updateCircuitBreaker counts an incoming update towards the ingress rate and, at the end of each
+// WithCircuitBreaker window, opens or closes the circuit breaker according to the rate over the
+// window.  When the breaker opens, all the queued updates are appended to emit.
+func (u *UpdateFilter) updateCircuitBreaker(now time.Time, emit []interface{}) []interface{} {
+	if u.breakerWindowStart.IsZero() {
+		u.breakerWindowStart = now
+	}
+	elapsed := now.Sub(u.breakerWindowStart)
+	if elapsed < u.storm.breakerWindow {
+		u.breakerWindowCount++
+		return emit
+	}
+	// The window is over; this update counts towards the next one.
+	rate := float64(u.breakerWindowCount) / elapsed.Seconds()
+	u.breakerWindowStart = now
+	u.breakerWindowCount = 1
+
+	logCtx := u.logCtx.WithFields(logrus.Fields{
+		"rate":    rate,
+		"maxRate": u.storm.breakerMaxRate,
+		"window":  u.storm.breakerWindow,
+	})
+	if !u.breakerOpen && rate > u.storm.breakerMaxRate {
+		logCtx.WithField("numQueued", u.stats.currentQueuedUpdates.Load()).Warn(
+			"FilterUpdates: update rate too high, circuit breaker tripped; disabling flap damping.")
+		u.breakerOpen = true
+		u.stats.circuitBreakerOpen.Store(true)
+		emit = u.takeAllQueuedUpdates(now, emit)
+	} else if u.breakerOpen && rate <= u.storm.breakerMaxRate {
+		logCtx.Info("FilterUpdates: update rate back to normal, circuit breaker reset; re-enabling flap damping.")
+		u.breakerOpen = false
+		u.stats.circuitBreakerOpen.Store(false)
+	}
+	return emit
+}
+
+// appendAddrSnapshot appends an add for each address that will be present downstream once the
+// updates in emit have been sent.
+func (u *UpdateFilter) appendAddrSnapshot(emit []interface{}) []interface{} {
+	u.snapshotLock.Lock()
+	addrsByIface := make(map[int][]netlink.RouteUpdate, len(u.emittedAddrsByIface))
+	for idx, addrs := range u.emittedAddrsByIface {
+		addrsByIface[idx] = append([]netlink.RouteUpdate(nil), addrs...)
+	}
+	u.snapshotLock.Unlock()
+
+	for _, upd := range emit {
+		switch upd := upd.(type) {
+		case netlink.LinkUpdate:
+			if upd.Header.Type == syscall.RTM_DELLINK {
+				delete(addrsByIface, int(upd.Index))
+			}
+		case netlink.RouteUpdate:
+			applyEmittedAddr(addrsByIface, upd, u.addrs.coalesceIgnoresMask)
+		}
+	}
+
+	idxs := make([]int, 0, len(addrsByIface))
+	for idx := range addrsByIface {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	for _, idx := range idxs {
+		for _, upd := range addrsByIface[idx] {
+			emit = append(emit, upd)
+		}
+	}
+	return emit
+}
+
+// updateBypass refreshes whether the link update's interface is bypassed, returning true if it is.
+func (u *UpdateFilter) updateBypass(linkUpd netlink.LinkUpdate) bool {
+	idx := int(linkUpd.Index)
+	if linkUpd.Header.Type == syscall.RTM_DELLINK {
+		// Let the normal processing clean up after the interface.
+		delete(u.bypassedIfaces, idx)
+		return false
+	}
+	if linkUpd.Link == nil || linkUpd.Link.Attrs() == nil || linkUpd.Link.Attrs().Name == "" {
+		return u.bypassedIfaces[idx]
+	}
+	if u.ifaces.bypassIface(linkUpd.Link.Attrs().Name) {
+		u.bypassedIfaces[idx] = true
+		return true
+	}
+	delete(u.bypassedIfaces, idx)
+	return false
+}
+
+// isUntrackedIface returns true if the interface's updates should be passed through because of
+// WithMaxTrackedInterfaces.  Once the queue has dropped back below the limit, all the interfaces
+// that were switched to pass-through are damped again.
+func (u *UpdateFilter) isUntrackedIface(idx int) bool {
+	if !u.untrackedIfaces[idx] {
+		return false
+	}
+	if len(u.updatesByIfaceIdx) < u.ifaces.maxTrackedIfaces {
+		u.logCtx.WithField("numUntracked", len(u.untrackedIfaces)).Info(
+			"FilterUpdates: no longer tracking too many interfaces, damping all interfaces again.")
+		clear(u.untrackedIfaces)
+		return false
+	}
+	return true
+}
+
+// enforceMaxTrackedIfaces is called after an update for an interface that had nothing queued.  If
+// the update took the queue over the WithMaxTrackedInterfaces limit, it switches the interface to
+// pass-through and sends what was just queued for it.  Updates that aren't queued, such as adds
+// that are sent straight away, don't count against the limit.
+func (u *UpdateFilter) enforceMaxTrackedIfaces(now time.Time, idx int, emit []interface{}) []interface{} {
+	if _, ok := u.updatesByIfaceIdx[idx]; !ok || len(u.updatesByIfaceIdx) <= u.ifaces.maxTrackedIfaces {
+		return emit
+	}
+	u.ifaceLogCtx(idx).WithField("maxTrackedIfaces", u.ifaces.maxTrackedIfaces).Error(
+		"FilterUpdates: tracking too many interfaces, passing this interface's updates through without damping.")
+	countUntrackedIfaces.Inc()
+	u.untrackedIfaces[idx] = true
+	return u.takeQueuedUpdates(now, idx, emit)
+}
+
+// updateIgnored refreshes whether the link update's interface is excluded by the allowlist,
+// returning true if the update should be dropped.
+func (u *UpdateFilter) updateIgnored(linkUpd netlink.LinkUpdate) bool {
+	idx := int(linkUpd.Index)
+	if linkUpd.Header.Type == syscall.RTM_DELLINK {
+		delete(u.ignoredIfaces, idx)
+		return false
+	}
+	if linkUpd.Link == nil || linkUpd.Link.Attrs() == nil || linkUpd.Link.Attrs().Name == "" {
+		return u.ignoredIfaces[idx]
+	}
+	if u.ifaces.allowIface(linkUpd.Link.Attrs().Name) {
+		delete(u.ignoredIfaces, idx)
+		return false
+	}
+	if !u.ignoredIfaces[idx] {
+		u.ifaceLogCtx(idx).Debug("FilterUpdates: interface isn't in the allowlist, ignoring its updates.")
+		u.ignoredIfaces[idx] = true
+	}
+	return true
+}
+
+type linkFlagState struct {
+	name  string
+	flags uint32
+}
+
+// linkFlagsChanged records the link update's name and masked flags, returning true if they differ
+// from the interface's previous link update, or if there wasn't one.  Deletions always count as a
+// change.
+func (u *UpdateFilter) linkFlagsChanged(linkUpd netlink.LinkUpdate) bool {
+	idx := int(linkUpd.Index)
+	if linkUpd.Header.Type == syscall.RTM_DELLINK {
+		delete(u.linkStatesByIface, idx)
+		return true
+	}
+	if linkUpd.Link == nil || linkUpd.Link.Attrs() == nil {
+		return true
+	}
+	attrs := linkUpd.Link.Attrs()
+	state := linkFlagState{name: attrs.Name, flags: attrs.RawFlags & u.ifaces.linkFlagMask}
+	oldState, known := u.linkStatesByIface[idx]
+	u.linkStatesByIface[idx] = state
+	return !known || state != oldState
+}
+
+// checkMACChange records the link update's hardware address, sending a MACChangedEvent if it differs
+// from the one in the interface's previous link update.
+func (u *UpdateFilter) checkMACChange(linkUpd netlink.LinkUpdate) {
+	idx := int(linkUpd.Index)
+	if linkUpd.Header.Type == syscall.RTM_DELLINK {
+		delete(u.macsByIface, idx)
+		return
+	}
+	if linkUpd.Link == nil || linkUpd.Link.Attrs() == nil || len(linkUpd.Link.Attrs().HardwareAddr) == 0 {
+		return
+	}
+	attrs := linkUpd.Link.Attrs()
+	oldMAC, known := u.macsByIface[idx]
+	if known && bytes.Equal(oldMAC, attrs.HardwareAddr) {
+		return
+	}
+	newMAC := append(net.HardwareAddr(nil), attrs.HardwareAddr...)
+	u.macsByIface[idx] = newMAC
+	if !known {
+		return
+	}
+	u.ifaceLogCtx(idx).WithFields(logrus.Fields{
+		"oldMAC": oldMAC,
+		"newMAC": newMAC,
+	}).Info("FilterUpdates: interface hardware address changed.")
+	select {
+	case u.notify.macChangeC <- MACChangedEvent{
+		IfaceIdx:  idx,
+		IfaceName: attrs.Name,
+		OldMAC:    oldMAC,
+		NewMAC:    newMAC,
+	}:
+	default:
+		u.ifaceLogCtx(idx).Warn("FilterUpdates: MAC change channel full, dropping event.")
+	}
+}
+
+// takeQueuedUpdates removes all the queued updates for the given interface, appending them to emit.
+func (u *UpdateFilter) takeQueuedUpdates(now time.Time, idx int, emit []interface{}) []interface{} {
+	for _, upd := range u.updatesByIfaceIdx[idx] {
+		u.onTakenFromQueue(now, upd)
+		emit = append(emit, upd.Update)
+	}
+	if _, ok := u.updatesByIfaceIdx[idx]; ok {
+		u.setQueue(idx, nil)
+		u.onQueueDrained(idx)
+	}
+	return emit
+}
+
+// onTakenFromQueue records how long the given update spent in the queue, as it is taken from the
+// queue to be sent.  If it is a deletion that was delayed, the delay was wasted since the address
+// didn't come back.
+func (u *UpdateFilter) onTakenFromQueue(now time.Time, upd timestampedUpd) {
+	histQueueLatency.Observe(now.Sub(upd.QueuedAt).Seconds())
+	u.unindexQueuedAddr(upd)
+	if u.notify.netlinkHeaderLogging {
+		u.takenIngressIDs[u.ingressKeyOf(upd.Update)] = upd.IngressID
+	}
+	if routeUpd, ok := upd.Update.(netlink.RouteUpdate); ok &&
+		routeUpd.Type == unix.RTM_DELROUTE && upd.ReadyAt.After(upd.QueuedAt) {
+		countDampedDeletesWasted.Inc()
+		u.stats.dampedDeletesWasted.Add(1)
+	}
+}
+
+// onDampedDeleteUseful records that a delayed deletion was suppressed by a re-add.
+func (u *UpdateFilter) onDampedDeleteUseful() {
+	countDampedDeletesUseful.Inc()
+	u.stats.dampedDeletesUseful.Add(1)
+}
+
+// drainReady removes the updates that are ready to send at the given time from the queue and returns
+// them, in order.  It is the part of the main loop that runs when the timer pops.  Since now may be a
+// virtual time, tests in this package can use it to step through the queue deterministically.
+//
+// Like the rest of the filter's state handling, drainReady must only be called from the goroutine
+// that owns the filter.  It recalculates u.nextWake but it doesn't publish the queue snapshot; that
+// is left to the caller.
+func (u *UpdateFilter) drainReady(now time.Time) []interface{} {
+	var emit []interface{}
+	emit, u.nextWake = u.sendReadyUpdates(now, emit)
+	if u.notify.passSummaryLogging {
+		u.logPassSummary(emit)
+	}
+	return emit
+}
+
+// logPassSummary logs the WithPassSummaryLogging line for a pass that sent the given updates.
+func (u *UpdateFilter) logPassSummary(emit []interface{}) {
+	ifacesTouched := map[int]bool{}
+	for _, upd := range emit {
+		ifacesTouched[updateIfaceIdx(upd)] = true
+	}
+	numQueued := 0
+	for _, upds := range u.updatesByIfaceIdx {
+		numQueued += len(upds)
+	}
+	u.logCtx.WithFields(logrus.Fields{
+		"numEmitted":       len(emit),
+		"numQueued":        numQueued,
+		"numIfacesTouched": len(ifacesTouched),
+		"nextWake":         u.nextWake,
+	}).Info(LogMsgPassSummary)
+}
+
+// NextWake returns the time at which the filter next plans to process its queue, or the zero time if
+// the queue is empty.  It is safe to call from any goroutine.  Like QueueSnapshot, it is published
+// after the filter finishes processing each update so it may lag slightly.
+//
+// The time is on the clock of the filter's time shim, so it can be compared with the shim's Now().
+// The filter schedules its queue against its own clock, which stands still while the shim's clock
+// steps backwards (see monotonicNow); the wake time is converted using the offset between the two
+// clocks when it is published.
+func (u *UpdateFilter) NextWake() time.Time {
+	nanos := u.nextWakeNanos.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// monotonicNow returns the filter's own clock, which only moves forwards.  It advances by the
+// time that the shim reports has elapsed since the previous call; if the shim's clock has stepped
+// backwards, it stands still instead.  The filter compares the ReadyAt times of queued updates
+// against this clock, so a wall clock step can't leave updates stuck in the queue until the
+// clock catches up.  Must only be called from the filter's goroutine.
+func (u *UpdateFilter) monotonicNow() time.Time {
+	shimNow := u.time.Now()
+	if u.lastShimNow.IsZero() {
+		u.monoNow = shimNow
+	} else if elapsed := shimNow.Sub(u.lastShimNow); elapsed > 0 {
+		u.monoNow = u.monoNow.Add(elapsed)
+	} else if elapsed < 0 {
+		u.logCtx.WithField("step", elapsed).Warn("FilterUpdates: clock stepped backwards.")
+	}
+	u.lastShimNow = shimNow
+	return u.monoNow
+}
+
+// QueueSnapshot returns the number of updates that are queued for each interface, keyed by interface
+// index.  Interfaces with no queued updates are omitted.  It is safe to call from any goroutine.
+// The snapshot is eventually consistent: it is published after the filter finishes processing
+// each update so it may lag slightly behind the filter's internal state.
+func (u *UpdateFilter) QueueSnapshot() map[int]int {
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	snap := make(map[int]int, len(u.queueDepthByIface))
+	for idx, depth := range u.queueDepthByIface {
+		snap[idx] = depth
+	}
+	return snap
+}
+
+// PendingCIDRs returns the addresses of the address updates that the filter is holding back, keyed
+// by interface index: those that are queued and whose damping delay hasn't expired.  It is more
+// useful than QueueSnapshot for working out why an address hasn't been programmed yet.  Like
+// QueueSnapshot, it is safe to call from any goroutine and may lag slightly behind the filter.
+func (u *UpdateFilter) PendingCIDRs() map[int][]net.IPNet {
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	snap := make(map[int][]net.IPNet, len(u.pendingCIDRsByIface))
+	for idx, cidrs := range u.pendingCIDRsByIface {
+		snap[idx] = append([]net.IPNet(nil), cidrs...)
+	}
+	return snap
+}
+
+// AddressesForInterface returns the addresses that are present on the given interface according to
+// the updates that the filter has forwarded downstream.  Since it reflects the filter's output, an
+// address that is flapping remains present until the filter forwards its deletion.  It is safe to
+// call from any goroutine.
+func (u *UpdateFilter) AddressesForInterface(idx int) []net.IPNet {
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	upds := u.emittedAddrsByIface[idx]
+	if len(upds) == 0 {
+		return nil
+	}
+	addrs := make([]net.IPNet, 0, len(upds))
+	for _, upd := range upds {
+		addrs = append(addrs, *upd.Dst)
+	}
+	return addrs
+}
+
+// IsAddressPresent returns true if the given address is present on the given interface according
+// to the updates that the filter has forwarded downstream, as for AddressesForInterface.  It is
+// safe to call from any goroutine.
+func (u *UpdateFilter) IsAddressPresent(idx int, cidr net.IPNet) bool {
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	for _, upd := range u.emittedAddrsByIface[idx] {
+		if ipNetsEqual(upd.Dst, &cidr) {
+			return true
+		}
+	}
+	return false
+}
+
+// onForwarded updates the stats and the emitted address state after a send.  unsent is the return
+// value of the sink's send.  Sinks give up part way through the route updates and the link updates,
+// so, of each type, the updates that were sent are the ones that precede the first unsent update.
+func (u *UpdateFilter) onForwarded(emit, unsent []interface{}) {
+	if u.heartbeat.idleInterval > 0 && len(emit) > len(unsent) {
+		u.heartbeat.lastEmitAt = u.monotonicNow()
+	}
+	u.stats.forwardedUpdates.Add(uint64(len(emit) - len(unsent)))
+
+	numSentRoutes, numSentLinks := countUpdateTypes(emit)
+	numUnsentRoutes, numUnsentLinks := countUpdateTypes(unsent)
+	numSentRoutes -= numUnsentRoutes
+	numSentLinks -= numUnsentLinks
+
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	for _, upd := range emit {
+		switch upd := upd.(type) {
+		case netlink.LinkUpdate:
+			if numSentLinks == 0 {
+				continue
+			}
+			numSentLinks--
+			if upd.Header.Type == syscall.RTM_DELLINK {
+				delete(u.emittedAddrsByIface, int(upd.Index))
+			}
+		case netlink.RouteUpdate:
+			if numSentRoutes == 0 {
+				continue
+			}
+			numSentRoutes--
+			u.recordEmittedAddr(upd)
+		}
+	}
+}
+
+// recordEmittedAddr applies a forwarded route update to emittedAddrsByIface.  The caller must hold
+// snapshotLock.
+func (u *UpdateFilter) recordEmittedAddr(upd netlink.RouteUpdate) {
+	applyEmittedAddr(u.emittedAddrsByIface, upd, u.addrs.coalesceIgnoresMask)
+}
+
+// applyEmittedAddr applies a route update to addrsByIface, which holds the most recent add for each
+// address on each interface.  If ignoreMask is set, addresses with the same IP but different masks
+// replace each other.
+func applyEmittedAddr(addrsByIface map[int][]netlink.RouteUpdate, upd netlink.RouteUpdate, ignoreMask bool) {
+	if upd.Dst == nil {
+		return
+	}
+	idx := upd.LinkIndex
+	oldUpds := addrsByIface[idx]
+	upds := oldUpds[:0]
+	for _, a := range oldUpds {
+		if ignoreMask && ipNetFamily(a.Dst) == ipNetFamily(upd.Dst) && a.Dst.IP.Equal(upd.Dst.IP) {
+			continue
+		}
+		if !ipNetsEqual(a.Dst, upd.Dst) {
+			upds = append(upds, a)
+		}
+	}
+	if upd.Type == unix.RTM_NEWROUTE {
+		upds = append(upds, upd)
+	}
+	if len(upds) == 0 {
+		delete(addrsByIface, idx)
+		return
+	}
+	addrsByIface[idx] = upds
+}
+
+// publishSnapshot publishes the queue for other goroutines to read.  Only the entries of the
+// interfaces whose queues have changed since the last call are refreshed.  In particular, an update
+// stays in the pending CIDRs until its queue is next processed, after its delay has expired.  Since
+// every queue is examined whenever the timer pops, that is only a short time afterwards.
+func (u *UpdateFilter) publishSnapshot(now time.Time) {
+	u.stats.currentQueuedUpdates.Store(uint64(u.numQueued))
+	if u.nextWake.IsZero() {
+		u.nextWakeNanos.Store(0)
+	} else {
+		// nextWake is on the filter's own clock (see monotonicNow), which lags the shim's clock
+		// by however far the shim has stepped backwards.  Convert using the current offset.
+		u.nextWakeNanos.Store(u.nextWake.Add(u.lastShimNow.Sub(u.monoNow)).UnixNano())
+	}
+	if len(u.changedQueues) == 0 {
+		return
+	}
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	for idx := range u.changedQueues {
+		upds := u.updatesByIfaceIdx[idx]
+		if len(upds) == 0 {
+			delete(u.queueDepthByIface, idx)
+		} else {
+			u.queueDepthByIface[idx] = len(upds)
+		}
+		// Readers take a copy so the old slice can be reused.
+		pending := u.pendingCIDRsByIface[idx][:0]
+		for _, upd := range upds {
+			routeUpd, ok := upd.Update.(netlink.RouteUpdate)
+			if !ok || routeUpd.Dst == nil || !upd.ReadyAt.After(now) {
+				continue
+			}
+			pending = append(pending, *routeUpd.Dst)
+		}
+		if len(pending) == 0 {
+			delete(u.pendingCIDRsByIface, idx)
+		} else {
+			u.pendingCIDRsByIface[idx] = pending
+		}
+	}
+	clear(u.changedQueues)
+}
+
+func (u *UpdateFilter) onLinkUpdate(now time.Time, linkUpd netlink.LinkUpdate, emit []interface{}) ([]interface{}, bool) {
+	idx := int(linkUpd.Index)
+	if linkUpd.Header.Type == syscall.RTM_DELLINK {
+		// The interface has been deleted.  The kernel may reuse its index for a new interface so we
+		// must not let any queued updates leak onto the new interface.  The deletion implies that all
+		// the interface's addresses are gone so it's safe to discard the queued updates and send the
+		// deletion straight away.
+		u.ifaceLogCtx(idx).WithField("numQueued", len(u.updatesByIfaceIdx[idx])).Debug(
+			"FilterUpdates: interface deleted, discarding queued updates.")
+		if u.ifaces.deletesOnIfaceRemoval {
+			emit = u.appendRemovedIfaceDeletes(now, idx, emit)
+		}
+		u.setQueue(idx, nil)
+		delete(u.queuedAddrSeqs, idx)
+		delete(u.ifaceNamesByIdx, idx)
+		delete(u.ifaceNameLastSeen, idx)
+		delete(u.recentAddrsByIfaceIdx, idx)
+		for k := range u.flapTimesByAddr {
+			if k.ifaceIdx == idx {
+				delete(u.flapTimesByAddr, k)
+			}
+		}
+		for k := range u.lastSeqByAddr {
+			if k.ifaceIdx == idx {
+				delete(u.lastSeqByAddr, k)
+			}
+		}
+		for k := range u.addrDelTimesByAddr {
+			if k.ifaceIdx == idx {
+				delete(u.addrDelTimesByAddr, k)
+			}
+		}
+		for k := range u.shortCircuitedAdds {
+			if k.ifaceIdx == idx {
+				delete(u.shortCircuitedAdds, k)
+			}
+		}
+		delete(u.avgDownTimeByIface, idx)
+		delete(u.untrackedIfaces, idx)
+		if _, ok := u.ifaceModes[idx]; ok {
+			// The kernel may reuse the index for a new interface, which should start out damped.
+			u.snapshotLock.Lock()
+			delete(u.ifaceModes, idx)
+			u.snapshotLock.Unlock()
+		}
+		return append(emit, linkUpd), false
+	}
+	u.recordIfaceName(now, linkUpd)
+	linkIsUp := linkUpd.Header.Type == syscall.RTM_NEWLINK && LinkIsOperUp(linkUpd.Link)
+	var delay time.Duration
+	if linkIsUp {
+		if u.delays.linkFlapDamping > 0 && u.linksUpDownstream[idx] && u.dropQueuedLinkDown(idx) {
+			u.ifaceLogCtx(idx).Debug(
+				"FilterUpdates: link came back up within the link flap damping window, suppressing the bounce.")
+			return emit, false
+		}
+		if len(u.updatesByIfaceIdx[idx]) == 0 && len(u.queuedGroupMembers(idx)) == 0 &&
+			!u.inGracePeriod(now) {
+			// Empty queue (so no flap in progress) and the link is up, no need to delay the message.
+			return append(emit, linkUpd), false
+		}
+		// Link is up but potential flap in progress, queue the update behind the other messages.
+		delay = 0
+	} else {
+		// We delay link down updates because a flap can involve both a link down and an IP removal.
+		// Since we receive those two messages over separate channels, the two messages can race.
+		delay = u.dampingDelayForIface(idx, linkUpd)
+		if u.delays.linkFlapDamping > 0 {
+			delay = u.delays.linkFlapDamping
+		}
+		if delay > 0 {
+			countUpdatesDelayed.WithLabelValues(updateTypeLink).Inc()
+			u.stats.delayedUpdates.Add(1)
+			u.logDecision(DecisionDelay, linkUpd, u.lastIngressID, now.Add(delay))
+			u.sendDebugEvent(idx, nil, SuppressionKindDelayed, now.Add(delay))
+		}
+	}
+
+	queuedAt := now
+	readyAt := u.holdForGracePeriod(now, now.Add(delay))
+
+	// Coalesce link updates; only the latest state of the link matters.  To avoid deferring the
+	// update indefinitely if the link keeps flapping, the new update inherits the timestamps of
+	// the update that it replaces.
+	oldUpds := u.updatesByIfaceIdx[idx]
+	upds := oldUpds[:0]
+	for _, upd := range oldUpds {
+		if _, ok := upd.Update.(netlink.LinkUpdate); ok {
+			u.logDecision(DecisionSquash, upd.Update, upd.IngressID, upd.ReadyAt)
+			countFlapsSuppressed.WithLabelValues(updateTypeLink).Inc()
+			u.stats.suppressedFlaps.Add(1)
+			u.sendDebugEvent(idx, nil, SuppressionKindSquashed, upd.ReadyAt)
+			queuedAt = upd.QueuedAt
+			readyAt = upd.ReadyAt
+			continue
+		}
+		upds = append(upds, upd)
+	}
+	u.setQueue(idx, append(upds,
+		timestampedUpd{
+			QueuedAt:  queuedAt,
+			ReadyAt:   readyAt,
+			Update:    linkUpd,
+			IngressID: u.lastIngressID,
+			Seq:       u.takeQueueSeq(),
+		}))
+	emit = u.enforceMaxQueueDepth(now, idx, emit)
+	return emit, delay > 0 && readyAt.Before(u.nextWake)
+}
+
+// recordIfaceName records the interface's name from the link update, if it has one.
+func (u *UpdateFilter) recordIfaceName(now time.Time, linkUpd netlink.LinkUpdate) {
+	if linkUpd.Link == nil || linkUpd.Link.Attrs() == nil || linkUpd.Link.Attrs().Name == "" {
+		return
+	}
+	idx := int(linkUpd.Index)
+	u.ifaceNamesByIdx[idx] = linkUpd.Link.Attrs().Name
+	if u.ifaces.ifaceNameTTL > 0 {
+		u.ifaceNameLastSeen[idx] = now
+	}
+}
+
+// appendRemovedIfaceDeletes appends a deletion for each address of a deleted interface: first its
+// queued deletions, then a deletion for each address that downstream believes is present and that
+// isn't already covered.
+func (u *UpdateFilter) appendRemovedIfaceDeletes(now time.Time, idx int, emit []interface{}) []interface{} {
+	numEmitted := len(emit)
+	deletedKeys := map[string]bool{}
+	for _, upd := range u.updatesByIfaceIdx[idx] {
+		routeUpd, ok := upd.Update.(netlink.RouteUpdate)
+		if !ok || routeUpd.Type != unix.RTM_DELROUTE {
+			continue
+		}
+		u.onTakenFromQueue(now, upd)
+		emit = append(emit, routeUpd)
+		deletedKeys[upd.Key] = true
+	}
+
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	for _, addUpd := range u.emittedAddrsByIface[idx] {
+		if deletedKeys[u.addrs.coalesceKey(addUpd)] {
+			continue
+		}
+		delUpd := addUpd
+		delUpd.Type = unix.RTM_DELROUTE
+		emit = append(emit, delUpd)
+	}
+	u.ifaceLogCtx(idx).WithField("numDeletes", len(emit)-numEmitted).Debug(
+		"FilterUpdates: interface deleted, sending deletions for its addresses.")
+	return emit
+}
+
+func (u *UpdateFilter) onRouteUpdate(now time.Time, routeUpd netlink.RouteUpdate, emit []interface{}) ([]interface{}, bool) {
+	if !u.shouldProcessRouteUpdate(routeUpd) {
+		return emit, false
+	}
+
+	idx := routeUpd.LinkIndex
+	key := u.addrs.coalesceKey(routeUpd)
+	if u.ifaces.suppressDownIfaces && u.adminDownIfaces[idx] {
+		u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug(
+			"FilterUpdates: interface is administratively down, holding back address update.")
+		u.suppressAddrUpdate(idx, key, routeUpd)
+		return emit, false
+	}
+	oldUpds := u.updatesByIfaceIdx[idx]
+	if u.addrs.sequenceFunc != nil && u.isStale(idx, key, routeUpd) {
+		u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Warn(
+			"FilterUpdates: received update that is older than one already seen for the same address, dropping.")
+		return emit, false
+	}
+	if u.addrs.ignoreLifetimeOnly && !u.updateRecentAddrs(routeUpd) {
+		u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug(
+			"FilterUpdates: address re-added with no other changes, dropping.")
+		return emit, false
+	}
+	if u.delays.adaptiveMaxDelay > 0 {
+		u.observeDownTime(now, idx, key, routeUpd)
+	}
+
+	var readyToSendTime time.Time
+	var dueBeforeWake bool
+	if routeUpd.Type == unix.RTM_NEWROUTE {
+		u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address ADD")
+		if u.isMicroCoalescedAdd(now, flapStormKey{idx, key}, routeUpd) {
+			u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug(
+				"FilterUpdates: add repeats one sent within the micro-coalescing window, dropping.")
+			return emit, false
+		}
+		if u.delays.addDelay <= 0 && !queueBlocksFamily(oldUpds, updateFamily(routeUpd)) &&
+			!u.groupQueueBlocksFamily(idx, updateFamily(routeUpd)) && !u.inGracePeriod(now) {
+			// This is an add for a new IP and there's nothing else in the queue for this interface
+			// (and address family).  Short circuit.  We care about flaps where IPs are temporarily
+			// removed so, unless configured otherwise, no need to delay an add.
+			u.logCtx.Debug("FilterUpdates: add with empty queue, short circuit.")
+			u.recordShortCircuitedAdd(now, flapStormKey{idx, key}, routeUpd)
+			return append(emit, routeUpd), false
+		}
+
+		// Else, there's something else in the queue, need to process the queue...
+		u.logCtx.Debug("FilterUpdates: add with non-empty queue.")
+		if u.replaceQueuedAdd(idx, oldUpds, key, routeUpd) {
+			// Kernel sometimes sends duplicate adds, no need to queue the same add twice.  With a
+			// custom coalesce key, the newer add for the same key takes the place of the old one.
+			u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug(
+				"FilterUpdates: add already queued for the same address, updating it in place.")
+			return emit, false
+		}
+		// By default, we don't actually need to delay the add itself so we don't set any delay here.
+		// It will still be queued up behind other updates.
+		readyToSendTime = now
+		if u.delays.addDelay > 0 {
+			readyToSendTime = now.Add(u.delays.addDelay)
+			countUpdatesDelayed.WithLabelValues(updateTypeAddr).Inc()
+			u.stats.delayedUpdates.Add(1)
+			u.logDecision(DecisionDelay, routeUpd, u.lastIngressID, readyToSendTime)
+			u.sendDebugEvent(idx, routeUpd.Dst, SuppressionKindDelayed, readyToSendTime)
+			dueBeforeWake = readyToSendTime.Before(u.nextWake)
+		}
+	} else {
+		// Got a delete, it might be a flap so queue the update.
+		u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address DEL")
+		delete(u.shortCircuitedAdds, flapStormKey{idx, key})
+		delay := u.dampingDelayForIface(idx, routeUpd)
+		readyToSendTime = now.Add(delay)
+		if delay > 0 {
+			countUpdatesDelayed.WithLabelValues(updateTypeAddr).Inc()
+			u.stats.delayedUpdates.Add(1)
+			u.logDecision(DecisionDelay, routeUpd, u.lastIngressID, readyToSendTime)
+			u.sendDebugEvent(idx, routeUpd.Dst, SuppressionKindDelayed, readyToSendTime)
+		}
+		dueBeforeWake = delay > 0 && readyToSendTime.Before(u.nextWake)
+	}
+	readyToSendTime = u.holdForGracePeriod(now, readyToSendTime)
+	if u.addrs.coalescePolicy != CoalesceAddWins && u.applyCoalescePolicy(now, idx, key, oldUpds, routeUpd) {
+		return emit, false
+	}
+
+	// Coalesce updates for the same IP by squashing any previous update for the same CIDR before
+	// we append this update to the queue.  There may be updates for different IPs in flight so we
+	// look the old update up in the index rather than scanning the queue.  The relative order of the
+	// remaining updates must be preserved so that downstream sees link and address updates in kernel
+	// order.
+	upds := oldUpds
+	collapsed := false
+	if i := u.queuedAddrPos(idx, key, oldUpds); i >= 0 {
+		// New update for the same IP, suppress the old update
+		upd := oldUpds[i]
+		oldAddrUpd := upd.Update.(netlink.RouteUpdate)
+		u.logDecision(DecisionSquash, oldAddrUpd, upd.IngressID, upd.ReadyAt)
+		countFlapsSuppressed.WithLabelValues(updateTypeAddr).Inc()
+		u.stats.suppressedFlaps.Add(1)
+		u.sendDebugEvent(idx, oldAddrUpd.Dst, SuppressionKindSquashed, upd.ReadyAt)
+		if oldAddrUpd.Type == unix.RTM_DELROUTE && routeUpd.Type == unix.RTM_NEWROUTE {
+			u.onDampedDeleteUseful()
+			u.onFlapSuppressed(idx, routeUpd.Dst, now.Sub(upd.QueuedAt))
+			collapsed = u.addrs.collapseReAdds && u.addrsSentDownstream[flapStormKey{idx, key}]
+		} else if oldAddrUpd.Type == unix.RTM_DELROUTE && routeUpd.Type == unix.RTM_DELROUTE {
+			u.onDoubleDelete(idx, routeUpd.Dst, now.Sub(upd.QueuedAt))
+		}
+		u.recordFlap(now, idx, key, routeUpd.Dst)
+		upds = append(oldUpds[:i], oldUpds[i+1:]...)
+		u.unindexQueuedAddr(upd)
+	}
+	if collapsed {
+		// Downstream still has the add from before the deletion, so the re-add would be a repeat.
+		u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug(
+			"FilterUpdates: address re-added before its deletion was sent, dropping both.")
+		u.setQueue(idx, upds)
+		return emit, false
+	}
+	tsUpd := timestampedUpd{
+		QueuedAt:  now,
+		ReadyAt:   readyToSendTime,
+		Update:    routeUpd,
+		Key:       key,
+		IngressID: u.lastIngressID,
+		Seq:       u.takeQueueSeq(),
+	}
+	u.setQueue(idx, append(upds, tsUpd))
+	u.indexQueuedAddr(idx, tsUpd)
+	emit = u.enforceMaxQueueDepth(now, idx, emit)
+	return emit, dueBeforeWake
+}
+
+// isMicroCoalescedAdd returns true if an identical add for the address was sent straight away
+// within the micro-coalescing window, with no deletion since.
+func (u *UpdateFilter) isMicroCoalescedAdd(now time.Time, k flapStormKey, routeUpd netlink.RouteUpdate) bool {
+	sent, ok := u.shortCircuitedAdds[k]
+	return ok && now.Sub(sent.sentAt) < u.delays.microCoalesceWindow && reflect.DeepEqual(sent.route, routeUpd.Route)
+}
+
+// recordShortCircuitedAdd notes that an add was sent without being queued.  To keep the map small,
+// it first sweeps out the entries that have aged out of the micro-coalescing window.
+func (u *UpdateFilter) recordShortCircuitedAdd(now time.Time, k flapStormKey, routeUpd netlink.RouteUpdate) {
+	if u.delays.microCoalesceWindow <= 0 {
+		return
+	}
+	if now.Sub(u.microCoalesceSweptAt) >= u.delays.microCoalesceWindow {
+		for k, sent := range u.shortCircuitedAdds {
+			if now.Sub(sent.sentAt) >= u.delays.microCoalesceWindow {
+				delete(u.shortCircuitedAdds, k)
+			}
+		}
+		u.microCoalesceSweptAt = now
+	}
+	u.shortCircuitedAdds[k] = shortCircuitedAdd{route: routeUpd.Route, sentAt: now}
+}
+
+// applyCoalescePolicy resolves the given address update against a queued update of the opposite
+// type for the same address according to the CoalescePolicy.  It returns true if it has dealt with
+// the update, or false if the update should be queued as normal.
+func (u *UpdateFilter) applyCoalescePolicy(
+	now time.Time, idx int, key string, oldUpds []timestampedUpd, routeUpd netlink.RouteUpdate,
+) bool {
+	i := u.queuedAddrPos(idx, key, oldUpds)
+	if i < 0 {
+		return false
+	}
+	oldAddrUpd := oldUpds[i].Update.(netlink.RouteUpdate)
+	if oldAddrUpd.Type == routeUpd.Type {
+		return false
+	}
+	switch {
+	case u.addrs.coalescePolicy == CoalesceDeleteWins && oldAddrUpd.Type == unix.RTM_DELROUTE:
+		u.ifaceLogCtx(idx).WithField("addr", routeUpd.Dst).Debug(
+			"FilterUpdates: address re-added while its deletion is queued, dropping the add.")
+		u.logDecision(DecisionSquash, routeUpd, u.lastIngressID, now)
+		u.sendDebugEvent(idx, routeUpd.Dst, SuppressionKindSquashed, now)
+	case u.addrs.coalescePolicy == CoalesceNewest:
+		if oldAddrUpd.Type == unix.RTM_DELROUTE {
+			u.onDampedDeleteUseful()
+		}
+		u.logDecision(DecisionSquash, oldAddrUpd, oldUpds[i].IngressID, oldUpds[i].ReadyAt)
+		u.sendDebugEvent(idx, oldAddrUpd.Dst, SuppressionKindSquashed, oldUpds[i].ReadyAt)
+		oldUpds[i].Update = routeUpd
+		oldUpds[i].IngressID = u.lastIngressID
+		u.markQueueChanged(idx)
+	default:
+		return false
+	}
+	countFlapsSuppressed.WithLabelValues(updateTypeAddr).Inc()
+	u.stats.suppressedFlaps.Add(1)
+	u.recordFlap(now, idx, key, routeUpd.Dst)
+	return true
+}
+
+// dropQueuedLinkDown removes the given interface's queued link update if it is a link down.  It
+// returns true if it removed one.
+func (u *UpdateFilter) dropQueuedLinkDown(idx int) bool {
+	upds := u.updatesByIfaceIdx[idx]
+	for i, upd := range upds {
+		linkUpd, ok := upd.Update.(netlink.LinkUpdate)
+		if !ok {
+			continue
+		}
+		if linkUpd.Header.Type == syscall.RTM_NEWLINK && LinkIsOperUp(linkUpd.Link) {
+			return false
+		}
+		u.logDecision(DecisionSquash, linkUpd, upd.IngressID, upd.ReadyAt)
+		countFlapsSuppressed.WithLabelValues(updateTypeLink).Inc()
+		u.stats.suppressedFlaps.Add(1)
+		u.sendDebugEvent(idx, nil, SuppressionKindSquashed, upd.ReadyAt)
+		upds = append(upds[:i], upds[i+1:]...)
+		u.setQueue(idx, upds)
+		// Force the queue to be processed so that nextWake gets recalculated.
+		u.nextWake = time.Time{}
+		return true
+	}
+	return false
+}
+
+// recordLinkSentDownstream updates linksUpDownstream for an update that the filter has released.
+func (u *UpdateFilter) recordLinkSentDownstream(upd interface{}) {
+	linkUpd, ok := upd.(netlink.LinkUpdate)
+	if !ok || IsHeartbeat(linkUpd) {
+		return
+	}
+	if linkUpd.Header.Type == syscall.RTM_NEWLINK && LinkIsOperUp(linkUpd.Link) {
+		u.linksUpDownstream[int(linkUpd.Index)] = true
+	} else {
+		delete(u.linksUpDownstream, int(linkUpd.Index))
+	}
+}
+
+// recordSentDownstream updates addrsSentDownstream for an update that the filter has released.
+func (u *UpdateFilter) recordSentDownstream(upd interface{}) {
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		k := flapStormKey{upd.LinkIndex, u.addrs.coalesceKey(upd)}
+		if upd.Type == unix.RTM_NEWROUTE {
+			u.addrsSentDownstream[k] = true
+		} else {
+			delete(u.addrsSentDownstream, k)
+		}
+	case netlink.LinkUpdate:
+		if upd.Header.Type == syscall.RTM_DELLINK {
+			for k := range u.addrsSentDownstream {
+				if k.ifaceIdx == int(upd.Index) {
+					delete(u.addrsSentDownstream, k)
+				}
+			}
+		}
+	}
+}
+
+// onUnknownUpdate logs and counts an update of a type that the filter can't handle, which the
+// caller then drops.
+func (u *UpdateFilter) onUnknownUpdate(upd interface{}) {
+	u.logCtx.WithFields(logrus.Fields{
+		"update": upd,
+		"type":   fmt.Sprintf("%T", upd),
+	}).Warn("FilterUpdates: ignoring unexpected update type.")
+	countUnknownUpdates.Inc()
+}
+
+// checkIfaceIndex returns true if the update's interface index is plausible.  The kernel's
+// interface indexes are positive int32s so a negative index, or one that doesn't fit in an int32,
+// would come from a corrupt message and, used as a map key, could mix up the state of unrelated
+// interfaces.  (Zero isn't a valid index either but it is what updates without an index carry.)
+// Updates with an implausible index are logged and the caller drops them.
+func (u *UpdateFilter) checkIfaceIndex(upd interface{}) bool {
+	idx := updateIfaceIdx(upd)
+	if idx >= 0 && idx <= math.MaxInt32 {
+		return true
+	}
+	u.logCtx.WithFields(logrus.Fields{
+		"ifaceIdx": idx,
+		"update":   upd,
+	}).Warn("FilterUpdates: update has an invalid interface index, dropping.")
+	return false
+}
+
+// inGracePeriod returns true if the startup grace period hasn't ended at the given time.
+func (u *UpdateFilter) inGracePeriod(now time.Time) bool {
+	return !u.graceEnd.IsZero() && now.Before(u.graceEnd)
+}
+
+// holdForGracePeriod returns readyAt, pushed back to the end of the startup grace period if it
+// falls within it.
+func (u *UpdateFilter) holdForGracePeriod(now, readyAt time.Time) time.Time {
+	if u.inGracePeriod(now) && readyAt.Before(u.graceEnd) {
+		return u.graceEnd
+	}
+	return readyAt
+}
+
+// sendReadyUpdates removes the updates that are ready to send from the queue, appending them to emit.
+// It returns the time at which the next update will be ready or the zero time if the queue is empty.
+//
+// IPv4 and IPv6 updates are damped independently: a pending update only holds up later updates
+// for the same address family (or any update, in the case of a link update).
+func (u *UpdateFilter) sendReadyUpdates(now time.Time, emit []interface{}) ([]interface{}, time.Time) {
+	var nextUpdTime time.Time
+	rateLimited := false
+	heldGroups := u.groupsWithUnreadyUpdates(now)
+	for _, idx := range u.queuedIfaceIdxs() {
+		upds := u.updatesByIfaceIdx[idx]
+		u.ifaceLogCtx(idx).Debug("FilterUpdates: examining updates for interface.")
+		group, grouped := u.groupForIface(idx)
+		groupHeld := grouped && heldGroups[group]
+		var blockedFamilies []int
+		remainingUpds := upds[:0]
+		for _, upd := range upds {
+			family := updateFamily(upd.Update)
+			blocked := familyConflictsWithAny(family, blockedFamilies)
+			ready := !blocked && now.Sub(upd.ReadyAt) >= 0
+			if ready && groupHeld {
+				// Another update in the group isn't ready yet; hold this one back so that the group's
+				// updates are sent together.  We'll be woken when that update is ready.
+				ready = false
+				blocked = true
+			}
+			limited := ready && u.delays.minEmitInterval > 0 && !u.lastReleaseAt.IsZero() &&
+				now.Sub(u.lastReleaseAt) < u.delays.minEmitInterval
+			if ready && !limited {
+				// Either update is old enough to prevent flapping or it's an address being added.
+				// Ready to send...
+				u.logCtx.WithField("update", upd).Debug("FilterUpdates: update ready to send.")
+				u.onTakenFromQueue(now, upd)
+				emit = append(emit, upd.Update)
+				if u.delays.minEmitInterval > 0 {
+					u.lastReleaseAt = now
+				}
+				continue
+			}
+			if u.delays.maxDeferral > 0 {
+				deadline := upd.QueuedAt.Add(u.delays.maxDeferral)
+				if now.Sub(deadline) >= 0 {
+					u.ifaceLogCtx(idx).WithField("update", upd).Info(
+						"FilterUpdates: update has been queued for too long, sending it early.")
+					u.onTakenFromQueue(now, upd)
+					emit = append(emit, upd.Update)
+					continue
+				}
+				if nextUpdTime.IsZero() || deadline.Before(nextUpdTime) {
+					nextUpdTime = deadline
+				}
+			}
+			if blocked {
+				u.logCtx.WithField("update", upd).Debug("FilterUpdates: update blocked by earlier update.")
+			} else if limited {
+				u.logCtx.WithField("update", upd).Debug("FilterUpdates: update ready but rate limited.")
+				rateLimited = true
+			} else {
+				// Update is too new, figure out when it'll be safe to send it.
+				u.logCtx.WithField("update", upd).Debug("FilterUpdates: update not ready.")
+				if nextUpdTime.IsZero() || upd.ReadyAt.Before(nextUpdTime) {
+					nextUpdTime = upd.ReadyAt
+				}
+			}
+			// Updates must be sent in order so this update blocks any later updates for the same family.
+			blockedFamilies = append(blockedFamilies, family)
+			remainingUpds = append(remainingUpds, upd)
+		}
+		if len(remainingUpds) == 0 {
+			u.ifaceLogCtx(idx).Debug("FilterUpdates: no more updates for interface.")
+			u.setQueue(idx, nil)
+			u.onQueueDrained(idx)
+		} else {
+			u.ifaceLogCtx(idx).WithField("num", len(remainingUpds)).Debug(
+				"FilterUpdates: still updates for interface.")
+			u.setQueue(idx, remainingUpds)
+		}
+	}
+	if rateLimited {
+		nextReleaseAt := u.lastReleaseAt.Add(u.delays.minEmitInterval)
+		if nextUpdTime.IsZero() || nextReleaseAt.Before(nextUpdTime) {
+			nextUpdTime = nextReleaseAt
+		}
+	}
+	return emit, nextUpdTime
+}
+
+// groupForIface returns the WithInterfaceGrouping group of the given interface.  It returns false
+// if grouping is disabled or the interface isn't in a group.
+func (u *UpdateFilter) groupForIface(idx int) (string, bool) {
+	if u.ifaces.ifaceGroup == nil {
+		return "", false
+	}
+	name := u.ifaceNamesByIdx[idx]
+	if name == "" {
+		return "", false
+	}
+	group := u.ifaces.ifaceGroup(name)
+	return group, group != ""
+}
+
+// queuedGroupMembers returns the other interfaces in the given interface's group that have
+// updates queued.
+func (u *UpdateFilter) queuedGroupMembers(idx int) []int {
+	group, grouped := u.groupForIface(idx)
+	if !grouped {
+		return nil
+	}
+	var members []int
+	for otherIdx := range u.updatesByIfaceIdx {
+		if otherIdx == idx {
+			continue
+		}
+		if otherGroup, ok := u.groupForIface(otherIdx); ok && otherGroup == group {
+			members = append(members, otherIdx)
+		}
+	}
+	return members
+}
+
+// groupQueueBlocksFamily returns true if another interface in the given interface's group has a
+// queued update that an update of the given family must be kept in order with.
+func (u *UpdateFilter) groupQueueBlocksFamily(idx int, family int) bool {
+	for _, otherIdx := range u.queuedGroupMembers(idx) {
+		if queueBlocksFamily(u.updatesByIfaceIdx[otherIdx], family) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsWithUnreadyUpdates returns the interface groups that have a queued update that isn't ready
+// to send at the given time.  Updates that have reached the max deferral don't count since they're
+// about to be sent anyway.
+func (u *UpdateFilter) groupsWithUnreadyUpdates(now time.Time) map[string]bool {
+	if u.ifaces.ifaceGroup == nil {
+		return nil
+	}
+	held := map[string]bool{}
+	for idx, upds := range u.updatesByIfaceIdx {
+		group, grouped := u.groupForIface(idx)
+		if !grouped {
+			continue
+		}
+		for _, upd := range upds {
+			overdue := u.delays.maxDeferral > 0 && !now.Before(upd.QueuedAt.Add(u.delays.maxDeferral))
+			if now.Before(upd.ReadyAt) && !overdue {
+				held[group] = true
+				break
+			}
+		}
+	}
+	return held
+}
+
+// updateFamily returns the address family of the given update; unix.AF_UNSPEC for link updates.
+func updateFamily(upd interface{}) int {
+	routeUpd, ok := upd.(netlink.RouteUpdate)
+	if !ok || routeUpd.Dst == nil {
+		return unix.AF_UNSPEC
+	}
+	return ipNetFamily(routeUpd.Dst)
+}
+
+// familyConflictsWithAny returns true if updates for the given family must be kept in order with
+// updates for any of the other families.  AF_UNSPEC (i.e. link updates) conflicts with everything.
+func familyConflictsWithAny(family int, others []int) bool {
+	for _, other := range others {
+		if family == unix.AF_UNSPEC || other == unix.AF_UNSPEC || family == other {
+			return true
+		}
+	}
+	return false
+}
+
+// ipNetsEqual returns true if the two CIDRs refer to the same kernel address.  net.IP.Equal treats
+// an IPv4 address and its IPv4-mapped IPv6 equivalent as equal so we also compare the address family.
+func ipNetsEqual(a *net.IPNet, b *net.IPNet) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	if ipNetFamily(a) != ipNetFamily(b) {
+		return false
+	}
+	aSize, aBits := a.Mask.Size()
+	bSize, bBits := b.Mask.Size()
+	return a.IP.Equal(b.IP) && aSize == bSize && aBits == bBits
+}
+
+// defaultCoalesceKey returns a key for the update's CIDR such that two updates have the same key if
+// and only if ipNetsEqual returns true for their CIDRs.
+func defaultCoalesceKey(upd netlink.RouteUpdate) string {
+	if upd.Dst == nil {
+		return ""
+	}
+	ones, bits := upd.Dst.Mask.Size()
+	return fmt.Sprintf("%d:%s/%d:%d", ipNetFamily(upd.Dst), upd.Dst.IP.To16(), ones, bits)
+}
+
+// sameIPCoalesceKey returns a key for the update's IP, ignoring its prefix length.
+func sameIPCoalesceKey(upd netlink.RouteUpdate) string {
+	if upd.Dst == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", ipNetFamily(upd.Dst), upd.Dst.IP.To16())
+}
+
+// ipNetFamily returns the address family of the given CIDR.  The IP alone isn't enough to determine
+// the family because IPv4 addresses are often stored in 16-byte form, so we prefer the length of the
+// mask.
+func ipNetFamily(n *net.IPNet) int {
+	switch _, bits := n.Mask.Size(); bits {
+	case 8 * net.IPv4len:
+		return unix.AF_INET
+	case 8 * net.IPv6len:
+		return unix.AF_INET6
+	}
+	if n.IP.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// shouldProcessRouteUpdate returns true if the update is for a local route that the filter should
+// handle.  We track addresses via their local routes rather than via address updates.  As well as
+// giving us the interface index directly, this means that we never see IPv6 addresses that are still
+// undergoing duplicate address detection: the kernel only installs the local route for an address once
+// it is no longer tentative.  Updates from other sources may include tentative addresses; see
+// WithSuppressTentative.
+func (u *UpdateFilter) shouldProcessRouteUpdate(routeUpd netlink.RouteUpdate) bool {
+	u.logCtx.WithField("route", routeUpd).Debug("Route update")
+	if !routeIsLocalUnicast(routeUpd.Route) {
+		u.logCtx.WithField("route", routeUpd).Debug("Ignoring non-local route.")
+		return false
+	}
+	if routeUpd.LinkIndex == 0 {
+		u.logCtx.WithField("route", routeUpd).Debug("Ignoring route with no link index.")
+		return false
+	}
+	if u.addrs.ignoreSecondary && u.isSecondary(routeUpd) {
+		u.logCtx.WithField("route", routeUpd).Debug("Ignoring route for secondary address.")
+		return false
+	}
+	if u.addrs.suppressTentative && routeUpd.Type == unix.RTM_NEWROUTE && u.isTentative(routeUpd) {
+		u.logCtx.WithField("route", routeUpd).Debug("Ignoring add of tentative address.")
+		return false
+	}
+	if len(u.addrs.ignoredScopes) > 0 && routeUpd.Dst != nil {
+		scope := addrScope(routeUpd.Dst.IP)
+		for _, s := range u.addrs.ignoredScopes {
+			if scope == s {
+				u.logCtx.WithField("route", routeUpd).Debug("Ignoring route for address in ignored scope.")
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isSecondary returns true if the WithSecondaryAddrFunc function reports that the update is for a
+// secondary address.
+func (u *UpdateFilter) isSecondary(routeUpd netlink.RouteUpdate) bool {
+	return u.addrs.secondaryFunc != nil && u.addrs.secondaryFunc(routeUpd)
+}
+
+// isTentative returns true if the WithTentativeAddrFunc function reports that the update is for a
+// tentative address.
+func (u *UpdateFilter) isTentative(routeUpd netlink.RouteUpdate) bool {
+	return u.addrs.tentativeFunc != nil && u.addrs.tentativeFunc(routeUpd)
+}
+
+// addrScope returns the scope of the given address.  The routes that we monitor are all in the local
+// table, which doesn't carry the scope of the address itself so we infer it from the IP.
+func addrScope(ip net.IP) netlink.Scope {
+	switch {
+	case ip.IsLoopback():
+		return netlink.SCOPE_HOST
+	case ip.IsLinkLocalUnicast():
+		return netlink.SCOPE_LINK
+	default:
+		return netlink.SCOPE_UNIVERSE
+	}
+}
+
+// updateRecentAddrs records the given address update in the recent address cache.  It returns false if
+// the update is an add that matches an address that is already in the cache.
+func (u *UpdateFilter) updateRecentAddrs(routeUpd netlink.RouteUpdate) bool {
+	idx := routeUpd.LinkIndex
+	oldAddrs := u.recentAddrsByIfaceIdx[idx]
+	addrs := oldAddrs[:0]
+	for _, r := range oldAddrs {
+		if !ipNetsEqual(r.Dst, routeUpd.Dst) {
+			addrs = append(addrs, r)
+			continue
+		}
+		if routeUpd.Type == unix.RTM_NEWROUTE && routesEqualIgnoringLifetime(r, routeUpd.Route) {
+			return false
+		}
+	}
+	if routeUpd.Type == unix.RTM_NEWROUTE {
+		if len(addrs) >= maxRecentAddrsPerIface {
+			addrs = addrs[1:]
+		}
+		addrs = append(addrs, routeUpd.Route)
+	}
+	if len(addrs) == 0 {
+		delete(u.recentAddrsByIfaceIdx, idx)
+	} else {
+		u.recentAddrsByIfaceIdx[idx] = addrs
+	}
+	return true
+}
+
+// routesEqualIgnoringLifetime compares the fields of the two local routes that matter for routing.
+func routesEqualIgnoringLifetime(a, b netlink.Route) bool {
+	return ipNetsEqual(a.Dst, b.Dst) &&
+		a.Src.Equal(b.Src) &&
+		a.Scope == b.Scope &&
+		a.Type == b.Type &&
+		a.Table == b.Table &&
+		a.Protocol == b.Protocol &&
+		a.Priority == b.Priority &&
+		a.Flags == b.Flags
+}
+
+func routeIsLocalUnicast(route netlink.Route) bool {
+	return route.Type == unix.RTN_LOCAL
+}
+
+// queueBlocksFamily returns true if the queue contains any updates that an update of the given family
+// would need to be queued behind.
+func queueBlocksFamily(upds []timestampedUpd, family int) bool {
+	for _, upd := range upds {
+		if familyConflictsWithAny(family, []int{updateFamily(upd.Update)}) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceQueuedAdd looks for a queued add with the given coalesce key.  If there is one, it replaces
+// it with newUpd, keeping its place in the queue, and returns true.
+func (u *UpdateFilter) replaceQueuedAdd(idx int, upds []timestampedUpd, key string, newUpd netlink.RouteUpdate) bool {
+	i := u.queuedAddrPos(idx, key, upds)
+	if i < 0 || upds[i].Update.(netlink.RouteUpdate).Type != unix.RTM_NEWROUTE {
+		return false
+	}
+	upds[i].Update = newUpd
+	upds[i].IngressID = u.lastIngressID
+	u.markQueueChanged(idx)
+	return true
+}
+
+// takeQueueSeq returns the Seq for an update that is being appended to a queue.
+func (u *UpdateFilter) takeQueueSeq() int64 {
+	seq := u.nextQueueSeq
+	u.nextQueueSeq++
+	return seq
+}
+
+// indexQueuedAddr adds a queued address update to queuedAddrSeqs.
+func (u *UpdateFilter) indexQueuedAddr(idx int, upd timestampedUpd) {
+	seqs := u.queuedAddrSeqs[idx]
+	if seqs == nil {
+		seqs = map[string]int64{}
+		u.queuedAddrSeqs[idx] = seqs
+	}
+	seqs[upd.Key] = upd.Seq
+}
+
+// unindexQueuedAddr removes an update that has left its queue from queuedAddrSeqs.  It does nothing
+// for a link update.
+func (u *UpdateFilter) unindexQueuedAddr(upd timestampedUpd) {
+	routeUpd, ok := upd.Update.(netlink.RouteUpdate)
+	if !ok {
+		return
+	}
+	seqs := u.queuedAddrSeqs[routeUpd.LinkIndex]
+	if seq, ok := seqs[upd.Key]; !ok || seq != upd.Seq {
+		return
+	}
+	delete(seqs, upd.Key)
+	if len(seqs) == 0 {
+		delete(u.queuedAddrSeqs, routeUpd.LinkIndex)
+	}
+}
+
+// queuedAddrPos returns the position in the interface's queue of the queued address update with
+// the given coalesce key, or -1 if there isn't one.
+func (u *UpdateFilter) queuedAddrPos(idx int, key string, upds []timestampedUpd) int {
+	seq, ok := u.queuedAddrSeqs[idx][key]
+	if !ok {
+		return -1
+	}
+	i := sort.Search(len(upds), func(i int) bool { return upds[i].Seq >= seq })
+	if i == len(upds) || upds[i].Seq != seq {
+		return -1
+	}
+	return i
+}
+
+// onQueueDrained records that the given interface's queue has drained by sending its updates, so
+// that notifySettled can call the settled callback once they have gone downstream.
+func (u *UpdateFilter) onQueueDrained(idx int) {
+	if u.notify.settledCallback == nil {
+		return
+	}
+	u.settledIfaces = append(u.settledIfaces, idx)
+}
+
+// notifySettled calls the settled callback for each interface whose queue has drained, unless
+// updates have been queued for it again since.
+func (u *UpdateFilter) notifySettled() {
+	settled := u.settledIfaces
+	u.settledIfaces = nil
+	notified := map[int]bool{}
+	for _, idx := range settled {
+		if notified[idx] || len(u.updatesByIfaceIdx[idx]) > 0 {
+			continue
+		}
+		notified[idx] = true
+		u.callSettledCallback(idx)
+	}
+}
+
+func (u *UpdateFilter) callSettledCallback(idx int) {
+	defer func() {
+		if r := recover(); r != nil {
+			u.logCtx.WithField("panic", r).Error("FilterUpdates: panic from interface settled callback, ignoring.")
+		}
+	}()
+	u.notify.settledCallback(idx)
+}
+
+func (u *UpdateFilter) onFlapSuppressed(idx int, addr *net.IPNet, goneFor time.Duration) {
+	if u.notify.flapCallback == nil || addr == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			u.logCtx.WithField("panic", r).Error("FilterUpdates: panic from flap callback, ignoring.")
+		}
+	}()
+	u.notify.flapCallback(idx, *addr, goneFor)
+}
+
+// onDoubleDelete is called when an address is deleted while a deletion of the same address is
+// still queued.  That isn't a flap; it suggests a confused driver or a bug so we flag it for
+// operators.  The new deletion still replaces the old one so only a single deletion is forwarded.
+func (u *UpdateFilter) onDoubleDelete(idx int, addr *net.IPNet, sincePrevious time.Duration) {
+	countDoubleDeletes.Inc()
+	u.stats.doubleDeletes.Add(1)
+	u.ifaceLogCtx(idx).WithFields(logrus.Fields{
+		"addr":          addr,
+		"sincePrevious": sincePrevious,
+	}).Warn("FilterUpdates: address deleted twice with no add in between.")
+}
+
+// logDecision logs a decision about an update using the message and fields documented on Decision.
+func (u *UpdateFilter) logDecision(decision Decision, upd interface{}, ingressID uint64, readyAt time.Time) {
+	level := logrus.DebugLevel
+	if decision == DecisionOverflow {
+		level = logrus.WarnLevel
+	}
+	if !u.logCtx.Logger.IsLevelEnabled(level) {
+		return
+	}
+	idx := updateIfaceIdx(upd)
+	addr := ""
+	if routeUpd, ok := upd.(netlink.RouteUpdate); ok && routeUpd.Dst != nil {
+		addr = routeUpd.Dst.String()
+	}
+	fields := logrus.Fields{
+		"addr":       addr,
+		"decision":   decision,
+		"readyAt":    readyAt,
+		"queueDepth": len(u.updatesByIfaceIdx[idx]),
+	}
+	if u.notify.netlinkHeaderLogging {
+		if ingressID != 0 {
+			fields["ingressID"] = ingressID
+		}
+		if linkUpd, ok := upd.(netlink.LinkUpdate); ok {
+			fields["nlSeq"] = linkUpd.Header.Seq
+			fields["nlPid"] = linkUpd.Header.Pid
+		}
+	}
+	u.ifaceLogCtx(idx).WithFields(fields).Log(level, logMsgsByDecision[decision])
+}
+
+// onIngress gives an update from our inputs the next ingress ID.  It is called at the start of each
+// pass, so it also forgets the IDs of the updates taken from the queue in the previous pass.
+func (u *UpdateFilter) onIngress(upd interface{}) {
+	clear(u.takenIngressIDs)
+	switch upd.(type) {
+	case netlink.RouteUpdate, netlink.LinkUpdate:
+		u.lastIngressID++
+		u.curIngressKey = u.ingressKeyOf(upd)
+	default:
+		u.curIngressKey = ingressKey{}
+	}
+}
+
+// emittedIngressID returns the ingress ID of an update that is being emitted, or 0 if it didn't
+// come from our inputs (for example, if it is part of a resync).
+func (u *UpdateFilter) emittedIngressID(upd interface{}) uint64 {
+	if !u.notify.netlinkHeaderLogging {
+		return 0
+	}
+	k := u.ingressKeyOf(upd)
+	if id, ok := u.takenIngressIDs[k]; ok {
+		return id
+	}
+	if k == u.curIngressKey {
+		// Sent without being queued.
+		return u.lastIngressID
+	}
+	return 0
+}
+
+func (u *UpdateFilter) ingressKeyOf(upd interface{}) ingressKey {
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		return ingressKey{ifaceIdx: upd.LinkIndex, coalesceKey: u.addrs.coalesceKey(upd)}
+	case netlink.LinkUpdate:
+		return ingressKey{ifaceIdx: int(upd.Index), isLink: true}
+	}
+	return ingressKey{}
+}
+
+// sendDebugEvent sends a SuppressionEvent to the debug channel, if one is configured.  It never
+// blocks; if the channel is full, the event is dropped.
+func (u *UpdateFilter) sendDebugEvent(idx int, addr *net.IPNet, kind SuppressionKind, readyAt time.Time) {
+	if u.notify.debugEventC == nil {
+		return
+	}
+	select {
+	case u.notify.debugEventC <- SuppressionEvent{
+		IfaceIdx:   idx,
+		Addr:       addr,
+		Kind:       kind,
+		OldReadyAt: readyAt,
+	}:
+	default:
+		u.logCtx.Debug("FilterUpdates: debug event channel full, dropping event.")
+	}
+}
+
+// isStale returns true if we've already seen a newer update for the same address.  Otherwise, it
+// records the update's sequence number.  It must only be called if sequenceFunc is set.
+func (u *UpdateFilter) isStale(idx int, key string, routeUpd netlink.RouteUpdate) bool {
+	seq, ok := u.addrs.sequenceFunc(routeUpd)
+	if !ok {
+		return false
+	}
+	k := flapStormKey{ifaceIdx: idx, coalesceKey: key}
+	if lastSeq, ok := u.lastSeqByAddr[k]; ok && seq < lastSeq {
+		return true
+	}
+	u.lastSeqByAddr[k] = seq
+	return false
+}
+
+// onLinkAdminState tracks whether the interface is administratively down.  When an interface comes
+// back up, it replays the address updates that were held back while it was down.
+func (u *UpdateFilter) onLinkAdminState(now time.Time, linkUpd netlink.LinkUpdate, emit []interface{}) ([]interface{}, bool) {
+	idx := int(linkUpd.Index)
+	if linkUpd.Header.Type == syscall.RTM_DELLINK {
+		delete(u.adminDownIfaces, idx)
+		delete(u.suppressedAddrsByIface, idx)
+		return emit, false
+	}
+	if linkUpd.Link == nil || linkUpd.Link.Attrs() == nil || linkUpd.Link.Attrs().RawFlags&unix.IFF_UP == 0 {
+		u.adminDownIfaces[idx] = true
+		return emit, false
+	}
+	if !u.adminDownIfaces[idx] {
+		return emit, false
+	}
+	delete(u.adminDownIfaces, idx)
+	suppressed := u.suppressedAddrsByIface[idx]
+	delete(u.suppressedAddrsByIface, idx)
+	u.ifaceLogCtx(idx).WithField("numUpdates", len(suppressed)).Debug(
+		"FilterUpdates: interface is administratively up, replaying held back address updates.")
+	var dueBeforeWake bool
+	for _, routeUpd := range suppressed {
+		var due bool
+		emit, due = u.onRouteUpdate(now, routeUpd, emit)
+		dueBeforeWake = dueBeforeWake || due
+	}
+	return emit, dueBeforeWake
+}
+
+// suppressAddrUpdate records an address update for an interface that is administratively down,
+// replacing any earlier update for the same address.
+func (u *UpdateFilter) suppressAddrUpdate(idx int, key string, routeUpd netlink.RouteUpdate) {
+	oldUpds := u.suppressedAddrsByIface[idx]
+	upds := oldUpds[:0]
+	for _, upd := range oldUpds {
+		if u.addrs.coalesceKey(upd) != key {
+			upds = append(upds, upd)
+		}
+	}
+	u.suppressedAddrsByIface[idx] = append(upds, routeUpd)
+}
+
+// observeDownTime updates the adaptive damping state for an address update.  It records the time of
+// each deletion and, when the address is re-added, folds the time that it was gone into the
+// interface's average down-time.
+func (u *UpdateFilter) observeDownTime(now time.Time, idx int, key string, routeUpd netlink.RouteUpdate) {
+	// Deletions that were never followed by a re-add weren't flaps.
+	for k, delTime := range u.addrDelTimesByAddr {
+		if now.Sub(delTime) > u.delays.adaptiveMaxDelay {
+			delete(u.addrDelTimesByAddr, k)
+			u.addDownTimeSample(k.ifaceIdx, 0)
+		}
+	}
+
+	k := flapStormKey{ifaceIdx: idx, coalesceKey: key}
+	if routeUpd.Type != unix.RTM_NEWROUTE {
+		if _, ok := u.addrDelTimesByAddr[k]; !ok {
+			u.addrDelTimesByAddr[k] = now
+		}
+		return
+	}
+	if delTime, ok := u.addrDelTimesByAddr[k]; ok {
+		delete(u.addrDelTimesByAddr, k)
+		u.addDownTimeSample(idx, now.Sub(delTime))
+	}
+}
+
+func (u *UpdateFilter) addDownTimeSample(idx int, downTime time.Duration) {
+	avg, ok := u.avgDownTimeByIface[idx]
+	if !ok {
+		avg = downTime
+	} else {
+		avg += time.Duration(adaptiveDampingWeight * float64(downTime-avg))
+	}
+	u.avgDownTimeByIface[idx] = avg
+	u.ifaceLogCtx(idx).WithFields(logrus.Fields{
+		"downTime":    downTime,
+		"avgDownTime": avg,
+	}).Debug("FilterUpdates: updated average down-time.")
+}
+
+// recordFlap records that an update for the given address was squashed and checks whether the address
+// is flapping persistently.  Once a flap storm has been reported, the address's history is reset so
+// that we report again only if the flapping continues.
+func (u *UpdateFilter) recordFlap(now time.Time, idx int, key string, addr *net.IPNet) {
+	if u.storm.flapStormThreshold <= 0 {
+		return
+	}
+	k := flapStormKey{ifaceIdx: idx, coalesceKey: key}
+	oldTimes := u.flapTimesByAddr[k]
+	times := oldTimes[:0]
+	for _, t := range oldTimes {
+		if now.Sub(t) < u.storm.flapStormWindow {
+			times = append(times, t)
+		}
+	}
+	times = append(times, now)
+	if len(times) <= u.storm.flapStormThreshold {
+		u.flapTimesByAddr[k] = times
+		return
+	}
+	delete(u.flapTimesByAddr, k)
+
+	u.ifaceLogCtx(idx).WithFields(logrus.Fields{
+		"addr":     addr,
+		"numFlaps": len(times),
+		"window":   u.storm.flapStormWindow,
+	}).Warn("FilterUpdates: address is flapping persistently.")
+	if u.notify.flapStormCallback == nil || addr == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			u.logCtx.WithField("panic", r).Error("FilterUpdates: panic from flap storm callback, ignoring.")
+		}
+	}()
+	u.notify.flapStormCallback(idx, *addr, len(times))
+}
+
+// enforceMaxQueueDepth removes the oldest updates for the given interface from the queue, appending
+// them to emit, if the queue has grown beyond the configured limit.
+func (u *UpdateFilter) enforceMaxQueueDepth(now time.Time, idx int, emit []interface{}) []interface{} {
+	upds := u.updatesByIfaceIdx[idx]
+	if u.delivery.maxQueueDepth <= 0 || len(upds) <= u.delivery.maxQueueDepth {
+		return emit
+	}
+	numOverflow := len(upds) - u.delivery.maxQueueDepth
+	for _, upd := range upds[:numOverflow] {
+		u.logDecision(DecisionOverflow, upd.Update, upd.IngressID, upd.ReadyAt)
+		u.onTakenFromQueue(now, upd)
+		emit = append(emit, upd.Update)
+	}
+	countQueueOverflows.Add(float64(numOverflow))
+	u.setQueue(idx, upds[numOverflow:])
+	return emit
+}
+
+// onSendTimeout handles updates that couldn't be sent downstream, either dropping them or putting
+// them back at the front of their queues, according to configuration.  It returns the time at which
+// the queue should next be processed.
+func (u *UpdateFilter) onSendTimeout(now time.Time, unsent []interface{}) time.Time {
+	if !u.delivery.requeueOnSendTimeout {
+		u.logCtx.WithFields(logrus.Fields{
+			"timeout":    u.delivery.sendTimeout,
+			"numDropped": len(unsent),
+		}).Error("FilterUpdates: timed out sending updates downstream, dropping them.")
+		return u.nextWake
+	}
+	u.logCtx.WithFields(logrus.Fields{
+		"timeout":     u.delivery.sendTimeout,
+		"numRequeued": len(unsent),
+	}).Error("FilterUpdates: timed out sending updates downstream, re-queueing them.")
+
+	retryAt := now.Add(u.delivery.sendTimeout)
+	u.requeueUpdates(now, unsent, retryAt)
+	if u.nextWake.IsZero() || retryAt.Before(u.nextWake) {
+		u.nextWake = retryAt
+	}
+	u.publishSnapshot(now)
+	return u.nextWake
+}
+
+// requeueUpdates puts updates that were taken off the queue back at the front of their queues, in
+// their original order.
+func (u *UpdateFilter) requeueUpdates(now time.Time, upds []interface{}, readyAt time.Time) {
+	// Work backwards so that the updates end up at the front of each queue in their original order.
+	for i := len(upds) - 1; i >= 0; i-- {
+		idx := updateIfaceIdx(upds[i])
+		queue := u.updatesByIfaceIdx[idx]
+		tsUpd := timestampedUpd{
+			QueuedAt: now,
+			ReadyAt:  readyAt,
+			Update:   upds[i],
+		}
+		if len(queue) > 0 {
+			// Keep the queue in Seq order.
+			tsUpd.Seq = queue[0].Seq - 1
+		} else {
+			tsUpd.Seq = u.takeQueueSeq()
+		}
+		if u.notify.netlinkHeaderLogging {
+			tsUpd.IngressID = u.takenIngressIDs[u.ingressKeyOf(upds[i])]
+		}
+		if routeUpd, ok := upds[i].(netlink.RouteUpdate); ok {
+			tsUpd.Key = u.addrs.coalesceKey(routeUpd)
+			u.indexQueuedAddr(idx, tsUpd)
+		}
+		u.setQueue(idx, append([]timestampedUpd{tsUpd}, queue...))
+	}
+}
+
+// updateIfaceIdx returns the index of the interface that the update applies to.
+func updateIfaceIdx(upd interface{}) int {
+	switch upd := upd.(type) {
+	case netlink.LinkUpdate:
+		return int(upd.Index)
+	case netlink.RouteUpdate:
+		return upd.LinkIndex
+	}
+	return 0
+}
+
+// passThroughUpdates is the main loop of FilterUpdates when flap damping is disabled.  It forwards
+// updates without any queueing.
+func (u *UpdateFilter) passThroughUpdates(ctx context.Context,
+	routeInC <-chan netlink.RouteUpdate, linkInC <-chan netlink.LinkUpdate,
+	sink updateSink,
+) error {
+	var heartbeatTimer, idleTimer reusableTimer
+	defer func() {
+		heartbeatTimer.stop()
+		idleTimer.stop()
+	}()
+	heartbeatC := u.heartbeatC(&heartbeatTimer)
+	u.heartbeat.lastEmitAt = u.monotonicNow()
+	idleC := u.idleC(&idleTimer)
+	for {
+		u.markActive()
+		var upd interface{}
+		select {
+		case <-ctx.Done():
+			u.logCtx.Info("FilterUpdates: Context expired, stopping")
+			return context.Cause(ctx)
+		case <-heartbeatC:
+			heartbeatC = u.heartbeatC(&heartbeatTimer)
+			continue
+		case <-idleC:
+			u.onIdleTimer(ctx, sink)
+			idleC = u.idleC(&idleTimer)
+			continue
+		case <-u.stopC:
+			// Nothing is queued so there's nothing to drain.
+			u.logCtx.Info("FilterUpdates: stop requested, stopping")
+			return nil
+		case <-u.resyncC:
+			// Nothing is queued so the resync is just the snapshot.
+			snap := u.appendAddrSnapshot(nil)
+			unsent := sink.send(ctx, snap)
+			u.onForwarded(snap, unsent)
+			if len(unsent) > 0 && ctx.Err() == nil {
+				u.logCtx.WithField("numUnsent", len(unsent)).Error(
+					"FilterUpdates: timed out sending resync downstream, dropping the rest of it.")
+			}
+			continue
+		case linkUpd, ok := <-linkInC:
+			if !ok {
+				u.logCtx.Error("FilterUpdates: link input channel closed.")
+				return errLinkInputClosed
+			}
+			countIngress(linkUpd)
+			u.recordUpdate(u.time.Now(), linkUpd)
+			upd = linkUpd
+		case routeUpd, ok := <-routeInC:
+			if !ok {
+				u.logCtx.Error("FilterUpdates: route input channel closed.")
+				return errRouteInputClosed
+			}
+			countIngress(routeUpd)
+			u.recordUpdate(u.time.Now(), routeUpd)
+			if !u.shouldProcessRouteUpdate(routeUpd) {
+				continue
+			}
+			upd = routeUpd
+		case upd = <-u.injectC:
+			countIngress(upd)
+			u.recordUpdate(u.time.Now(), upd)
+			if routeUpd, ok := upd.(netlink.RouteUpdate); ok && !u.shouldProcessRouteUpdate(routeUpd) {
+				continue
+			}
+		}
+		if len(sink.send(ctx, []interface{}{upd})) == 0 {
+			u.onForwarded([]interface{}{upd}, nil)
+			continue
+		}
+		if ctx.Err() != nil {
+			u.logCtx.Info("FilterUpdates: Context expired, stopping")
+			return context.Cause(ctx)
+		}
+		u.logCtx.WithFields(logrus.Fields{
+			"timeout": u.delivery.sendTimeout,
+			"update":  upd,
+		}).Error("FilterUpdates: timed out sending update downstream, dropping it.")
+	}
+}
+
+// flushQueuedUpdates forwards the queued updates after the context has been cancelled.  Since the
+// context is already done, it can't be used as an escape hatch for a blocked send.  Instead, we wait
+// for the consumer until the shutdown timeout expires; if the timeout is negative, we only send if
+// the consumer can accept the update immediately.  Either way, we give up on the first send that
+// fails.
+func (u *UpdateFilter) flushQueuedUpdates(sink updateSink) {
+	timeout := u.delivery.shutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	sendFn := sink.trySend
+	if timeout > 0 {
+		flushCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var timer reusableTimer
+		defer timer.stop()
+		timeoutC := timer.reset(u.time, timeout)
+		go func() {
+			select {
+			case <-timeoutC:
+				cancel()
+			case <-flushCtx.Done():
+			}
+		}()
+		sendFn = func(upd interface{}) bool {
+			return len(sink.send(flushCtx, []interface{}{upd})) == 0
+		}
+	}
+
+	numSent := 0
+	numDropped := 0
+	numAbandoned := 0
+	defer func() {
+		u.logCtx.WithFields(logrus.Fields{
+			"sent":      numSent,
+			"dropped":   numDropped,
+			"abandoned": numAbandoned,
+		}).Info("FilterUpdates: flushed queued updates on shutdown.")
+	}()
+	for _, idx := range u.queuedIfaceIdxs() {
+		upds := u.updatesByIfaceIdx[idx]
+		for i, upd := range upds {
+			if !u.delivery.flushDeletesOnShutdown && !isAddUpdate(upd.Update) {
+				u.logCtx.WithField("update", upd).Debug("FilterUpdates: not flushing deletion on shutdown.")
+				numDropped++
+				continue
+			}
+			if !sendFn(upd.Update) {
+				numAbandoned = u.countFlushable(upds[i:])
+				for otherIdx, otherUpds := range u.updatesByIfaceIdx {
+					if otherIdx != idx {
+						numAbandoned += u.countFlushable(otherUpds)
+					}
+				}
+				u.ifaceLogCtx(idx).WithField("abandoned", numAbandoned).Warn(
+					"FilterUpdates: consumer not ready, abandoning flush of queued updates.")
+				return
+			}
+			numSent++
+			u.onTakenFromQueue(u.monotonicNow(), upd)
+			u.onForwarded([]interface{}{upd.Update}, nil)
+		}
+		u.setQueue(idx, nil)
+		delete(u.queuedAddrSeqs, idx)
+	}
+}
+
+// countFlushable returns the number of the given updates that flushQueuedUpdates would try to send.
+func (u *UpdateFilter) countFlushable(upds []timestampedUpd) int {
+	n := 0
+	for _, upd := range upds {
+		if u.delivery.flushDeletesOnShutdown || isAddUpdate(upd.Update) {
+			n++
+		}
+	}
+	return n
+}
+
+// isAddUpdate returns true if the given update represents an address being added or a link coming up.
+func isAddUpdate(upd interface{}) bool {
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		return upd.Type == unix.RTM_NEWROUTE
+	case netlink.LinkUpdate:
+		return upd.Header.Type == syscall.RTM_NEWLINK && LinkIsOperUp(upd.Link)
+	}
+	return false
 }
@@ -0,0 +1,121 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// AddrEvent is the part of an address update that the filter uses.  It allows updates from a netlink
+// library other than vishvananda/netlink (or from a lightweight fake) to be fed to the filter; see
+// AdaptAddrEvents.  The filter itself works on vishvananda/netlink types: events are converted into
+// those on the way in.
+type AddrEvent interface {
+	LinkIndex() int
+	LinkAddress() net.IPNet
+	// NewAddr is true if the address was added and false if it was removed.
+	NewAddr() bool
+}
+
+// LinkEvent is the part of a link update that the filter uses.  See AdaptLinkEvents.
+type LinkEvent interface {
+	Index() int32
+	Name() string
+	// RawFlags returns the interface's IFF_* flags, as reported by the kernel.  It must include
+	// IFF_RUNNING, which carries the operational state: the filter and LinkIsOperUp treat a link
+	// without it as down, whatever its IFF_UP and IFF_LOWER_UP flags say.
+	RawFlags() uint32
+	// HardwareAddr returns the interface's MAC address, or nil if it is unknown.  It is needed for
+	// WithMACChangeChan to report MAC changes.
+	HardwareAddr() net.HardwareAddr
+	// Deleted is true if the interface was deleted.
+	Deleted() bool
+}
+
+// AddrEventToRouteUpdate converts an AddrEvent into the local route update that the filter expects
+// for an address.
+func AddrEventToRouteUpdate(e AddrEvent) netlink.RouteUpdate {
+	addr := e.LinkAddress()
+	upd := netlink.RouteUpdate{
+		Type: unix.RTM_DELROUTE,
+		Route: netlink.Route{
+			LinkIndex: e.LinkIndex(),
+			Dst:       &addr,
+			Table:     unix.RT_TABLE_LOCAL,
+			Type:      unix.RTN_LOCAL,
+		},
+	}
+	if e.NewAddr() {
+		upd.Type = unix.RTM_NEWROUTE
+	}
+	return upd
+}
+
+// LinkEventToLinkUpdate converts a LinkEvent into a netlink.LinkUpdate.
+func LinkEventToLinkUpdate(e LinkEvent) netlink.LinkUpdate {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Index = int(e.Index())
+	attrs.Name = e.Name()
+	attrs.RawFlags = e.RawFlags()
+	attrs.HardwareAddr = e.HardwareAddr()
+	upd := netlink.LinkUpdate{
+		IfInfomsg: nl.IfInfomsg{IfInfomsg: unix.IfInfomsg{
+			Index: e.Index(),
+			Flags: e.RawFlags(),
+		}},
+		Link: &netlink.Device{LinkAttrs: attrs},
+	}
+	upd.Header.Type = unix.RTM_NEWLINK
+	if e.Deleted() {
+		upd.Header.Type = unix.RTM_DELLINK
+	}
+	return upd
+}
+
+// AdaptAddrEvents converts the events from inC and sends them to outC, which can then be passed to
+// FilterUpdates.  It returns when ctx is done or inC is closed; in the latter case, it closes outC so
+// that FilterUpdates sees the closure.
+func AdaptAddrEvents(ctx context.Context, inC <-chan AddrEvent, outC chan<- netlink.RouteUpdate) {
+	adaptEvents(ctx, inC, outC, AddrEventToRouteUpdate)
+}
+
+// AdaptLinkEvents is the LinkEvent equivalent of AdaptAddrEvents.
+func AdaptLinkEvents(ctx context.Context, inC <-chan LinkEvent, outC chan<- netlink.LinkUpdate) {
+	adaptEvents(ctx, inC, outC, LinkEventToLinkUpdate)
+}
+
+func adaptEvents[E, U any](ctx context.Context, inC <-chan E, outC chan<- U, convert func(E) U) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-inC:
+			if !ok {
+				close(outC)
+				return
+			}
+			select {
+			case outC <- convert(e):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+
+	"github.com/vishvananda/netlink"
+)
+
+// BatchingUpdateFilter is a variant of UpdateFilter that sends its output in batches.  All the
+// updates that become ready at the same time (for example, when the damping timer pops and several
+// interfaces have pending updates) are sent as a single slice.  This allows consumers to do one
+// recalculation per batch rather than one per update.
+type BatchingUpdateFilter struct {
+	filter *UpdateFilter
+}
+
+// NewBatchingUpdateFilter creates a BatchingUpdateFilter.  It accepts the same options as
+// NewUpdateFilter.
+func NewBatchingUpdateFilter(options ...UpdateFilterOp) *BatchingUpdateFilter {
+	return &BatchingUpdateFilter{
+		filter: NewUpdateFilter(options...),
+	}
+}
+
+// FilterUpdates is the batching equivalent of UpdateFilter.FilterUpdates.  Within a batch, route and
+// link updates are sent on separate channels, routes first; consumers that care about the relative
+// order of route and link updates should use the non-batching filter.  Like the other variants, it
+// returns an error straight away if additional or typed outputs are registered.
+func (b *BatchingUpdateFilter) FilterUpdates(ctx context.Context,
+	routeOutC chan<- []netlink.RouteUpdate, routeInC <-chan netlink.RouteUpdate,
+	linkOutC chan<- []netlink.LinkUpdate, linkInC <-chan netlink.LinkUpdate,
+) error {
+	// Propagate failures to the downstream channels.
+	defer close(routeOutC)
+	defer close(linkOutC)
+
+	if err := b.filter.checkVariantOutputs(); err != nil {
+		return err
+	}
+	return b.filter.run(ctx, routeInC, linkInC, &batchSink{
+		filter:    b.filter,
+		routeOutC: routeOutC,
+		linkOutC:  linkOutC,
+	})
+}
+
+// Validate is as for UpdateFilter.Validate, except that additional and typed outputs aren't
+// supported.
+func (b *BatchingUpdateFilter) Validate() error {
+	return b.filter.validateVariant()
+}
+
+// QueueSnapshot is as for UpdateFilter.QueueSnapshot.
+func (b *BatchingUpdateFilter) QueueSnapshot() map[int]int {
+	return b.filter.QueueSnapshot()
+}
+
+// batchSink sends updates to the output channels of BatchingUpdateFilter.FilterUpdates.
+type batchSink struct {
+	filter    *UpdateFilter
+	routeOutC chan<- []netlink.RouteUpdate
+	linkOutC  chan<- []netlink.LinkUpdate
+	sendTimer reusableTimer
+}
+
+func (b *batchSink) send(ctx context.Context, upds []interface{}) []interface{} {
+	defer b.sendTimer.stop()
+	var routeUpds []netlink.RouteUpdate
+	var linkUpds []netlink.LinkUpdate
+	var linkUpdsToRetry []interface{}
+	for _, upd := range upds {
+		switch upd := upd.(type) {
+		case netlink.RouteUpdate:
+			routeUpds = append(routeUpds, upd)
+		case netlink.LinkUpdate:
+			linkUpds = append(linkUpds, upd)
+			linkUpdsToRetry = append(linkUpdsToRetry, upd)
+		}
+	}
+
+	timeoutC := b.filter.sendTimeoutC(&b.sendTimer)
+	if len(routeUpds) > 0 {
+		select {
+		case b.routeOutC <- routeUpds:
+		case <-timeoutC:
+			return upds
+		case <-ctx.Done():
+			return upds
+		}
+	}
+	if len(linkUpds) > 0 {
+		select {
+		case b.linkOutC <- linkUpds:
+		case <-timeoutC:
+			return linkUpdsToRetry
+		case <-ctx.Done():
+			return linkUpdsToRetry
+		}
+	}
+	return nil
+}
+
+func (b *batchSink) trySend(upd interface{}) bool {
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		select {
+		case b.routeOutC <- []netlink.RouteUpdate{upd}:
+			return true
+		default:
+		}
+	case netlink.LinkUpdate:
+		select {
+		case b.linkOutC <- []netlink.LinkUpdate{upd}:
+			return true
+		default:
+		}
+	}
+	return false
+}
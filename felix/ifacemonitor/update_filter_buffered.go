@@ -0,0 +1,139 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Update is an update sent by BufferedUpdateFilter: a netlink.RouteUpdate or netlink.LinkUpdate.
+type Update interface{}
+
+// BufferedUpdateFilter is a variant of UpdateFilter that sends its output to a buffered channel that
+// it owns, rather than to channels supplied by the caller.  The filter never waits for the consumer:
+// if the consumer is momentarily slow, ready updates collect in the buffer and the filter carries on
+// draining its queue.  If the buffer fills up, the oldest update in the buffer is dropped to make
+// room and the drop is counted; see Dropped.  Consumers that can't tolerate lost updates should
+// size the buffer for their worst-case burst and resync if Dropped increases.
+type BufferedUpdateFilter struct {
+	filter     *UpdateFilter
+	bufferSize int
+	outC       chan Update
+	numDropped atomic.Uint64
+}
+
+// NewBufferedUpdateFilter creates a BufferedUpdateFilter whose buffer holds up to bufferSize updates.
+// It accepts the same options as NewUpdateFilter.  If bufferSize isn't positive, FilterUpdates and
+// Validate return an error.
+func NewBufferedUpdateFilter(bufferSize int, options ...UpdateFilterOp) *BufferedUpdateFilter {
+	b := &BufferedUpdateFilter{
+		filter:     NewUpdateFilter(options...),
+		bufferSize: bufferSize,
+	}
+	if bufferSize > 0 {
+		b.outC = make(chan Update, bufferSize)
+	}
+	return b
+}
+
+// FilterUpdates is the buffered equivalent of UpdateFilter.FilterUpdates.  Filtered updates are sent
+// in order to the channel returned by Updates, which is closed when FilterUpdates returns.  It
+// returns an error straight away if the filter has no buffer or if additional or typed outputs are
+// registered.
+func (b *BufferedUpdateFilter) FilterUpdates(ctx context.Context,
+	routeInC <-chan netlink.RouteUpdate, linkInC <-chan netlink.LinkUpdate,
+) error {
+	if b.outC == nil {
+		return errors.New("buffered update filter has no buffer")
+	}
+	// Propagate failures to the downstream channel.
+	defer close(b.outC)
+
+	if err := b.filter.checkVariantOutputs(); err != nil {
+		return err
+	}
+	return b.filter.run(ctx, routeInC, linkInC, &bufferSink{
+		buffer: b,
+	})
+}
+
+// Updates returns the channel on which FilterUpdates sends its updates.
+func (b *BufferedUpdateFilter) Updates() <-chan Update {
+	return b.outC
+}
+
+// Dropped returns the number of updates that have been dropped because the buffer was full.  It is
+// safe to call from any goroutine.
+func (b *BufferedUpdateFilter) Dropped() uint64 {
+	return b.numDropped.Load()
+}
+
+// Validate is as for UpdateFilter.Validate, except that additional and typed outputs aren't
+// supported.
+func (b *BufferedUpdateFilter) Validate() error {
+	if b.bufferSize <= 0 {
+		return errors.Join(b.filter.validateVariant(), errors.New("buffer size must be positive"))
+	}
+	return b.filter.validateVariant()
+}
+
+// QueueSnapshot is as for UpdateFilter.QueueSnapshot.
+func (b *BufferedUpdateFilter) QueueSnapshot() map[int]int {
+	return b.filter.QueueSnapshot()
+}
+
+// bufferSink sends updates to the output channel of BufferedUpdateFilter.FilterUpdates.  It is the
+// only sender on the channel so, once it has removed the oldest update from a full buffer, there is
+// room for the new one.  Since it never blocks, sends never fail.
+type bufferSink struct {
+	buffer *BufferedUpdateFilter
+}
+
+func (b *bufferSink) send(_ context.Context, upds []interface{}) []interface{} {
+	for _, upd := range upds {
+		b.trySend(upd)
+	}
+	return nil
+}
+
+func (b *bufferSink) trySend(upd interface{}) bool {
+	var numDropped uint64
+	for {
+		select {
+		case b.buffer.outC <- upd:
+			// Only count drops once their replacement is in the buffer so that a consumer that sees
+			// Dropped increase can find the replacement.
+			if numDropped > 0 {
+				b.buffer.numDropped.Add(numDropped)
+				countBufferOverflowDrops.Add(float64(numDropped))
+			}
+			return true
+		default:
+		}
+		// The buffer is full; drop its oldest update.  The consumer may have beaten us to it, in
+		// which case there's now room anyway.
+		select {
+		case dropped := <-b.buffer.outC:
+			numDropped++
+			b.buffer.filter.logCtx.WithField("update", dropped).Warn(
+				"FilterUpdates: output buffer full, dropping oldest update.")
+		default:
+		}
+	}
+}
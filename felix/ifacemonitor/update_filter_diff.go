@@ -0,0 +1,212 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// AddressDiff is the net change to one interface's addresses, as sent by DiffUpdateFilter.
+type AddressDiff struct {
+	IfaceIdx int
+	// Added holds the addresses that are present now but weren't at the previous diff.
+	Added []net.IPNet
+	// Removed holds the addresses that were present at the previous diff but aren't now.
+	Removed []net.IPNet
+}
+
+// DiffUpdateFilter is a variant of UpdateFilter that, instead of sending individual updates, sends
+// an AddressDiff for each interface whose addresses change in a batch.  All the updates that become
+// ready at the same time (for example, when the damping timer pops) are applied to the interface's
+// addresses, as sent so far, and the net change is sent.  This suits consumers that maintain their
+// own set of addresses for each interface, since they don't need to work out the change themselves.
+//
+// Link updates only contribute to the diffs by way of interface deletions, which remove all of the
+// interface's addresses.  Batches that don't change an interface's addresses (such as an address
+// that was added and removed again) don't produce a diff.
+//
+// Diffs are sent per batch, not once an interface's queue has drained.  If an interface's queued
+// updates become ready at different times, it gets a diff for each batch; updates that are still
+// queued aren't included.
+type DiffUpdateFilter struct {
+	filter *UpdateFilter
+}
+
+// NewDiffUpdateFilter creates a DiffUpdateFilter.  It accepts the same options as NewUpdateFilter.
+func NewDiffUpdateFilter(options ...UpdateFilterOp) *DiffUpdateFilter {
+	return &DiffUpdateFilter{
+		filter: NewUpdateFilter(options...),
+	}
+}
+
+// FilterUpdates is the diff equivalent of UpdateFilter.FilterUpdates.  It returns an error straight
+// away if additional or typed outputs are registered.
+func (d *DiffUpdateFilter) FilterUpdates(ctx context.Context,
+	diffOutC chan<- AddressDiff,
+	routeInC <-chan netlink.RouteUpdate, linkInC <-chan netlink.LinkUpdate,
+) error {
+	// Propagate failures to the downstream channel.
+	defer close(diffOutC)
+
+	if err := d.filter.checkVariantOutputs(); err != nil {
+		return err
+	}
+	return d.filter.run(ctx, routeInC, linkInC, &diffSink{
+		filter:       d.filter,
+		diffOutC:     diffOutC,
+		addrsByIface: map[int][]netlink.RouteUpdate{},
+	})
+}
+
+// Validate is as for UpdateFilter.Validate, except that additional and typed outputs aren't
+// supported.
+func (d *DiffUpdateFilter) Validate() error {
+	return d.filter.validateVariant()
+}
+
+// QueueSnapshot is as for UpdateFilter.QueueSnapshot.
+func (d *DiffUpdateFilter) QueueSnapshot() map[int]int {
+	return d.filter.QueueSnapshot()
+}
+
+// diffSink sends updates to the output channel of DiffUpdateFilter.FilterUpdates.  It tracks the
+// addresses of each interface according to the diffs that it has sent.  An interface's addresses
+// are only updated once its diff has been sent so that, if the send fails and the filter re-queues
+// the updates, the diff is recalculated in full when they're re-sent.
+type diffSink struct {
+	filter       *UpdateFilter
+	diffOutC     chan<- AddressDiff
+	addrsByIface map[int][]netlink.RouteUpdate
+	sendTimer    reusableTimer
+}
+
+func (d *diffSink) send(ctx context.Context, upds []interface{}) []interface{} {
+	defer d.sendTimer.stop()
+	var idxs []int
+	updsByIface := map[int][]interface{}{}
+	for _, upd := range upds {
+		idx, ok := diffIfaceIdx(upd)
+		if !ok {
+			continue
+		}
+		if _, ok := updsByIface[idx]; !ok {
+			idxs = append(idxs, idx)
+		}
+		updsByIface[idx] = append(updsByIface[idx], upd)
+	}
+
+	timeoutC := d.filter.sendTimeoutC(&d.sendTimer)
+	for i, idx := range idxs {
+		diff, addrs := d.diff(idx, updsByIface[idx])
+		if len(diff.Added) == 0 && len(diff.Removed) == 0 {
+			d.commit(idx, addrs)
+			continue
+		}
+		select {
+		case d.diffOutC <- diff:
+			d.commit(idx, addrs)
+			continue
+		case <-timeoutC:
+		case <-ctx.Done():
+		}
+		var unsent []interface{}
+		for _, idx := range idxs[i:] {
+			unsent = append(unsent, updsByIface[idx]...)
+		}
+		return unsent
+	}
+	return nil
+}
+
+func (d *diffSink) trySend(upd interface{}) bool {
+	idx, ok := diffIfaceIdx(upd)
+	if !ok {
+		return true
+	}
+	diff, addrs := d.diff(idx, []interface{}{upd})
+	if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+		select {
+		case d.diffOutC <- diff:
+		default:
+			return false
+		}
+	}
+	d.commit(idx, addrs)
+	return true
+}
+
+// diff applies the given updates to a copy of the interface's addresses and returns the net change
+// along with the resulting addresses.
+func (d *diffSink) diff(idx int, upds []interface{}) (AddressDiff, []netlink.RouteUpdate) {
+	oldAddrs := d.addrsByIface[idx]
+	addrsByIface := map[int][]netlink.RouteUpdate{
+		idx: append([]netlink.RouteUpdate(nil), oldAddrs...),
+	}
+	for _, upd := range upds {
+		switch upd := upd.(type) {
+		case netlink.RouteUpdate:
+			applyEmittedAddr(addrsByIface, upd, d.filter.addrs.coalesceIgnoresMask)
+		case netlink.LinkUpdate:
+			delete(addrsByIface, idx)
+		}
+	}
+	newAddrs := addrsByIface[idx]
+	return AddressDiff{
+		IfaceIdx: idx,
+		Added:    addrsMissingFrom(newAddrs, oldAddrs),
+		Removed:  addrsMissingFrom(oldAddrs, newAddrs),
+	}, newAddrs
+}
+
+func (d *diffSink) commit(idx int, addrs []netlink.RouteUpdate) {
+	if len(addrs) == 0 {
+		delete(d.addrsByIface, idx)
+		return
+	}
+	d.addrsByIface[idx] = addrs
+}
+
+// diffIfaceIdx returns the interface of an update that may affect the interface's addresses.
+func diffIfaceIdx(upd interface{}) (int, bool) {
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		return upd.LinkIndex, upd.Dst != nil
+	case netlink.LinkUpdate:
+		return int(upd.Index), upd.Header.Type == syscall.RTM_DELLINK
+	}
+	return 0, false
+}
+
+// addrsMissingFrom returns the addresses of the updates in a that have no counterpart in b.
+func addrsMissingFrom(a, b []netlink.RouteUpdate) []net.IPNet {
+	var missing []net.IPNet
+	for _, upd := range a {
+		found := false
+		for _, other := range b {
+			if ipNetsEqual(upd.Dst, other.Dst) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, *upd.Dst)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+
+	"github.com/vishvananda/netlink"
+)
+
+// GenerationUpdate is an update sent by FilterUpdatesWithGenerations.
+type GenerationUpdate struct {
+	// Generation is one more than the generation of the previous update that the filter sent; the
+	// first update has generation 1.  A consumer that sees a gap has missed an update.
+	Generation uint64
+	// Update is a netlink.RouteUpdate or netlink.LinkUpdate.
+	Update interface{}
+}
+
+// FilterUpdatesWithGenerations is a variant of FilterUpdates that sends each update wrapped in a
+// GenerationUpdate, on a single channel, so that consumers that receive updates from several sources
+// can put them in order and detect updates that went missing.  Additional and typed outputs (see
+// WithAdditionalOutput and WithTypedOutput) aren't supported; if any are registered, it returns an
+// error straight away.
+func (u *UpdateFilter) FilterUpdatesWithGenerations(ctx context.Context,
+	outC chan<- GenerationUpdate,
+	routeInC <-chan netlink.RouteUpdate, linkInC <-chan netlink.LinkUpdate,
+) error {
+	// Propagate failures to the downstream channel.
+	defer close(outC)
+
+	if err := u.checkVariantOutputs(); err != nil {
+		return err
+	}
+	return u.run(ctx, routeInC, linkInC, &generationSink{
+		filter: u,
+		outC:   outC,
+	})
+}
+
+// Generation returns the generation of the most recent update sent by FilterUpdatesWithGenerations,
+// or 0 if it hasn't sent any.  It is safe to call from any goroutine.
+func (u *UpdateFilter) Generation() uint64 {
+	return u.generation.Load()
+}
+
+// generationSink sends updates to the output channel of FilterUpdatesWithGenerations.  A generation
+// is only used up when its update is sent so, if a send fails and the update is re-queued, it gets
+// the same generation when it is re-sent.
+type generationSink struct {
+	filter    *UpdateFilter
+	outC      chan<- GenerationUpdate
+	sendTimer reusableTimer
+}
+
+func (g *generationSink) send(ctx context.Context, upds []interface{}) []interface{} {
+	defer g.sendTimer.stop()
+	for i, upd := range upds {
+		timeoutC := g.filter.sendTimeoutC(&g.sendTimer)
+		select {
+		case g.outC <- g.next(upd):
+			g.filter.generation.Add(1)
+			continue
+		case <-timeoutC:
+		case <-ctx.Done():
+		}
+		return upds[i:]
+	}
+	return nil
+}
+
+func (g *generationSink) trySend(upd interface{}) bool {
+	select {
+	case g.outC <- g.next(upd):
+		g.filter.generation.Add(1)
+		return true
+	default:
+	}
+	return false
+}
+
+func (g *generationSink) next(upd interface{}) GenerationUpdate {
+	return GenerationUpdate{
+		Generation: g.filter.generation.Load() + 1,
+		Update:     upd,
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// heartbeatState holds the settings and state behind WithHeartbeatInterval, which keeps LastActive()
+// advancing while the filter is idle, and WithHeartbeat, which sends heartbeats downstream.
+type heartbeatState struct {
+	// interval is the WithHeartbeatInterval interval.
+	interval time.Duration
+	// idleInterval is the WithHeartbeat interval.
+	idleInterval time.Duration
+
+	// lastEmitAt is the time at which the filter last sent something downstream.  Only maintained
+	// if idleInterval is set.
+	lastEmitAt time.Time
+	// lastActiveNanos holds the time of the filter goroutine's last loop iteration as nanoseconds
+	// since the epoch, or 0 if it hasn't started.  Read via LastActive().
+	lastActiveNanos atomic.Int64
+}
+
+// HeartbeatLinkType is the link type reported by a HeartbeatLink.
+const HeartbeatLinkType = "ifacemonitor-heartbeat"
+
+// HeartbeatLink is the Link of the heartbeat updates sent by WithHeartbeat.  It doesn't correspond
+// to any real interface: its index is 0 and its name is empty.
+type HeartbeatLink struct {
+	netlink.LinkAttrs
+}
+
+func (h *HeartbeatLink) Attrs() *netlink.LinkAttrs {
+	return &h.LinkAttrs
+}
+
+func (h *HeartbeatLink) Type() string {
+	return HeartbeatLinkType
+}
+
+// IsHeartbeat returns true if the update is a heartbeat sent by WithHeartbeat.
+func IsHeartbeat(upd netlink.LinkUpdate) bool {
+	_, ok := upd.Link.(*HeartbeatLink)
+	return ok
+}
+
+func newHeartbeatUpdate() netlink.LinkUpdate {
+	return netlink.LinkUpdate{Link: &HeartbeatLink{LinkAttrs: netlink.NewLinkAttrs()}}
+}
+
+// LastActive returns the time of the filter goroutine's most recent loop iteration, or the zero time
+// if FilterUpdates hasn't been started.  It is safe to call from any goroutine.
+//
+// It is intended to back a liveness report.  To wire it into Felix's health aggregator, configure
+// the filter WithHeartbeatInterval(d) so that it stays active while idle, register a reporter with
+// a timeout comfortably larger than d and report from a goroutine, for example:
+//
+//	healthAggregator.RegisterReporter("IfaceMonitorFilter", &health.HealthReport{Live: true}, 3*d)
+//	for range time.NewTicker(d).C {
+//		live := time.Since(filter.LastActive()) < 3*d
+//		healthAggregator.Report("IfaceMonitorFilter", &health.HealthReport{Live: live})
+//	}
+//
+// If the filter goroutine exits or wedges, LastActive() stops advancing and the reporter goes
+// non-live.
+func (u *UpdateFilter) LastActive() time.Time {
+	nanos := u.heartbeat.lastActiveNanos.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// markActive records that the filter goroutine is still making progress, for LastActive().
+func (u *UpdateFilter) markActive() {
+	u.heartbeat.lastActiveNanos.Store(u.time.Now().UnixNano())
+}
+
+// idleC arms the given timer to fire when the filter will have been idle for the WithHeartbeat
+// interval and returns its channel, or nil if idle heartbeats are disabled.
+func (u *UpdateFilter) idleC(timer *reusableTimer) <-chan time.Time {
+	if u.heartbeat.idleInterval <= 0 {
+		return nil
+	}
+	return timer.reset(u.time, u.heartbeat.idleInterval-u.monotonicNow().Sub(u.heartbeat.lastEmitAt))
+}
+
+// onIdleTimer sends a heartbeat downstream if the filter hasn't sent anything for the WithHeartbeat
+// interval.  If it has, the next check is pushed back to the end of the new idle interval.
+func (u *UpdateFilter) onIdleTimer(ctx context.Context, sink updateSink) {
+	if u.monotonicNow().Sub(u.heartbeat.lastEmitAt) < u.heartbeat.idleInterval {
+		return
+	}
+	if len(sink.send(ctx, []interface{}{newHeartbeatUpdate()})) > 0 {
+		u.logCtx.Debug("FilterUpdates: failed to send heartbeat downstream.")
+	}
+	// Even if the send failed, wait for another interval before trying again.
+	u.heartbeat.lastEmitAt = u.monotonicNow()
+}
+
+// heartbeatC arms the given timer to fire after the heartbeat interval and returns its channel, or
+// nil if heartbeats are disabled.
+func (u *UpdateFilter) heartbeatC(timer *reusableTimer) <-chan time.Time {
+	if u.heartbeat.interval <= 0 {
+		return nil
+	}
+	return timer.reset(u.time, u.heartbeat.interval)
+}
@@ -0,0 +1,413 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestIPNetsEqual(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		a, b  *net.IPNet
+		equal bool
+	}{
+		{
+			name:  "same IPv4",
+			a:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(16, 32)},
+			b:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(16, 32)},
+			equal: true,
+		},
+		{
+			name:  "IPv4 in 4- and 16-byte form",
+			a:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+			b:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(32, 32)},
+			equal: true,
+		},
+		{
+			name:  "IPv4 vs IPv4-mapped IPv6",
+			a:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+			b:     &net.IPNet{IP: net.ParseIP("::ffff:10.0.0.1"), Mask: net.CIDRMask(128, 128)},
+			equal: false,
+		},
+		{
+			name:  "IPv4 vs IPv4-mapped IPv6 with no mask",
+			a:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4()},
+			b:     &net.IPNet{IP: net.ParseIP("::ffff:10.0.0.1"), Mask: net.CIDRMask(128, 128)},
+			equal: false,
+		},
+		{
+			name:  "different prefix length",
+			a:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(16, 32)},
+			b:     &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(24, 32)},
+			equal: false,
+		},
+		{
+			name:  "same IPv6",
+			a:     &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+			b:     &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+			equal: true,
+		},
+		{
+			name:  "nil vs non-nil",
+			a:     nil,
+			b:     &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+			equal: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if eq := ipNetsEqual(tc.a, tc.b); eq != tc.equal {
+				t.Errorf("ipNetsEqual(%v, %v) = %v, expected %v", tc.a, tc.b, eq, tc.equal)
+			}
+			if eq := ipNetsEqual(tc.b, tc.a); eq != tc.equal {
+				t.Errorf("ipNetsEqual(%v, %v) = %v, expected %v", tc.b, tc.a, eq, tc.equal)
+			}
+			keyA := defaultCoalesceKey(netlink.RouteUpdate{Route: netlink.Route{Dst: tc.a}})
+			keyB := defaultCoalesceKey(netlink.RouteUpdate{Route: netlink.Route{Dst: tc.b}})
+			if (keyA == keyB) != tc.equal {
+				t.Errorf("defaultCoalesceKey gave %q and %q, expected equal=%v", keyA, keyB, tc.equal)
+			}
+		})
+	}
+}
+
+func TestDrainReady(t *testing.T) {
+	u := NewUpdateFilter()
+	start := time.Now()
+	routeDel := netlink.RouteUpdate{
+		Type: unix.RTM_DELROUTE,
+		Route: netlink.Route{
+			LinkIndex: 2,
+			Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+			Type:      unix.RTN_LOCAL,
+		},
+	}
+	u.FilterOne(start, routeDel)
+
+	if emit := u.drainReady(start.Add(99 * time.Millisecond)); len(emit) != 0 {
+		t.Errorf("Expected no updates to be ready, got %v", emit)
+	}
+	if !u.nextWake.Equal(start.Add(100 * time.Millisecond)) {
+		t.Errorf("Expected next wake to be unchanged, got %v", u.nextWake)
+	}
+	if emit := u.drainReady(start.Add(100 * time.Millisecond)); len(emit) != 1 || !reflect.DeepEqual(emit[0], routeDel) {
+		t.Errorf("Expected delete to be ready, got %v", emit)
+	}
+	if len(u.updatesByIfaceIdx) != 0 || !u.nextWake.IsZero() {
+		t.Errorf("Expected queue to be empty, got %v (next wake %v)", u.updatesByIfaceIdx, u.nextWake)
+	}
+}
+
+func TestQueueLatencyObserved(t *testing.T) {
+	u := NewUpdateFilter()
+	start := time.Now()
+	routeDel := netlink.RouteUpdate{
+		Type: unix.RTM_DELROUTE,
+		Route: netlink.Route{
+			LinkIndex: 2,
+			Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+			Type:      unix.RTN_LOCAL,
+		},
+	}
+	before := readQueueLatency(t)
+	u.FilterOne(start, routeDel)
+	if emit := u.drainReady(start.Add(150 * time.Millisecond)); len(emit) != 1 {
+		t.Fatalf("Expected delete to be ready, got %v", emit)
+	}
+
+	after := readQueueLatency(t)
+	if n := after.GetSampleCount() - before.GetSampleCount(); n != 1 {
+		t.Errorf("Expected one latency sample, got %d", n)
+	}
+	if d := after.GetSampleSum() - before.GetSampleSum(); d < 0.1499 || d > 0.1501 {
+		t.Errorf("Expected latency of 150ms, got %vs", d)
+	}
+}
+
+func readQueueLatency(t *testing.T) *dto.Histogram {
+	var m dto.Metric
+	if err := histQueueLatency.Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return m.GetHistogram()
+}
+
+type testNeighUpdate struct {
+	ifaceIdx int
+}
+
+func TestChanSinkTypedOutputs(t *testing.T) {
+	neighOutC := make(chan interface{}, 1)
+	u := NewUpdateFilter(WithTypedOutput(testNeighUpdate{}, neighOutC))
+	routeOutC := make(chan netlink.RouteUpdate, 1)
+	sink := &chanSink{filter: u, routeOutC: routeOutC}
+
+	routeUpd := netlink.RouteUpdate{Type: unix.RTM_NEWROUTE}
+	neighUpd := testNeighUpdate{ifaceIdx: 2}
+	var before dto.Metric
+	if err := countUnknownUpdates.Write(&before); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	if unsent := sink.send(context.Background(), []interface{}{routeUpd, "unknown", neighUpd}); len(unsent) != 0 {
+		t.Errorf("Expected all updates to be sent or dropped, got unsent %v", unsent)
+	}
+	if got := <-routeOutC; !reflect.DeepEqual(got, routeUpd) {
+		t.Errorf("Expected route update on route channel, got %v", got)
+	}
+	if got := <-neighOutC; got != neighUpd {
+		t.Errorf("Expected registered update on its own channel, got %v", got)
+	}
+	var after dto.Metric
+	if err := countUnknownUpdates.Write(&after); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	if n := after.GetCounter().GetValue() - before.GetCounter().GetValue(); n != 1 {
+		t.Errorf("Expected one unknown update to be counted, got %v", n)
+	}
+
+	if !sink.trySend(neighUpd) || sink.trySend(neighUpd) {
+		t.Errorf("Expected trySend to succeed only while the channel has room")
+	}
+}
+
+func TestTimerDelayClampedToMinRetryDelay(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		opts     []UpdateFilterOp
+		nextWake time.Time
+		expected time.Duration
+	}{
+		{"future wake", nil, now.Add(50 * time.Millisecond), 50 * time.Millisecond},
+		{"wake due now", nil, now, DefaultMinRetryDelay},
+		{"wake in the past", nil, now.Add(-time.Second), DefaultMinRetryDelay},
+		{"wake in the past, custom minimum", []UpdateFilterOp{WithMinRetryDelay(5 * time.Millisecond)},
+			now.Add(-time.Second), 5 * time.Millisecond},
+		{"wake just after now, custom minimum", []UpdateFilterOp{WithMinRetryDelay(5 * time.Millisecond)},
+			now.Add(time.Nanosecond), 5 * time.Millisecond},
+		{"zero minimum means default", []UpdateFilterOp{WithMinRetryDelay(0)},
+			now.Add(-time.Second), DefaultMinRetryDelay},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := NewUpdateFilter(tc.opts...)
+			if d := u.timerDelay(now, tc.nextWake); d != tc.expected {
+				t.Errorf("Expected delay %v, got %v", tc.expected, d)
+			}
+		})
+	}
+}
+
+func TestSequenceNumbersOnlyTrackedWithSequenceFunc(t *testing.T) {
+	u := NewUpdateFilter()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		u.FilterOne(start, netlink.RouteUpdate{
+			Type: unix.RTM_NEWROUTE,
+			Route: netlink.Route{
+				LinkIndex: 2,
+				Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, byte(i)).To4(), Mask: net.CIDRMask(32, 32)},
+				Type:      unix.RTN_LOCAL,
+			},
+		})
+	}
+	if len(u.lastSeqByAddr) != 0 {
+		t.Errorf("Expected no sequence numbers to be tracked, got %v", u.lastSeqByAddr)
+	}
+}
+
+func TestQueuedAddrIndexFollowsQueue(t *testing.T) {
+	u := NewUpdateFilter(WithMaxTrackedInterfaces(1))
+	start := time.Now()
+	routeUpd := func(typ uint16, idx int, i byte) netlink.RouteUpdate {
+		return netlink.RouteUpdate{
+			Type: typ,
+			Route: netlink.Route{
+				LinkIndex: idx,
+				Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, i).To4(), Mask: net.CIDRMask(32, 32)},
+				Type:      unix.RTN_LOCAL,
+			},
+		}
+	}
+	expectIndexed := func(idx int) {
+		t.Helper()
+		upds := u.updatesByIfaceIdx[idx]
+		numAddrs := 0
+		for i, upd := range upds {
+			if _, ok := upd.Update.(netlink.RouteUpdate); !ok {
+				continue
+			}
+			numAddrs++
+			if pos := u.queuedAddrPos(idx, upd.Key, upds); pos != i {
+				t.Errorf("Expected %v to be indexed at %d, got %d", upd.Update, i, pos)
+			}
+		}
+		if len(u.queuedAddrSeqs[idx]) != numAddrs {
+			t.Errorf("Expected %d indexed updates for interface %d, got %v", numAddrs, idx, u.queuedAddrSeqs[idx])
+		}
+	}
+
+	for i := byte(1); i <= 3; i++ {
+		u.FilterOne(start, routeUpd(unix.RTM_DELROUTE, 2, i))
+	}
+	expectIndexed(2)
+
+	// Re-adding the middle address squashes its deletion out of the middle of the queue.
+	u.FilterOne(start, routeUpd(unix.RTM_NEWROUTE, 2, 2))
+	expectIndexed(2)
+	if n := len(u.updatesByIfaceIdx[2]); n != 3 {
+		t.Errorf("Expected 3 updates to be queued, got %d", n)
+	}
+
+	// A second interface takes the filter over the tracking limit so its update is passed through.
+	if emit, _ := u.FilterOne(start, routeUpd(unix.RTM_DELROUTE, 3, 1)); len(emit) != 1 {
+		t.Errorf("Expected untracked interface's update to be passed through, got %v", emit)
+	}
+	if seqs, ok := u.queuedAddrSeqs[3]; ok {
+		t.Errorf("Expected untracked interface to have nothing indexed, got %v", seqs)
+	}
+
+	u.drainReady(start.Add(time.Second))
+	if len(u.queuedAddrSeqs) != 0 {
+		t.Errorf("Expected index to be empty once the queue has drained, got %v", u.queuedAddrSeqs)
+	}
+}
+
+func TestQueueTotalsFollowQueue(t *testing.T) {
+	u := NewUpdateFilter()
+	start := time.Now()
+	routeUpd := func(idx int, i byte) netlink.RouteUpdate {
+		return netlink.RouteUpdate{
+			Type: unix.RTM_DELROUTE,
+			Route: netlink.Route{
+				LinkIndex: idx,
+				Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, i).To4(), Mask: net.CIDRMask(32, 32)},
+				Type:      unix.RTN_LOCAL,
+			},
+		}
+	}
+	expectQueued := func(depths map[int]int) {
+		t.Helper()
+		total := 0
+		idxs := []int{}
+		for idx := 1; idx <= 3; idx++ {
+			if depths[idx] > 0 {
+				idxs = append(idxs, idx)
+				total += depths[idx]
+			}
+		}
+		if u.numQueued != total {
+			t.Errorf("Expected %d queued updates, got %d", total, u.numQueued)
+		}
+		if !reflect.DeepEqual(append([]int{}, u.queuedIdxs...), idxs) {
+			t.Errorf("Expected interfaces %v to be queued, got %v", idxs, u.queuedIdxs)
+		}
+		if snap := u.QueueSnapshot(); !reflect.DeepEqual(snap, depths) {
+			t.Errorf("Expected snapshot %v, got %v", depths, snap)
+		}
+		pending := u.PendingCIDRs()
+		for idx, depth := range depths {
+			if len(pending[idx]) != depth {
+				t.Errorf("Expected %d pending CIDRs for interface %d, got %v", depth, idx, pending[idx])
+			}
+		}
+	}
+
+	u.FilterOne(start, routeUpd(3, 1))
+	u.FilterOne(start, routeUpd(1, 1))
+	u.FilterOne(start, routeUpd(3, 2))
+	expectQueued(map[int]int{1: 1, 3: 2})
+
+	u.drainReady(start.Add(time.Second))
+	u.publishSnapshot(start.Add(time.Second))
+	expectQueued(map[int]int{})
+}
+
+func TestIngressUpdatesCounted(t *testing.T) {
+	for _, damping := range []bool{true, false} {
+		t.Run(fmt.Sprintf("damping=%v", damping), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			u := NewUpdateFilter(WithDampingEnabled(damping))
+			routeInC := make(chan netlink.RouteUpdate, 10)
+			linkInC := make(chan netlink.LinkUpdate, 10)
+			routeOutC := make(chan netlink.RouteUpdate, 10)
+			linkOutC := make(chan netlink.LinkUpdate, 10)
+			before := readIngressUpdates(t)
+			go func() {
+				_ = u.FilterUpdates(ctx, routeOutC, routeInC, linkOutC, linkInC)
+			}()
+
+			routeAdd := netlink.RouteUpdate{
+				Type: unix.RTM_NEWROUTE,
+				Route: netlink.Route{
+					LinkIndex: 2,
+					Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+					Type:      unix.RTN_LOCAL,
+				},
+			}
+			routeDel := routeAdd
+			routeDel.Type = unix.RTM_DELROUTE
+			routeDel.LinkIndex = 3
+			linkUpd := netlink.LinkUpdate{Link: &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: 4}}}
+			linkUpd.Index = 4
+			linkUpd.Header.Type = unix.RTM_NEWLINK
+			linkUpd.Flags = unix.IFF_UP | unix.IFF_RUNNING
+
+			// The delete may be damped so send it first; once the add comes out, both have been read.
+			routeInC <- routeDel
+			routeInC <- routeAdd
+			linkInC <- linkUpd
+			timeout := time.After(5 * time.Second)
+			for sawAdd, sawLink := false, false; !sawAdd || !sawLink; {
+				select {
+				case upd := <-routeOutC:
+					sawAdd = sawAdd || upd.Type == unix.RTM_NEWROUTE
+				case <-linkOutC:
+					sawLink = true
+				case <-timeout:
+					t.Fatal("Timed out waiting for updates to be forwarded")
+				}
+			}
+
+			after := readIngressUpdates(t)
+			for _, typ := range []string{updateTypeAddrAdd, updateTypeAddrDel, updateTypeLink} {
+				if n := after[typ] - before[typ]; n != 1 {
+					t.Errorf("Expected one %s update to be counted, got %v", typ, n)
+				}
+			}
+		})
+	}
+}
+
+func readIngressUpdates(t *testing.T) map[string]float64 {
+	counts := map[string]float64{}
+	for _, typ := range []string{updateTypeAddrAdd, updateTypeAddrDel, updateTypeLink} {
+		var m dto.Metric
+		if err := countIngressUpdates.WithLabelValues(typ).Write(&m); err != nil {
+			t.Fatalf("Failed to read counter: %v", err)
+		}
+		counts[typ] = m.GetCounter().GetValue()
+	}
+	return counts
+}
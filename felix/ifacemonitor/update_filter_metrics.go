@@ -0,0 +1,183 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	updateTypeAddr    = "addr"
+	updateTypeAddrAdd = "addr_add"
+	updateTypeAddrDel = "addr_del"
+	updateTypeLink    = "link"
+)
+
+var (
+	countFlapsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_flaps_suppressed_total",
+		Help: "Number of queued interface updates that were squashed by a later update for the same object.",
+	}, []string{"type"})
+	countUpdatesDelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_updates_delayed_total",
+		Help: "Number of interface updates that were held back to damp a potential flap.",
+	}, []string{"type"})
+	countQueueOverflows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_queue_overflow_total",
+		Help: "Number of queued interface updates that were sent early because the per-interface queue was full.",
+	})
+	gaugeOldestPendingUpdate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_ifacemonitor_oldest_pending_update_seconds",
+		Help: "Time since the most overdue queued interface update became ready to send.",
+	})
+	countSourceErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_source_errors_total",
+		Help: "Number of errors reported by the source of interface updates.",
+	})
+	countDoubleDeletes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_double_deletes_total",
+		Help: "Number of address deletions that arrived while a deletion of the same address was still queued.",
+	})
+	histQueueLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "felix_ifacemonitor_update_queue_latency_seconds",
+		Help: "Time that queued interface updates spent in the queue before being sent.",
+		// Centred on the default FlapDampingDelay of 100ms.
+		Buckets: []float64{0.01, 0.025, 0.05, 0.075, 0.1, 0.125, 0.15, 0.2, 0.3, 0.5, 1, 2.5, 5, 10},
+	})
+	countDampedDeletesUseful = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_delete_damped_useful_total",
+		Help: "Number of delayed address deletions that were suppressed because the address was re-added.",
+	})
+	countDampedDeletesWasted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_delete_damped_wasted_total",
+		Help: "Number of delayed address deletions that were sent anyway because the address didn't come back.",
+	})
+	countUnknownUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_unknown_updates_dropped_total",
+		Help: "Number of updates of an unregistered type that the filter dropped.",
+	})
+	countIngressUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_ingress_updates_total",
+		Help: "Number of interface updates received by the filter, before any filtering.",
+	}, []string{"type"})
+	countUntrackedIfaces = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_untracked_interfaces_total",
+		Help: "Number of interfaces whose updates were passed through without damping because the filter was already tracking its maximum number of interfaces.",
+	})
+	countBufferOverflowDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ifacemonitor_buffer_overflow_drops_total",
+		Help: "Number of updates dropped from a buffered filter's output buffer because the buffer was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countFlapsSuppressed, countUpdatesDelayed, countQueueOverflows,
+		gaugeOldestPendingUpdate, countSourceErrors, countDoubleDeletes, histQueueLatency,
+		countUnknownUpdates, countDampedDeletesUseful, countDampedDeletesWasted, countIngressUpdates,
+		countUntrackedIfaces, countBufferOverflowDrops)
+}
+
+// FilterStats contains counters describing the filter's activity since it was created.
+type FilterStats struct {
+	// SuppressedFlaps is the number of queued updates that were squashed by a later update.
+	SuppressedFlaps uint64
+	// DelayedUpdates is the number of updates that were queued to damp a potential flap.
+	DelayedUpdates uint64
+	// ForwardedUpdates is the number of updates that FilterUpdates sent downstream.
+	ForwardedUpdates uint64
+	// CurrentQueuedUpdates is the number of updates that are currently queued.
+	CurrentQueuedUpdates uint64
+	// DoubleDeletes is the number of address deletions that arrived while a deletion of the same
+	// address was still queued, with no add in between.
+	DoubleDeletes uint64
+	// DampedDeletesUseful is the number of delayed address deletions that were suppressed because
+	// the address was re-added.
+	DampedDeletesUseful uint64
+	// DampedDeletesWasted is the number of delayed address deletions that were sent anyway because
+	// the address didn't come back; the damping only added latency.
+	DampedDeletesWasted uint64
+	// CircuitBreakerOpen is true while the WithCircuitBreaker circuit breaker has disabled damping.
+	CircuitBreakerOpen bool
+}
+
+// filterStats holds the counters behind FilterStats.  The filter's goroutine updates them and Stats
+// reads them from any goroutine.
+type filterStats struct {
+	suppressedFlaps      atomic.Uint64
+	delayedUpdates       atomic.Uint64
+	forwardedUpdates     atomic.Uint64
+	currentQueuedUpdates atomic.Uint64
+	doubleDeletes        atomic.Uint64
+	dampedDeletesUseful  atomic.Uint64
+	dampedDeletesWasted  atomic.Uint64
+	circuitBreakerOpen   atomic.Bool
+}
+
+// Stats returns the filter's counters.  It is safe to call from any goroutine.
+func (u *UpdateFilter) Stats() FilterStats {
+	return FilterStats{
+		SuppressedFlaps:      u.stats.suppressedFlaps.Load(),
+		DelayedUpdates:       u.stats.delayedUpdates.Load(),
+		ForwardedUpdates:     u.stats.forwardedUpdates.Load(),
+		CurrentQueuedUpdates: u.stats.currentQueuedUpdates.Load(),
+		DoubleDeletes:        u.stats.doubleDeletes.Load(),
+		DampedDeletesUseful:  u.stats.dampedDeletesUseful.Load(),
+		DampedDeletesWasted:  u.stats.dampedDeletesWasted.Load(),
+		CircuitBreakerOpen:   u.stats.circuitBreakerOpen.Load(),
+	}
+}
+
+// updateOldestPendingGauge records how long the most overdue queued update has been ready to send.
+// Updates should be sent as soon as they're ready so a persistently non-zero value suggests that the
+// timer isn't firing.  The next wake time is the time that the earliest queued update becomes ready,
+// so there's no need to examine the queue.
+func (u *UpdateFilter) updateOldestPendingGauge(now time.Time) {
+	age := time.Duration(0)
+	if !u.nextWake.IsZero() && now.After(u.nextWake) {
+		age = now.Sub(u.nextWake)
+	}
+	gaugeOldestPendingUpdate.Set(age.Seconds())
+}
+
+func countUpdateTypes(upds []interface{}) (numRoutes, numLinks int) {
+	for _, upd := range upds {
+		switch upd.(type) {
+		case netlink.RouteUpdate:
+			numRoutes++
+		case netlink.LinkUpdate:
+			numLinks++
+		}
+	}
+	return
+}
+
+// countIngress counts an update that arrived on one of FilterUpdates' inputs, before any filtering.
+func countIngress(upd interface{}) {
+	switch upd := upd.(type) {
+	case netlink.LinkUpdate:
+		countIngressUpdates.WithLabelValues(updateTypeLink).Inc()
+	case netlink.RouteUpdate:
+		if upd.Type == unix.RTM_NEWROUTE {
+			countIngressUpdates.WithLabelValues(updateTypeAddrAdd).Inc()
+		} else {
+			countIngressUpdates.WithLabelValues(updateTypeAddrDel).Inc()
+		}
+	}
+}
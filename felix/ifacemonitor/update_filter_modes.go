@@ -0,0 +1,102 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// InterfaceMode controls how the filter treats an interface's updates; see SetInterfaceMode.
+type InterfaceMode string
+
+const (
+	// InterfaceModeDamped is the default mode: the interface's updates are damped as normal.
+	InterfaceModeDamped InterfaceMode = "damped"
+	// InterfaceModePassThrough sends the interface's updates straight downstream without damping.
+	InterfaceModePassThrough InterfaceMode = "pass-through"
+	// InterfaceModeDropped drops the interface's updates.
+	InterfaceModeDropped InterfaceMode = "dropped"
+)
+
+// ifaceModeReq is passed to processUpdate to change an interface's mode.
+type ifaceModeReq struct {
+	idx  int
+	mode InterfaceMode
+}
+
+// SetInterfaceMode changes how the filter treats the given interface's updates at runtime, for
+// example to stop damping an interface that is being debugged.  The mode applies to updates that
+// the filter processes after the request; updates that are already queued for the interface are
+// unaffected and are sent when they're ready, so pass-through updates may overtake them.  Interface
+// deletions are always processed as normal and the interface's mode is forgotten when it is
+// deleted.  Modes have no effect if damping is disabled.
+//
+// SetInterfaceMode is safe to call from any goroutine.  It returns an error, and leaves the
+// interface's mode unchanged, if the mode is unknown.  If the filter is not keeping up with
+// requests, the request may be dropped; ModeForInterface shows when the change has taken effect.
+func (u *UpdateFilter) SetInterfaceMode(idx int, mode InterfaceMode) error {
+	switch mode {
+	case InterfaceModeDamped, InterfaceModePassThrough, InterfaceModeDropped:
+	default:
+		return fmt.Errorf("unknown interface mode %q", mode)
+	}
+	select {
+	case u.ifaceModeC <- ifaceModeReq{idx: idx, mode: mode}:
+	default:
+		u.logCtx.WithField("ifaceIdx", idx).Warn(
+			"FilterUpdates: too many pending interface mode requests, ignoring request.")
+	}
+	return nil
+}
+
+// ModeForInterface returns the mode of the given interface, as set by SetInterfaceMode.  It is safe
+// to call from any goroutine.
+func (u *UpdateFilter) ModeForInterface(idx int) InterfaceMode {
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	if mode, ok := u.ifaceModes[idx]; ok {
+		return mode
+	}
+	return InterfaceModeDamped
+}
+
+// onIfaceModeReq applies a request from SetInterfaceMode.
+func (u *UpdateFilter) onIfaceModeReq(req ifaceModeReq) {
+	u.ifaceLogCtx(req.idx).WithField("mode", req.mode).Info("FilterUpdates: changing interface mode.")
+	u.snapshotLock.Lock()
+	defer u.snapshotLock.Unlock()
+	if req.mode == InterfaceModeDamped {
+		delete(u.ifaceModes, req.idx)
+		return
+	}
+	u.ifaceModes[req.idx] = req.mode
+}
+
+// applyIfaceMode deals with an update for an interface whose mode isn't InterfaceModeDamped,
+// returning true if it has done so.
+func (u *UpdateFilter) applyIfaceMode(idx int, upd interface{}, emit []interface{}) ([]interface{}, bool) {
+	switch u.ifaceModes[idx] {
+	case InterfaceModeDropped:
+		return emit, true
+	case InterfaceModePassThrough:
+		if routeUpd, ok := upd.(netlink.RouteUpdate); ok && !u.shouldProcessRouteUpdate(routeUpd) {
+			return emit, true
+		}
+		return append(emit, upd), true
+	}
+	return emit, false
+}
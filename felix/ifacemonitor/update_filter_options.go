@@ -0,0 +1,810 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sys/unix"
+
+	"github.com/projectcalico/calico/felix/timeshim"
+)
+
+// delayOptions holds the options that control how long updates are held back.
+type delayOptions struct {
+	dampingDelay        time.Duration
+	perInterfaceDelay   func(ifaceName string) time.Duration
+	linkDelay           time.Duration
+	linkFlapDamping     time.Duration
+	familyDelays        map[int]time.Duration
+	addrDelay           time.Duration
+	addDelay            time.Duration
+	maxDeferral         time.Duration
+	minEmitInterval     time.Duration
+	secondaryDelay      time.Duration
+	adaptiveMinDelay    time.Duration
+	adaptiveMaxDelay    time.Duration
+	timerJitter         time.Duration
+	minRetryDelay       time.Duration
+	microCoalesceWindow time.Duration
+	startupGracePeriod  time.Duration
+}
+
+// addrOptions holds the options that control how address updates are matched up and which of
+// them are ignored.
+type addrOptions struct {
+	coalesceKey         func(netlink.RouteUpdate) string
+	coalescePolicy      CoalescePolicy
+	coalesceIgnoresMask bool
+	collapseReAdds      bool
+	sequenceFunc        func(netlink.RouteUpdate) (uint64, bool)
+	secondaryFunc       func(netlink.RouteUpdate) bool
+	ignoreSecondary     bool
+	tentativeFunc       func(netlink.RouteUpdate) bool
+	suppressTentative   bool
+	ignoredScopes       []netlink.Scope
+	ignoreLifetimeOnly  bool
+}
+
+// ifaceOptions holds the options that control which interfaces are filtered and how their link
+// updates are handled.
+type ifaceOptions struct {
+	suppressDownIfaces    bool
+	ifaceNameTTL          time.Duration
+	bypassIface           func(ifaceName string) bool
+	allowIface            func(ifaceName string) bool
+	ifaceGroup            func(ifaceName string) string
+	linkFlagMask          uint32
+	deletesOnIfaceRemoval bool
+	maxTrackedIfaces      int
+}
+
+// deliveryOptions holds the options that control sending updates downstream, including on shutdown.
+type deliveryOptions struct {
+	sendTimeout            time.Duration
+	requeueOnSendTimeout   bool
+	maxQueueDepth          int
+	flushOnShutdown        bool
+	flushDeletesOnShutdown bool
+	shutdownTimeout        time.Duration
+}
+
+// stormOptions holds the options for flap storm detection and the circuit breaker.
+type stormOptions struct {
+	flapStormThreshold int
+	flapStormWindow    time.Duration
+	breakerMaxRate     float64
+	breakerWindow      time.Duration
+}
+
+// notifyOptions holds the callbacks, channels and logging options that report on the filter's
+// decisions.
+type notifyOptions struct {
+	flapCallback         FlapCallback
+	settledCallback      func(idx int)
+	flapStormCallback    FlapStormCallback
+	sourceErrorCallback  SourceErrorCallback
+	debugEventC          chan<- SuppressionEvent
+	macChangeC           chan<- MACChangedEvent
+	recorder             *updateRecorder
+	passSummaryLogging   bool
+	netlinkHeaderLogging bool
+}
+
+type UpdateFilterOp func(filter *UpdateFilter)
+
+func WithTimeShim(t timeshim.Interface) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.time = t
+	}
+}
+
+// WithDampingEnabled allows flap damping to be disabled, in which case FilterUpdates passes updates
+// straight through without queueing them.  Damping is enabled by default.
+func WithDampingEnabled(enabled bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.dampingEnabled = enabled
+	}
+}
+
+// WithFlapDampingDelay overrides the default FlapDampingDelay.  Negative values are clamped to zero.
+func WithFlapDampingDelay(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.dampingDelay = d
+	}
+}
+
+// WithPerInterfaceDelay allows the damping delay to be chosen per interface.  The callback is passed
+// the interface name; if it returns zero, or the name of the interface is not yet known, the global
+// damping delay is used.
+func WithPerInterfaceDelay(f func(ifaceName string) time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.perInterfaceDelay = f
+	}
+}
+
+// WithLinkDelay sets the damping delay for link down updates, in place of the flap damping delay.
+// A link going down is less likely to be a flap than an address being removed so it may warrant a
+// shorter delay.  Adaptive damping and WithPerInterfaceDelay still take precedence.  Zero (or a
+// negative value) means use the flap damping delay.
+func WithLinkDelay(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.linkDelay = d
+	}
+}
+
+// WithLinkFlapDamping damps link bounces independently of address flaps.  A link down update is held
+// for d, in place of the other damping delays.  If the link comes back up within d and downstream
+// last saw the link up, the queued down and the up are both dropped so downstream never sees the
+// bounce.  Otherwise, link updates are coalesced as normal.
+func WithLinkFlapDamping(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.linkFlapDamping = d
+	}
+}
+
+// WithInterfaceSettledCallback registers a callback that is invoked (synchronously) when an
+// interface's queue drains because its last queued update has been sent.  FilterUpdates calls it
+// after sending the updates downstream; FilterOne calls it before returning the updates.  Panics
+// from the callback are recovered and logged.
+func WithInterfaceSettledCallback(f func(idx int)) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.settledCallback = f
+	}
+}
+
+// WithAddrDelay sets the damping delay for address deletions, in place of the flap damping delay.
+// Adaptive damping and WithPerInterfaceDelay still take precedence.  Zero (or a negative value)
+// means use the flap damping delay.
+func WithAddrDelay(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.addrDelay = d
+	}
+}
+
+// WithFamilyDelay sets the damping delay for deletions of addresses in the given family (unix.AF_INET
+// or unix.AF_INET6), in place of the flap damping delay and WithAddrDelay.  For example, IPv6
+// addresses that churn with router advertisements may warrant a longer delay than IPv4 addresses
+// from DHCP.  The two families are already damped independently so each follows its own schedule.
+// Adaptive damping and WithPerInterfaceDelay still take precedence.  Zero (or a negative value)
+// means use the other delays.
+func WithFamilyDelay(family int, d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		if filter.delays.familyDelays == nil {
+			filter.delays.familyDelays = map[int]time.Duration{}
+		}
+		filter.delays.familyDelays[family] = d
+	}
+}
+
+// WithAdaptiveDamping makes the damping delay for each interface adapt to the flaps that the filter
+// observes on it.  The filter maintains a moving average of the time between each address being
+// deleted and re-added and uses a delay a little longer than that, clamped to [min, max].  Deletions
+// that aren't followed by a re-add within max count as a zero down-time, so the delay shrinks
+// towards min if flaps are rare.  Interfaces with no history use the static damping delay.  A
+// delay returned by WithPerInterfaceDelay takes precedence.
+func WithAdaptiveDamping(min, max time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.adaptiveMinDelay = min
+		filter.delays.adaptiveMaxDelay = max
+	}
+}
+
+// WithDelayAdds makes the filter delay address additions as well as deletions.  By default, adds are
+// only queued if there's already a pending update for the interface.  When an add arrives just before
+// the deletion of the address that it replaces, delaying the add allows the pair to be queued, and
+// sent, together.
+func WithDelayAdds(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.addDelay = d
+	}
+}
+
+// WithIgnoreLifetimeOnlyChanges makes the filter drop address adds that repeat an add that it has
+// already seen, without an intervening delete.  DHCP renewals, for example, re-add the same address
+// with updated lifetimes; the lifetime isn't included in the updates that we receive so such an
+// update is identical to the previous add and is a no-op for routing.
+func WithIgnoreLifetimeOnlyChanges() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.ignoreLifetimeOnly = true
+	}
+}
+
+// WithMaxDeferral caps the time that any update may spend in the queue.  Once an update has been
+// queued for longer than d, it is sent even if it isn't ready or is held up by an earlier update.
+// A value of 0 (the default) means no cap.
+func WithMaxDeferral(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.maxDeferral = d
+	}
+}
+
+// WithCoalesceKey replaces the function used to decide whether two address updates refer to the same
+// address.  Queued updates with the same key as a new update are squashed.  By default, updates are
+// keyed on their exact CIDR; a function that returns the /64 prefix, for example, would coalesce
+// flaps between different IPv6 addresses in the same subnet.
+func WithCoalesceKey(f func(netlink.RouteUpdate) string) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.coalesceKey = f
+		filter.addrs.coalesceIgnoresMask = false
+	}
+}
+
+// WithCoalesceSameIPDifferentMask makes the filter treat updates for the same IP with different
+// prefix lengths as updates for the same address.  Some platforms change an address's netmask by
+// deleting the old CIDR and adding the new one; with this option, the add squashes the queued delete
+// so that downstream sees a single add with the new mask rather than a gap in which the IP is
+// missing.  It replaces any function set by WithCoalesceKey.
+func WithCoalesceSameIPDifferentMask() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.coalesceKey = sameIPCoalesceKey
+		filter.addrs.coalesceIgnoresMask = true
+	}
+}
+
+// WithSequenceFunc supplies a function that extracts a sequence number from an address update.  If
+// the function returns ok, the filter discards any update that is older than an update that it has
+// already seen for the same address, protecting against netlink messages being delivered out of
+// order.  netlink.RouteUpdate doesn't carry the sequence number of the underlying netlink message so
+// there is no such protection by default.
+func WithSequenceFunc(f func(netlink.RouteUpdate) (seq uint64, ok bool)) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.sequenceFunc = f
+	}
+}
+
+// WithSecondaryAddrFunc supplies a function that reports whether an address update is for a
+// secondary address (one with the IFA_F_SECONDARY flag).  The filter works on the local routes of
+// addresses, which don't carry the address flags, so there is no way for it to tell by itself; the
+// function might consult a cache of the interface's addresses, for example.  It is required by
+// WithIgnoreSecondary and WithSeparateSecondaryDelay.
+func WithSecondaryAddrFunc(f func(netlink.RouteUpdate) bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.secondaryFunc = f
+	}
+}
+
+// WithIgnoreSecondary makes the filter drop updates for secondary addresses, as identified by the
+// WithSecondaryAddrFunc function.
+func WithIgnoreSecondary(ignore bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.ignoreSecondary = ignore
+	}
+}
+
+// WithSeparateSecondaryDelay sets the damping delay for deletions of secondary addresses, as
+// identified by the WithSecondaryAddrFunc function, in place of the other delays for addresses.
+// Adaptive damping and WithPerInterfaceDelay still take precedence.  Zero (or a negative value)
+// means damp secondary addresses like primaries.
+func WithSeparateSecondaryDelay(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.secondaryDelay = d
+	}
+}
+
+// WithTentativeAddrFunc supplies a function that reports whether an address update is for an IPv6
+// address that is still undergoing duplicate address detection (one with the IFA_F_TENTATIVE flag).
+// As with WithSecondaryAddrFunc, the filter can't tell by itself.  The kernel only installs the local
+// route for an address once DAD has finished, so this is only needed when the updates come from
+// another source, such as address events passed through AdaptAddrEvents.  It is required by
+// WithSuppressTentative.
+func WithTentativeAddrFunc(f func(netlink.RouteUpdate) bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.tentativeFunc = f
+	}
+}
+
+// WithSuppressTentative makes the filter drop additions of tentative addresses, as identified by the
+// WithTentativeAddrFunc function.  The addition is forwarded once the address is no longer tentative
+// and its add is seen again.  This avoids programming an address that fails DAD and is removed
+// moments later.  Deletions are forwarded (or damped) as usual.
+func WithSuppressTentative(suppress bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.suppressTentative = suppress
+	}
+}
+
+// WithMinEmitInterval rate limits the release of queued updates so that they're sent at least d
+// apart.  When many updates become ready at once, for example when a flap storm resolves, the
+// remainder are released on later timer pops rather than all at once.  Updates that bypass the queue
+// aren't limited and the WithMaxDeferral cap takes precedence.
+func WithMinEmitInterval(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.minEmitInterval = d
+	}
+}
+
+// WithHeartbeatInterval makes the filter goroutine wake up at least every d, even if it has nothing
+// to do, so that LastActive() keeps advancing while the filter is idle.  Without it, LastActive()
+// only advances when the filter handles an update or a timer pop.
+func WithHeartbeatInterval(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.heartbeat.interval = d
+	}
+}
+
+// DefaultLinkFlagMask is the mask of interface flags that WithLinkFlagFilter uses if it is given a
+// mask of zero: whether the interface is administratively up and whether its carrier is up.
+const DefaultLinkFlagMask = unix.IFF_UP | unix.IFF_LOWER_UP
+
+// WithLinkFlagFilter makes the filter drop link updates that don't change any of the interface
+// flags (IFF_*) in mask, compared with the previous link update for the same interface.  For
+// example, it drops updates that only toggle IFF_RUNNING.  A mask of zero selects
+// DefaultLinkFlagMask.  The first update for each interface, updates that change its name, and
+// deletions are always sent.
+//
+// Take care when choosing the mask: LinkIsOperUp, which InterfaceMonitor uses to decide whether an
+// interface is up, reads IFF_RUNNING, and DefaultLinkFlagMask doesn't include it.  With the default
+// mask, a consumer that relies on LinkIsOperUp can miss an interface going operationally up or
+// down.  Such consumers should include IFF_RUNNING in the mask.
+func WithLinkFlagFilter(mask uint32) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		if mask == 0 {
+			mask = DefaultLinkFlagMask
+		}
+		filter.ifaces.linkFlagMask = mask
+	}
+}
+
+// WithDeletesOnInterfaceRemoval makes the filter send address deletions when an interface is
+// deleted.  Normally, the interface's queued updates are discarded and only the link deletion is
+// sent, leaving downstream to infer that the addresses have gone.  With this option, the link
+// deletion is preceded by the interface's queued address deletions, without waiting for their
+// damping delays since the addresses can't come back, and by a deletion for each of the other
+// addresses that downstream believes are present (see AddressesForInterface).
+func WithDeletesOnInterfaceRemoval() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.ifaces.deletesOnIfaceRemoval = true
+	}
+}
+
+// WithCollapseReAdds makes the filter collapse an add→del→add sequence for the same address into
+// the first add.  Normally, the first add is sent straight away and the re-add, which squashes the
+// queued deletion, is sent too, so downstream sees the address added twice.  With this option, if
+// the filter has already sent an add for the address, the re-add is dropped along with the
+// deletion; downstream sees a single add and the address stays present throughout.
+func WithCollapseReAdds() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.collapseReAdds = true
+	}
+}
+
+// CoalescePolicy controls how the filter resolves an address update that arrives while an update
+// of the opposite type (add vs. deletion) for the same address is still queued.
+type CoalescePolicy string
+
+const (
+	// CoalesceAddWins is the default policy: the newer update squashes the queued one and is queued
+	// afresh.  A quick del→add is sent as just the add, without waiting for the deletion's delay.
+	CoalesceAddWins CoalescePolicy = "add-wins"
+	// CoalesceDeleteWins is as CoalesceAddWins except that an add doesn't squash a queued deletion;
+	// instead, the add is dropped and the deletion is sent as scheduled.  Downstream then treats the
+	// address as removed until the next update for it.
+	CoalesceDeleteWins CoalescePolicy = "delete-wins"
+	// CoalesceNewest makes the newer update take the place of the queued one, keeping its position
+	// in the queue and the time at which it was due to be sent.
+	CoalesceNewest CoalescePolicy = "newest"
+)
+
+// WithCoalescePolicy sets how the filter resolves an add and a deletion for the same address that
+// are queued together.  The default is CoalesceAddWins.
+func WithCoalescePolicy(p CoalescePolicy) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.coalescePolicy = p
+	}
+}
+
+// WithTypedOutput registers a type of update, other than the address and link updates, for the filter
+// to pass through without damping.  example is a value of the type; FilterUpdates sends updates of
+// that type to outC, subject to the send timeout, and closes outC when it returns.  The same channel
+// may be registered for several types.  Updates of types that aren't registered are logged, counted
+// and dropped.  Typed outputs are only supported by UpdateFilter.FilterUpdates; the variants
+// refuse to run with them.
+func WithTypedOutput(example interface{}, outC chan<- interface{}) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		if filter.outputs.typed == nil {
+			filter.outputs.typed = map[reflect.Type]chan<- interface{}{}
+		}
+		filter.outputs.typed[reflect.TypeOf(example)] = outC
+	}
+}
+
+// WithPassSummaryLogging makes the filter log one line at Info level each time it processes its queue
+// because the timer popped.  The line has the fields:
+//   - numEmitted: the number of updates that the pass sent.
+//   - numQueued: the number of updates still queued.
+//   - numIfacesTouched: the number of interfaces that the sent updates applied to.
+//   - nextWake: when the queue will next be processed, or the zero time if it is empty.
+//
+// This is much less noisy than the per-update Debug logs.
+func WithPassSummaryLogging(enabled bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.passSummaryLogging = enabled
+	}
+}
+
+// WithFreezeChan gives FilterUpdates a channel on which the consumer can freeze and thaw the filter,
+// as an alternative to calling Pause and Resume from another goroutine.  Receiving true freezes the
+// filter and receiving false thaws it.  While frozen, the filter behaves as if paused: it keeps
+// reading and queueing updates but holds on to the updates that it would have sent until it is
+// thawed.  The filter only sends updates while it is neither paused nor frozen.  Closing the channel
+// thaws the filter for good.
+func WithFreezeChan(freezeC <-chan bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.freezeC = freezeC
+	}
+}
+
+// WithInitialDumpCount makes the filter treat the first n address updates that it receives as the
+// initial dump of the kernel's addresses, which the netlink subscription delivers when it starts.
+// During this priming phase, address updates aren't damped: each is sent straight away, along with
+// anything that was already queued for its interface.  Otherwise, a deletion that races with the
+// dump could hold back the dump's adds for the same interface.  Priming ends after n address updates
+// or when StartupComplete is called, whichever comes first.  Link updates are filtered as normal.
+func WithInitialDumpCount(n int) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.initialDumpCount = n
+	}
+}
+
+// WithHeartbeat makes FilterUpdates send a heartbeat on the link output channel whenever it hasn't
+// sent anything downstream for d, so that a consumer can tell an idle filter from a dead one.  A
+// heartbeat is a netlink.LinkUpdate whose Link is a *HeartbeatLink; consumers that aren't
+// interested should check IsHeartbeat (or type-switch on the Link) and ignore it.  Heartbeats aren't
+// counted in the filter's stats.  Unlike WithHeartbeatInterval, which only keeps LastActive()
+// advancing, this option is visible downstream.
+func WithHeartbeat(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.heartbeat.idleInterval = d
+	}
+}
+
+// WithSuppressDownInterfaces makes the filter hold back address updates for interfaces that are
+// administratively down (i.e. whose most recent link update had IFF_UP clear).  When the interface
+// comes back up, the filter replays the latest update for each address that changed while it was
+// down, so that downstream catches up with the interface's current addresses.
+func WithSuppressDownInterfaces(suppress bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.ifaces.suppressDownIfaces = suppress
+	}
+}
+
+// WithInterfaceNameTTL limits the lifetime of the filter's cache of interface names, which it uses
+// for logging and for WithPerInterfaceDelay.  Names of interfaces that the filter hasn't seen an
+// update for in ttl are evicted, unless the interface has queued updates.  Eviction is checked as
+// the filter processes updates and timer pops so an entry may outlive its TTL by up to another TTL.
+// By default, names are only evicted when the interface is deleted.
+func WithInterfaceNameTTL(ttl time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.ifaces.ifaceNameTTL = ttl
+	}
+}
+
+// WithBypassInterfaces exempts interfaces from damping.  The callback is passed each interface's
+// name, taken from its link updates; updates for interfaces that it returns true for are sent
+// straight downstream without being queued, even if other interfaces have updates queued.  This
+// suits interfaces whose addresses are static, such as a host's main interface.  Until the filter
+// has seen a link update for an interface, its updates are damped as normal.
+func WithBypassInterfaces(f func(ifaceName string) bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.ifaces.bypassIface = f
+	}
+}
+
+// WithMaxTrackedInterfaces limits the number of interfaces that the filter queues updates for, as a
+// safety valve against a runaway process creating many transient interfaces.  Once updates for n
+// interfaces are queued, an update that would start a queue for a further interface switches that
+// interface to pass-through: its updates are sent straight downstream, as for WithBypassInterfaces,
+// until the interface is deleted or the queue drops back below n interfaces.  Each switch is logged
+// and counted.  Zero means no limit.
+func WithMaxTrackedInterfaces(n int) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.ifaces.maxTrackedIfaces = n
+	}
+}
+
+// WithInterfaceAllowlist makes the filter drop updates for interfaces that the callback returns
+// false for, before they reach the queue.  The callback is passed each interface's name, taken from
+// its link updates.  Until the filter has seen a link update for an interface, its updates are
+// processed as normal.  Interface deletions are always forwarded.
+func WithInterfaceAllowlist(f func(ifaceName string) bool) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.ifaces.allowIface = f
+	}
+}
+
+// WithInterfaceGrouping makes the filter damp related interfaces, such as the two ends of a veth
+// pair, together.  The callback maps each interface's name, taken from its link updates, to a
+// group key.  While any interface in a group has an update that isn't ready to send, the ready
+// updates of the other interfaces in the group are held back, so that the group's updates are
+// sent together, and updates don't skip the queue while another interface in the group has
+// updates queued.  FlushInterface flushes the whole group.  Interfaces that the callback returns
+// "" for, and interfaces whose names the filter hasn't seen yet, are damped on their own, as they
+// are by default.
+func WithInterfaceGrouping(f func(ifaceName string) string) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.ifaces.ifaceGroup = f
+	}
+}
+
+// WithCircuitBreaker makes the filter stop damping while it is overloaded.  If the average rate of
+// link and address updates over a window exceeds maxRate updates per second, the circuit breaker
+// trips: the filter sends everything that it has queued and then passes updates straight through,
+// as if damping were disabled.  Only queueing is disabled: updates that the filter would drop anyway
+// (for example, those of interfaces excluded by WithInterfaceAllowlist) are still dropped, and
+// aren't counted towards the rate.  Once the rate over a later window drops to maxRate or below,
+// damping resumes.  Since the rate is measured as updates arrive, the breaker stays open until the
+// first update after the load subsides.  Stats reports whether the breaker is open.
+func WithCircuitBreaker(maxRate float64, window time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.storm.breakerMaxRate = maxRate
+		filter.storm.breakerWindow = window
+	}
+}
+
+// WithStartupGracePeriod makes the filter hold back all link and address updates for the given
+// period after FilterUpdates starts, while the interfaces are being brought up.  Updates that
+// arrive during the grace period are coalesced as normal and the final state of each address and
+// link is sent when it ends, rather than a storm of transient updates.  Interface deletions,
+// updates for bypassed interfaces and updates in the initial dump (see WithInitialDumpCount) are
+// still sent straight away.
+func WithStartupGracePeriod(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.startupGracePeriod = d
+	}
+}
+
+// WithSourceErrorCallback sets a callback that FilterUpdatesFromSource calls for each error reported
+// by its LinkAddrSource, for example to trigger recovery.  The callback is called from a goroutine
+// that is separate from the main filter goroutine.
+func WithSourceErrorCallback(f SourceErrorCallback) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.sourceErrorCallback = f
+	}
+}
+
+// WithAdditionalOutput registers an extra pair of output channels for FilterUpdates, allowing
+// several consumers to share one filter.  Each update is sent to the main output channels first and
+// then handed to a per-consumer goroutine, which buffers it until the consumer accepts it, so a
+// stalled additional consumer never holds up the main output.  Each consumer is subject to the send
+// timeout independently, but updates that an additional consumer fails to accept, or that arrive
+// while its buffer is full, are always dropped (rather than re-queued).  The channels are closed
+// when FilterUpdates returns.  Additional outputs are only supported by FilterUpdates; the variants
+// that send updates in a different form (BatchingUpdateFilter, FilterUpdatesWithGenerations and so
+// on) reject them.
+func WithAdditionalOutput(routeOutC chan<- netlink.RouteUpdate, linkOutC chan<- netlink.LinkUpdate) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.outputs.additional = append(filter.outputs.additional, &chanSink{
+			filter:    filter,
+			routeOutC: routeOutC,
+			linkOutC:  linkOutC,
+		})
+	}
+}
+
+// WithTap registers a function that is called with a copy of each update that the filter emits,
+// just before it is sent to the output channels.  Unlike the debug events, the tap sees the
+// filter's output rather than its suppressions.  The tap is called from its own goroutine, which
+// buffers updates for it; if the tap falls behind, updates are dropped rather than holding up the
+// filter, and a panic from the tap is logged and ignored.  Updates that are re-queued after a
+// send timeout are passed to the tap again when they are re-sent.
+func WithTap(tap func(upd interface{})) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.outputs.tap = tap
+	}
+}
+
+// WithFlushOnShutdown makes FilterUpdates forward any queued address and link "up" updates when its
+// context is cancelled, rather than discarding them.  Queued deletions are still discarded.  The
+// flush waits for the consumer for up to the shutdown timeout; see WithShutdownTimeout.
+func WithFlushOnShutdown() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delivery.flushOnShutdown = true
+	}
+}
+
+// WithFlushAllOnShutdown is like WithFlushOnShutdown but it also forwards queued deletions.
+func WithFlushAllOnShutdown() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delivery.flushOnShutdown = true
+		filter.delivery.flushDeletesOnShutdown = true
+	}
+}
+
+// WithShutdownTimeout bounds how long WithFlushOnShutdown waits for the consumer to accept the
+// queued updates.  The flush gives up on the remaining updates once d has elapsed, so that a
+// stalled consumer can't prevent shutdown.  The default is DefaultShutdownTimeout.  A negative d
+// makes the flush only send updates that the consumer can accept immediately.
+func WithShutdownTimeout(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delivery.shutdownTimeout = d
+	}
+}
+
+// WithForcedDrainOnStop makes StopAndDrain send queued updates straight away, without waiting for
+// their damping delays to expire.
+func WithForcedDrainOnStop() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.forceDrainOnStop = true
+	}
+}
+
+// WithMaxQueueDepth limits the number of updates that may be queued for a single interface.  If the
+// limit is exceeded, the oldest updates are sent immediately, without waiting for them to be ready.
+// A limit of 0 (the default) means no limit.
+func WithMaxQueueDepth(n int) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delivery.maxQueueDepth = n
+	}
+}
+
+// WithFlapCallback registers a callback that is invoked (synchronously) each time an address deletion
+// is suppressed because the address was re-added.  Panics from the callback are recovered and logged.
+func WithFlapCallback(f FlapCallback) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.flapCallback = f
+	}
+}
+
+// WithFlapStormThreshold configures flap storm detection: if updates for an address are squashed more
+// than n times within the given window, the filter logs a warning and calls the flap storm callback
+// (if any).  Persistent flapping is often a symptom of a real problem, such as a bad DHCP lease.  A
+// threshold of 0 disables detection.  Defaults to DefaultFlapStormThreshold and
+// DefaultFlapStormWindow.
+func WithFlapStormThreshold(n int, window time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.storm.flapStormThreshold = n
+		filter.storm.flapStormWindow = window
+	}
+}
+
+// WithFlapStormCallback registers a callback that is invoked (synchronously) when a flap storm is
+// detected.  Panics from the callback are recovered and logged.
+func WithFlapStormCallback(f FlapStormCallback) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.flapStormCallback = f
+	}
+}
+
+// WithTimerJitter adds a random extra delay of up to the given amount to each damped update.  When
+// many interfaces flap at once, this spreads out the times at which their updates are released.
+func WithTimerJitter(maxJitter time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.timerJitter = maxJitter
+	}
+}
+
+// WithRandSource sets the source of randomness used by the filter.  By default, a time-seeded source
+// is used; tests can supply a fixed seed to make the filter's behaviour reproducible.
+func WithRandSource(src rand.Source) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.rand = rand.New(src)
+	}
+}
+
+// WithIgnoredScopes makes the filter drop address updates for addresses in any of the given scopes.
+// For example, passing netlink.SCOPE_LINK ignores link-local addresses, which tend to churn as
+// interfaces come up.
+func WithIgnoredScopes(scopes ...netlink.Scope) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.addrs.ignoredScopes = scopes
+	}
+}
+
+// WithDebugEventChan makes the filter send a SuppressionEvent to the given channel each time it delays
+// or squashes an update.  Sends are non-blocking; events are dropped if the channel is full.
+func WithDebugEventChan(c chan<- SuppressionEvent) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.debugEventC = c
+	}
+}
+
+// MACChangedEvent reports that an interface's hardware address changed.
+type MACChangedEvent struct {
+	IfaceIdx  int
+	IfaceName string
+	OldMAC    net.HardwareAddr
+	NewMAC    net.HardwareAddr
+}
+
+// WithMACChangeChan makes the filter send a MACChangedEvent to the given channel when a link update
+// shows that an interface's hardware address has changed since its previous link update.  Link
+// updates are otherwise indistinguishable from one another so this allows consumers to, for example,
+// flush neighbour caches only when needed.  The event is sent when the filter receives the link
+// update, so it may precede the link update on the link output.  Sends are non-blocking; events
+// are dropped, with a warning, if the channel is full.
+func WithMACChangeChan(c chan<- MACChangedEvent) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.macChangeC = c
+	}
+}
+
+// WithSendTimeout limits the time that FilterUpdates will wait to send an update downstream.  If the
+// timeout expires, the update is dropped (or re-queued, if WithRequeueOnSendTimeout is also used) so
+// that a stalled consumer can't wedge the filter.  Any further updates that were due to be sent at the
+// same time are handled in the same way, without waiting again.  A timeout of 0 (the default) means
+// wait indefinitely.
+func WithSendTimeout(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delivery.sendTimeout = d
+	}
+}
+
+// WithMinRetryDelay sets the shortest time that FilterUpdates waits before processing the queue again.
+// If the next update was due to be sent in the past, which can happen if sending downstream was slow
+// or the clock is skewed, the filter waits this long rather than re-arming its timer immediately,
+// which could spin the CPU.  Zero (or a negative value) means use DefaultMinRetryDelay.
+func WithMinRetryDelay(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		if d <= 0 {
+			d = DefaultMinRetryDelay
+		}
+		filter.delays.minRetryDelay = d
+	}
+}
+
+// WithMicroCoalesceWindow sets the window within which an exact repeat of an address add is
+// dropped, even if the first add was sent straight away because nothing was queued.  This stops
+// duplicate messages from the kernel producing duplicate updates downstream.  A later deletion of
+// the address ends the window early.  Zero (or a negative value) disables the check.  The default
+// is DefaultMicroCoalesceWindow.
+func WithMicroCoalesceWindow(d time.Duration) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delays.microCoalesceWindow = d
+	}
+}
+
+// WithRequeueOnSendTimeout makes FilterUpdates put updates that it failed to send (see
+// WithSendTimeout) back at the front of the queue, to be retried after another send timeout has
+// elapsed.
+func WithRequeueOnSendTimeout() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.delivery.requeueOnSendTimeout = true
+	}
+}
+
+// WithLogger sets the log context used by the filter.  By default, the filter logs with a
+// "component" field of "ifacemonitor".
+func WithLogger(logCtx *logrus.Entry) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.logCtx = logCtx
+	}
+}
+
+// WithNetlinkHeaderLogging adds fields to the filter's decision logs that allow its decisions to be
+// correlated with captures of the underlying netlink messages.  Link updates carry their netlink
+// header, so their logs get its sequence number and port ID as "nlSeq" and "nlPid".  Address
+// updates don't carry the header, so the filter instead gives each update that it receives a
+// monotonically increasing "ingressID", which is logged for every decision about the update,
+// including when it is eventually emitted.
+func WithNetlinkHeaderLogging() UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.netlinkHeaderLogging = true
+	}
+}
+
+// WithTracerProvider makes FilterUpdates create a tracing span for each pass of its main loop, as a
+// child of any span in the context passed to FilterUpdates.  By default, no spans are recorded.
+func WithTracerProvider(tp trace.TracerProvider) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.tracer = tp.Tracer("github.com/projectcalico/calico/felix/ifacemonitor")
+	}
+}
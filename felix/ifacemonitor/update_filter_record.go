@@ -0,0 +1,261 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// CaptureFormatVersion is the version of the capture format written by WithRecorder.  It is bumped
+// whenever the format changes incompatibly.
+//
+// A capture is a stream of JSON objects, one per line.  The first is a header holding the version;
+// each subsequent object is a captureRecord describing one update that the filter received.
+const CaptureFormatVersion = 1
+
+type captureHeader struct {
+	Version int `json:"version"`
+}
+
+const (
+	captureKindRoute = "route"
+	captureKindLink  = "link"
+)
+
+// captureRecord is the serialized form of an update.  It holds only the fields that the filter
+// looks at.
+type captureRecord struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	MsgType  uint16    `json:"msgType"`
+	IfaceIdx int       `json:"ifaceIdx"`
+
+	// Route updates only.
+	Dst       string `json:"dst,omitempty"`
+	RouteType int    `json:"routeType,omitempty"`
+	Scope     uint8  `json:"scope,omitempty"`
+	Table     int    `json:"table,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+
+	// Link updates only.
+	Name     string `json:"name,omitempty"`
+	RawFlags uint32 `json:"rawFlags,omitempty"`
+}
+
+// CapturedUpdate is an update loaded from a capture, along with the time at which the recording
+// filter received it.  Update is a netlink.RouteUpdate or a netlink.LinkUpdate.
+type CapturedUpdate struct {
+	Time   time.Time
+	Update interface{}
+}
+
+// updateRecorder writes the updates that the filter receives to a capture.
+type updateRecorder struct {
+	enc         *json.Encoder
+	wroteHeader bool
+	failed      bool
+}
+
+// WithRecorder makes the filter write every update that it receives, along with its arrival time,
+// to w.  The capture can be loaded with LoadCapture and replayed with ReplayCapture in order to
+// reproduce a problem.  If a write fails, the filter logs the error and stops recording.  Writes are
+// made from the filter's goroutine so w should not block.
+func WithRecorder(w io.Writer) UpdateFilterOp {
+	return func(filter *UpdateFilter) {
+		filter.notify.recorder = &updateRecorder{enc: json.NewEncoder(w)}
+	}
+}
+
+// recordUpdate writes the update to the capture, if recording is enabled.
+func (u *UpdateFilter) recordUpdate(now time.Time, upd interface{}) {
+	r := u.notify.recorder
+	if r == nil || r.failed {
+		return
+	}
+	if err := r.record(now, upd); err != nil {
+		u.logCtx.WithError(err).Error("FilterUpdates: failed to write update to capture, disabling recording.")
+		r.failed = true
+	}
+}
+
+func (r *updateRecorder) record(now time.Time, upd interface{}) error {
+	if !r.wroteHeader {
+		if err := r.enc.Encode(captureHeader{Version: CaptureFormatVersion}); err != nil {
+			return err
+		}
+		r.wroteHeader = true
+	}
+	rec := captureRecord{Time: now}
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		rec.Kind = captureKindRoute
+		rec.MsgType = upd.Type
+		rec.IfaceIdx = upd.LinkIndex
+		if upd.Dst != nil {
+			rec.Dst = upd.Dst.String()
+		}
+		rec.RouteType = upd.Route.Type
+		rec.Scope = uint8(upd.Scope)
+		rec.Table = upd.Table
+		rec.Priority = upd.Priority
+	case netlink.LinkUpdate:
+		rec.Kind = captureKindLink
+		rec.MsgType = upd.Header.Type
+		rec.IfaceIdx = int(upd.Index)
+		if upd.Link != nil && upd.Link.Attrs() != nil {
+			rec.Name = upd.Link.Attrs().Name
+			rec.RawFlags = upd.Link.Attrs().RawFlags
+		}
+	default:
+		return nil
+	}
+	return r.enc.Encode(rec)
+}
+
+// LoadCapture reads a capture written by WithRecorder.
+func LoadCapture(r io.Reader) ([]CapturedUpdate, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		// The recorder writes nothing until the first update.
+		return nil, nil
+	}
+	var hdr captureHeader
+	if err := json.Unmarshal(scanner.Bytes(), &hdr); err != nil {
+		return nil, fmt.Errorf("failed to parse capture header: %w", err)
+	}
+	if hdr.Version != CaptureFormatVersion {
+		return nil, fmt.Errorf("unsupported capture version %d (expected %d)", hdr.Version, CaptureFormatVersion)
+	}
+
+	var upds []CapturedUpdate
+	for lineNum := 2; scanner.Scan(); lineNum++ {
+		var rec captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse capture line %d: %w", lineNum, err)
+		}
+		upd, err := rec.toUpdate()
+		if err != nil {
+			return nil, fmt.Errorf("bad update on capture line %d: %w", lineNum, err)
+		}
+		upds = append(upds, CapturedUpdate{Time: rec.Time, Update: upd})
+	}
+	return upds, scanner.Err()
+}
+
+func (rec captureRecord) toUpdate() (interface{}, error) {
+	switch rec.Kind {
+	case captureKindRoute:
+		upd := netlink.RouteUpdate{Type: rec.MsgType}
+		upd.LinkIndex = rec.IfaceIdx
+		if rec.Dst != "" {
+			ip, cidr, err := net.ParseCIDR(rec.Dst)
+			if err != nil {
+				return nil, err
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				cidr.IP = ip4
+			} else {
+				cidr.IP = ip
+			}
+			upd.Dst = cidr
+		}
+		upd.Route.Type = rec.RouteType
+		upd.Scope = netlink.Scope(rec.Scope)
+		upd.Table = rec.Table
+		upd.Priority = rec.Priority
+		return upd, nil
+	case captureKindLink:
+		attrs := netlink.NewLinkAttrs()
+		attrs.Index = rec.IfaceIdx
+		attrs.Name = rec.Name
+		attrs.RawFlags = rec.RawFlags
+		upd := netlink.LinkUpdate{
+			Link: &netlink.Device{LinkAttrs: attrs},
+			IfInfomsg: nl.IfInfomsg{
+				IfInfomsg: unix.IfInfomsg{
+					Index: int32(rec.IfaceIdx),
+				},
+			},
+		}
+		upd.Header.Type = rec.MsgType
+		return upd, nil
+	}
+	return nil, fmt.Errorf("unknown update kind %q", rec.Kind)
+}
+
+// ReplayClock is the clock that ReplayCapture advances.  *mocktime.MockTime satisfies it.
+type ReplayClock interface {
+	IncrementTime(d time.Duration)
+}
+
+// ReplayCapture sends captured updates to the input channels of a filter that is running
+// FilterUpdates with a mock clock.  Before each update, it advances the clock by the time that
+// elapsed between that update and the previous one in the capture.
+//
+// The filter runs on its own goroutine, so it needs real time in which to react to each update and
+// timer pop.  If speed is greater than zero, ReplayCapture also sleeps for each gap divided by speed:
+// a speed of 1 replays at the original speed and a speed of 10 replays ten times faster.  If speed
+// is zero, updates are sent as fast as the filter accepts them, which may change the interleaving
+// of updates and timer pops.
+func ReplayCapture(ctx context.Context, upds []CapturedUpdate, clock ReplayClock, speed float64,
+	routeInC chan<- netlink.RouteUpdate, linkInC chan<- netlink.LinkUpdate,
+) error {
+	if speed < 0 {
+		return errors.New("replay speed must not be negative")
+	}
+	for i, cu := range upds {
+		if i > 0 {
+			if gap := cu.Time.Sub(upds[i-1].Time); gap > 0 {
+				if speed > 0 {
+					select {
+					case <-time.After(time.Duration(float64(gap) / speed)):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				clock.IncrementTime(gap)
+			}
+		}
+		switch upd := cu.Update.(type) {
+		case netlink.RouteUpdate:
+			select {
+			case routeInC <- upd:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case netlink.LinkUpdate:
+			select {
+			case linkInC <- upd:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// outputSinks holds the outputs registered with WithAdditionalOutput, WithTypedOutput and WithTap.
+type outputSinks struct {
+	// additional holds a sink for each WithAdditionalOutput consumer.
+	additional []*chanSink
+	// typed maps each type registered with WithTypedOutput to its channel.
+	typed map[reflect.Type]chan<- interface{}
+	// tap is the WithTap function.
+	tap func(upd interface{})
+}
+
+// updateSink sends the filter's output downstream.
+type updateSink interface {
+	// send sends the updates downstream, in order.  It returns the updates that it failed to send,
+	// either because the send timeout expired or because the context was cancelled.
+	send(ctx context.Context, upds []interface{}) (unsent []interface{})
+	// trySend sends the update only if the consumer is ready to receive it immediately.
+	trySend(upd interface{}) bool
+}
+
+// fanOutSink sends updates to the primary sink and then hands them to each of the additional
+// outputs.  Only updates that the primary sink accepts are passed on so that, if the primary's
+// updates are re-queued, the other consumers don't see duplicates.
+type fanOutSink struct {
+	primary updateSink
+	others  []*additionalOutput
+}
+
+func (f *fanOutSink) send(ctx context.Context, upds []interface{}) []interface{} {
+	unsent := f.primary.send(ctx, upds)
+	sent := upds[:len(upds)-len(unsent)]
+	if len(sent) == 0 {
+		return unsent
+	}
+	for _, o := range f.others {
+		o.enqueue(append([]interface{}(nil), sent...))
+	}
+	return unsent
+}
+
+func (f *fanOutSink) trySend(upd interface{}) bool {
+	if !f.primary.trySend(upd) {
+		return false
+	}
+	for _, o := range f.others {
+		o.enqueue([]interface{}{upd})
+	}
+	return true
+}
+
+// additionalOutputBufferSize is the number of batches of updates that each additional output
+// buffers for its consumer.
+const additionalOutputBufferSize = 100
+
+// additionalOutput sends updates to a consumer registered with WithAdditionalOutput from its own
+// goroutine.
+type additionalOutput struct {
+	consumer int
+	sink     *chanSink
+	pendingC chan []interface{}
+	done     chan struct{}
+}
+
+// enqueue passes the updates to the sender goroutine, dropping them if its buffer is full.
+func (a *additionalOutput) enqueue(upds []interface{}) {
+	select {
+	case a.pendingC <- upds:
+	default:
+		a.sink.filter.logCtx.WithFields(logrus.Fields{
+			"consumer":   a.consumer,
+			"numDropped": len(upds),
+		}).Error("FilterUpdates: additional consumer is not keeping up, dropping updates.")
+	}
+}
+
+// run sends buffered updates to the consumer until pendingC is closed.  Once ctx is done, it only
+// sends updates that the consumer can accept immediately.
+func (a *additionalOutput) run(ctx context.Context) {
+	defer close(a.done)
+	for upds := range a.pendingC {
+		if ctx.Err() != nil {
+			for _, upd := range upds {
+				if !a.sink.trySend(upd) {
+					break
+				}
+			}
+			continue
+		}
+		if dropped := a.sink.send(ctx, upds); len(dropped) > 0 && ctx.Err() == nil {
+			a.sink.filter.logCtx.WithFields(logrus.Fields{
+				"consumer":   a.consumer,
+				"timeout":    a.sink.filter.delivery.sendTimeout,
+				"numDropped": len(dropped),
+			}).Error("FilterUpdates: timed out sending updates to additional consumer, dropping them.")
+		}
+	}
+}
+
+// tapSink passes updates to the WithTap function before sending them downstream.
+type tapSink struct {
+	next updateSink
+	tap  *tapWorker
+}
+
+func (t *tapSink) send(ctx context.Context, upds []interface{}) []interface{} {
+	t.tap.enqueue(append([]interface{}(nil), upds...))
+	return t.next.send(ctx, upds)
+}
+
+func (t *tapSink) trySend(upd interface{}) bool {
+	// Only used when flushing on shutdown, when most updates can't be sent; only tap the ones
+	// that were.
+	if !t.next.trySend(upd) {
+		return false
+	}
+	t.tap.enqueue([]interface{}{upd})
+	return true
+}
+
+// tapBufferSize is the number of batches of updates that are buffered for the WithTap function.
+const tapBufferSize = 100
+
+// tapWorker calls the WithTap function from its own goroutine.
+type tapWorker struct {
+	filter   *UpdateFilter
+	pendingC chan []interface{}
+}
+
+// enqueue passes the updates to the tap's goroutine, dropping them if its buffer is full.
+func (t *tapWorker) enqueue(upds []interface{}) {
+	select {
+	case t.pendingC <- upds:
+	default:
+		t.filter.logCtx.WithField("numDropped", len(upds)).Warn(
+			"FilterUpdates: tap is not keeping up, dropping updates.")
+	}
+}
+
+// run calls the tap for each buffered update until pendingC is closed.
+func (t *tapWorker) run() {
+	for upds := range t.pendingC {
+		for _, upd := range upds {
+			t.call(upd)
+		}
+	}
+}
+
+func (t *tapWorker) call(upd interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.filter.logCtx.WithField("panic", r).Error("FilterUpdates: panic from tap, ignoring.")
+		}
+	}()
+	t.filter.outputs.tap(upd)
+}
+
+// chanSink sends updates one at a time to the output channels of FilterUpdates.
+type chanSink struct {
+	filter    *UpdateFilter
+	routeOutC chan<- netlink.RouteUpdate
+	linkOutC  chan<- netlink.LinkUpdate
+	sendTimer reusableTimer
+}
+
+func (c *chanSink) send(ctx context.Context, upds []interface{}) []interface{} {
+	defer c.sendTimer.stop()
+	for i, upd := range upds {
+		timeoutC := c.filter.sendTimeoutC(&c.sendTimer)
+		switch upd := upd.(type) {
+		case netlink.RouteUpdate:
+			select {
+			case c.routeOutC <- upd:
+				continue
+			case <-timeoutC:
+			case <-ctx.Done():
+			}
+		case netlink.LinkUpdate:
+			select {
+			case c.linkOutC <- upd:
+				continue
+			case <-timeoutC:
+			case <-ctx.Done():
+			}
+		default:
+			outC, ok := c.filter.outputs.typed[reflect.TypeOf(upd)]
+			if !ok {
+				c.filter.onUnknownUpdate(upd)
+				continue
+			}
+			select {
+			case outC <- upd:
+				continue
+			case <-timeoutC:
+			case <-ctx.Done():
+			}
+		}
+		return upds[i:]
+	}
+	return nil
+}
+
+func (c *chanSink) trySend(upd interface{}) bool {
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		select {
+		case c.routeOutC <- upd:
+			return true
+		default:
+		}
+	case netlink.LinkUpdate:
+		select {
+		case c.linkOutC <- upd:
+			return true
+		default:
+		}
+	default:
+		outC, ok := c.filter.outputs.typed[reflect.TypeOf(upd)]
+		if !ok {
+			c.filter.onUnknownUpdate(upd)
+			return true
+		}
+		select {
+		case outC <- upd:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// closeTypedOutputs closes the channels registered with WithTypedOutput, each of which may be
+// registered for more than one type.
+func (u *UpdateFilter) closeTypedOutputs() {
+	closed := map[chan<- interface{}]bool{}
+	for _, outC := range u.outputs.typed {
+		if closed[outC] {
+			continue
+		}
+		close(outC)
+		closed[outC] = true
+	}
+}
+
+// sendTimeoutC arms the given timer for the send timeout and returns its channel, or nil if there's
+// no send timeout.
+func (u *UpdateFilter) sendTimeoutC(timer *reusableTimer) <-chan time.Time {
+	if u.delivery.sendTimeout <= 0 {
+		return nil
+	}
+	return timer.reset(u.time, u.delivery.sendTimeout)
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// LinkAddrSnapshot is the complete state of one interface, as sent by SnapshotUpdateFilter.
+type LinkAddrSnapshot struct {
+	IfaceIdx int
+	// Link is the most recent link update that the filter has sent for the interface, or nil if it
+	// hasn't sent one.  If the interface has been deleted, it is the deletion.
+	Link *netlink.LinkUpdate
+	// Addrs holds the most recent add for each address that is present on the interface.
+	Addrs []netlink.RouteUpdate
+}
+
+// SnapshotUpdateFilter is a variant of UpdateFilter that, instead of sending individual updates,
+// sends a LinkAddrSnapshot for each interface that has updates in a batch.  All the updates that
+// become ready at the same time (for example, when the damping timer pops) are applied to the
+// interface's state before the snapshot is sent.  This suits consumers that reprogram everything
+// for an interface whenever it changes, since they only need to do so once per batch.
+//
+// Snapshots are sent per batch, not once an interface's queue has drained.  If an interface's
+// queued updates become ready at different times, it gets a snapshot for each batch, reflecting the
+// updates that have been sent so far; updates that are still queued aren't included.
+type SnapshotUpdateFilter struct {
+	filter *UpdateFilter
+}
+
+// NewSnapshotUpdateFilter creates a SnapshotUpdateFilter.  It accepts the same options as
+// NewUpdateFilter.
+func NewSnapshotUpdateFilter(options ...UpdateFilterOp) *SnapshotUpdateFilter {
+	return &SnapshotUpdateFilter{
+		filter: NewUpdateFilter(options...),
+	}
+}
+
+// FilterUpdates is the snapshot equivalent of UpdateFilter.FilterUpdates.  Idle heartbeats (see
+// WithHeartbeat) aren't sent as snapshots.  It returns an error straight away if additional or typed
+// outputs are registered.
+func (s *SnapshotUpdateFilter) FilterUpdates(ctx context.Context,
+	snapshotOutC chan<- LinkAddrSnapshot,
+	routeInC <-chan netlink.RouteUpdate, linkInC <-chan netlink.LinkUpdate,
+) error {
+	// Propagate failures to the downstream channel.
+	defer close(snapshotOutC)
+
+	if err := s.filter.checkVariantOutputs(); err != nil {
+		return err
+	}
+	return s.filter.run(ctx, routeInC, linkInC, &snapshotSink{
+		filter:       s.filter,
+		snapshotOutC: snapshotOutC,
+		linksByIface: map[int]netlink.LinkUpdate{},
+		addrsByIface: map[int][]netlink.RouteUpdate{},
+	})
+}
+
+// Validate is as for UpdateFilter.Validate, except that additional and typed outputs aren't
+// supported.
+func (s *SnapshotUpdateFilter) Validate() error {
+	return s.filter.validateVariant()
+}
+
+// QueueSnapshot is as for UpdateFilter.QueueSnapshot.
+func (s *SnapshotUpdateFilter) QueueSnapshot() map[int]int {
+	return s.filter.QueueSnapshot()
+}
+
+// snapshotSink sends updates to the output channel of SnapshotUpdateFilter.FilterUpdates.  It
+// tracks the state of each interface according to the updates that it has been given.
+type snapshotSink struct {
+	filter       *UpdateFilter
+	snapshotOutC chan<- LinkAddrSnapshot
+	linksByIface map[int]netlink.LinkUpdate
+	addrsByIface map[int][]netlink.RouteUpdate
+	sendTimer    reusableTimer
+}
+
+func (s *snapshotSink) send(ctx context.Context, upds []interface{}) []interface{} {
+	defer s.sendTimer.stop()
+	// Applying an update twice has no further effect so, if the send fails and the filter re-queues
+	// the updates, it's safe to apply them again when they're re-sent.
+	var idxs []int
+	updsByIface := map[int][]interface{}{}
+	for _, upd := range upds {
+		if !s.apply(upd) {
+			continue
+		}
+		idx := updateIfaceIdx(upd)
+		if _, ok := updsByIface[idx]; !ok {
+			idxs = append(idxs, idx)
+		}
+		updsByIface[idx] = append(updsByIface[idx], upd)
+	}
+
+	timeoutC := s.filter.sendTimeoutC(&s.sendTimer)
+	for i, idx := range idxs {
+		select {
+		case s.snapshotOutC <- s.snapshot(idx):
+			continue
+		case <-timeoutC:
+		case <-ctx.Done():
+		}
+		var unsent []interface{}
+		for _, idx := range idxs[i:] {
+			unsent = append(unsent, updsByIface[idx]...)
+		}
+		return unsent
+	}
+	return nil
+}
+
+func (s *snapshotSink) trySend(upd interface{}) bool {
+	if !s.apply(upd) {
+		return true
+	}
+	select {
+	case s.snapshotOutC <- s.snapshot(updateIfaceIdx(upd)):
+		return true
+	default:
+	}
+	return false
+}
+
+// apply updates the interface state for the given update.  It returns false if the update doesn't
+// apply to an interface.
+func (s *snapshotSink) apply(upd interface{}) bool {
+	switch upd := upd.(type) {
+	case netlink.RouteUpdate:
+		applyEmittedAddr(s.addrsByIface, upd, s.filter.addrs.coalesceIgnoresMask)
+	case netlink.LinkUpdate:
+		if IsHeartbeat(upd) {
+			return false
+		}
+		idx := int(upd.Index)
+		s.linksByIface[idx] = upd
+		if upd.Header.Type == syscall.RTM_DELLINK {
+			delete(s.addrsByIface, idx)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// snapshot returns the current state of the given interface.  Once the deletion of an interface
+// has been included in a snapshot, the interface's state is forgotten.
+func (s *snapshotSink) snapshot(idx int) LinkAddrSnapshot {
+	snap := LinkAddrSnapshot{
+		IfaceIdx: idx,
+		Addrs:    append([]netlink.RouteUpdate(nil), s.addrsByIface[idx]...),
+	}
+	if link, ok := s.linksByIface[idx]; ok {
+		snap.Link = &link
+		if link.Header.Type == syscall.RTM_DELLINK {
+			delete(s.linksByIface, idx)
+		}
+	}
+	return snap
+}
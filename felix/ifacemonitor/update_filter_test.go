@@ -15,18 +15,32 @@
 package ifacemonitor_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"golang.org/x/sys/unix"
 
 	"github.com/projectcalico/calico/felix/ifacemonitor"
+	"github.com/projectcalico/calico/felix/timeshim"
 	"github.com/projectcalico/calico/felix/timeshim/mocktime"
 )
 
@@ -43,6 +57,7 @@ func TestUpdateFilter_FilterUpdates_LinkCClosed(t *testing.T) {
 	close(harness.LinkIn)
 	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(BeClosed())
 	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+	Eventually(harness.Result, chanPollTime, chanPollIntvl).Should(Receive(MatchError(ifacemonitor.ErrInputClosed)))
 }
 
 func TestUpdateFilter_FilterUpdates_RouteCClosed(t *testing.T) {
@@ -53,6 +68,32 @@ func TestUpdateFilter_FilterUpdates_RouteCClosed(t *testing.T) {
 	close(harness.RouteIn)
 	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(BeClosed())
 	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+	Eventually(harness.Result, chanPollTime, chanPollIntvl).Should(Receive(MatchError(ifacemonitor.ErrInputClosed)))
+}
+
+func TestUpdateFilter_FilterUpdates_ReturnsContextCause(t *testing.T) {
+	RegisterTestingT(t)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	in := func() (<-chan netlink.RouteUpdate, <-chan netlink.LinkUpdate) {
+		return make(chan netlink.RouteUpdate), make(chan netlink.LinkUpdate)
+	}
+
+	t.Log("A deadline should be distinguishable from a cancellation.")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	routeIn, linkIn := in()
+	err := ifacemonitor.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn)
+	Expect(err).To(MatchError(context.DeadlineExceeded))
+
+	t.Log("A cancellation cause should be returned as-is, also when damping is disabled.")
+	errStop := errors.New("stopped by test")
+	causeCtx, cancelCause := context.WithCancelCause(context.Background())
+	cancelCause(errStop)
+	routeIn, linkIn = in()
+	err = ifacemonitor.FilterUpdates(causeCtx, make(chan netlink.RouteUpdate), routeIn,
+		make(chan netlink.LinkUpdate), linkIn, ifacemonitor.WithDampingEnabled(false))
+	Expect(err).To(Equal(errStop))
 }
 
 func TestUpdateFilter_FilterUpdates_LinkUpdateDelay(t *testing.T) {
@@ -231,69 +272,3987 @@ func TestUpdateFilter_FilterUpdates_RouteUpdateDelOnly(t *testing.T) {
 	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
 }
 
-type filterUpdatesHarness struct {
-	Time *mocktime.MockTime
+func TestUpdateFilter_FilterUpdates_CustomDampingDelay(t *testing.T) {
+	t.Log("Route DEL should be delayed by the configured damping delay")
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithFlapDampingDelay(300*time.Millisecond))
+	defer cancel()
 
-	Ctx    context.Context
-	Cancel context.CancelFunc
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	harness.RouteIn <- routeDel
 
-	LinkIn   chan netlink.LinkUpdate
-	LinkOut  chan netlink.LinkUpdate
-	RouteIn  chan netlink.RouteUpdate
-	RouteOut chan netlink.RouteUpdate
+	// Make sure the filter has pulled the DEL off the channel before advancing time.
+	routeAdd2 := routeUpdate("10.0.0.2/16", true, 3)
+	harness.RouteIn <- routeAdd2
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+
+	t.Log("Shouldn't get any output after 299ms.")
+	harness.Time.IncrementTime(299 * time.Millisecond)
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Should get the DEL after 300ms.")
+	harness.Time.IncrementTime(1 * time.Millisecond)
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
 }
 
-func setUpFilterTest(t *testing.T) (*filterUpdatesHarness, context.CancelFunc) {
+func TestUpdateFilter_ZeroDampingDelay(t *testing.T) {
 	RegisterTestingT(t)
-	mockTime := mocktime.New()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Log("A zero damping delay should send a route DEL straight away")
+	f := NewManualTestFilter(ifacemonitor.WithFlapDampingDelay(0))
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(routeDel)).To(Equal([]interface{}{routeDel}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_FilterUpdates_PerInterfaceDelay(t *testing.T) {
+	t.Log("Per-interface delay should override the global delay for known interfaces")
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithPerInterfaceDelay(func(name string) time.Duration {
+		if name == "bond0" {
+			return 250 * time.Millisecond
+		}
+		return 0
+	}))
+	defer cancel()
+
+	linkUpd := linkUpdateWithIndex(2)
+	linkUpd.Link.Attrs().Name = "bond0"
+	harness.LinkIn <- linkUpd
+	otherLinkUpd := linkUpdateWithIndex(3)
+	otherLinkUpd.Link.Attrs().Name = "eth0"
+	harness.LinkIn <- otherLinkUpd
+	Consistently(harness.LinkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Interface without an override should use the global delay.")
+	harness.Time.IncrementTime(100 * time.Millisecond)
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(otherLinkUpd)))
+	Consistently(harness.LinkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Overridden interface should be released after 250ms.")
+	harness.Time.IncrementTime(150 * time.Millisecond)
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkUpd)))
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
+}
+
+func TestUpdateFilter_FilterUpdates_FlushOnShutdown(t *testing.T) {
+	t.Log("Queued ADDs should be flushed when the context is cancelled")
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithFlushOnShutdown())
+	defer cancel()
+
+	// This DEL will block the following ADD from being delivered.
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	harness.RouteIn <- routeDel
+	routeAdd := routeUpdate("10.0.0.2/16", true, 2)
+	harness.RouteIn <- routeAdd
+
+	// Make sure the filter has pulled the above off the channel.
+	routeAdd2 := routeUpdate("10.0.0.3/16", true, 3)
+	harness.RouteIn <- routeAdd2
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+
+	t.Log("After cancellation, should get the queued ADD but not the DEL.")
+	harness.Cancel()
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_FlushOnShutdownDuringSend(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	linkIn := make(chan netlink.LinkUpdate, 10)
 	routeIn := make(chan netlink.RouteUpdate, 10)
-	linkOut := make(chan netlink.LinkUpdate, 10)
-	routeOut := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10),
+		ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithFlushOnShutdown(),
+		ifacemonitor.WithShutdownTimeout(time.Second))
 
-	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn, ifacemonitor.WithTimeShim(mockTime))
-	return &filterUpdatesHarness{
-		Ctx:    ctx,
-		Cancel: cancel,
-		Time:   mockTime,
+	t.Log("Cancel while the filter is trying to send an add.")
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- routeAdd
+	Eventually(func() int { return len(routeIn) }, chanPollTime, chanPollIntvl).Should(BeZero())
+	cancel()
 
-		LinkIn:   linkIn,
-		LinkOut:  linkOut,
-		RouteIn:  routeIn,
-		RouteOut: routeOut,
-	}, cancel
+	t.Log("The add should still be flushed.")
+	Eventually(routeOut, "1s").Should(Receive(Equal(routeAdd)))
+	Eventually(routeOut, "1s").Should(BeClosed())
 }
 
-func routeUpdate(cidrStr string, up bool, ifaceIdx int) netlink.RouteUpdate {
-	ip, cidr, _ := net.ParseCIDR(cidrStr)
-	cidr.IP = ip.To4()
-	routeUpd := netlink.RouteUpdate{}
-	routeUpd.Dst = cidr
-	if strings.Contains(cidrStr, ".255") {
-		routeUpd.Route.Type = unix.RTN_BROADCAST
-	} else {
-		routeUpd.Route.Type = unix.RTN_LOCAL
-	}
-	routeUpd.LinkIndex = ifaceIdx
-	if up {
-		routeUpd.Type = unix.RTM_NEWROUTE
-	} else {
-		routeUpd.Type = unix.RTM_DELROUTE
+func TestUpdateFilter_FilterUpdates_ShutdownTimeout(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Output channel is unbuffered and only read after the shutdown timeout has expired.
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithFlapDampingDelay(time.Hour),
+		ifacemonitor.WithFlushOnShutdown(),
+		ifacemonitor.WithShutdownTimeout(50*time.Millisecond),
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		filter.FilterUpdates(ctx, routeOut, routeIn,
+			make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+	}()
+
+	// The DEL blocks the ADD, which would be flushed on shutdown.
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- routeUpdate("10.0.0.2/16", true, 2)
+	Eventually(filter.QueueSnapshot, "1s", chanPollIntvl).Should(Equal(map[int]int{2: 2}))
+
+	t.Log("Filter should give up on the stalled consumer after the shutdown timeout.")
+	start := time.Now()
+	cancel()
+	Eventually(done, "1s", chanPollIntvl).Should(BeClosed())
+	Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+	Expect(routeOut).To(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_ShutdownTimeoutWaitsForConsumer(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithFlapDampingDelay(time.Hour),
+		ifacemonitor.WithFlushOnShutdown(),
+		ifacemonitor.WithShutdownTimeout(time.Second),
+	)
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	routeAdd := routeUpdate("10.0.0.2/16", true, 2)
+	routeIn <- routeAdd
+	Eventually(filter.QueueSnapshot, "1s", chanPollIntvl).Should(Equal(map[int]int{2: 2}))
+
+	t.Log("A consumer that is slow to read should still get the flushed update.")
+	cancel()
+	mockTime.IncrementTime(999 * time.Millisecond)
+	select {
+	case upd := <-routeOut:
+		Expect(upd).To(Equal(routeAdd))
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for flushed update")
 	}
-	return routeUpd
+	Eventually(routeOut, "1s", chanPollIntvl).Should(BeClosed())
 }
 
-func linkUpdateWithIndex(idx int) netlink.LinkUpdate {
-	la := netlink.NewLinkAttrs()
-	la.Index = idx
-	return netlink.LinkUpdate{
-		Link: &netlink.Device{LinkAttrs: la},
-		IfInfomsg: nl.IfInfomsg{
-			IfInfomsg: unix.IfInfomsg{
-				Index: int32(idx),
-			},
-		},
+func TestUpdateFilter_FilterUpdates_FlushOnShutdownWaitsByDefault(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithFlapDampingDelay(time.Hour),
+		ifacemonitor.WithFlushOnShutdown(),
+	)
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	routeAdd := routeUpdate("10.0.0.2/16", true, 2)
+	routeIn <- routeAdd
+	Eventually(filter.QueueSnapshot, "1s", chanPollIntvl).Should(Equal(map[int]int{2: 2}))
+
+	t.Log("Without a shutdown timeout, the flush should wait up to the default for the consumer.")
+	cancel()
+	mockTime.IncrementTime(ifacemonitor.DefaultShutdownTimeout - time.Millisecond)
+	Eventually(routeOut, "1s", chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Eventually(routeOut, "1s", chanPollIntvl).Should(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_FlushAllOnShutdown(t *testing.T) {
+	t.Log("All queued updates should be flushed when the context is cancelled")
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithFlushAllOnShutdown())
+	defer cancel()
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	harness.RouteIn <- routeDel
+	routeAdd := routeUpdate("10.0.0.2/16", true, 2)
+	harness.RouteIn <- routeAdd
+
+	// Make sure the filter has pulled the above off the channel.
+	routeAdd2 := routeUpdate("10.0.0.3/16", true, 3)
+	harness.RouteIn <- routeAdd2
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+
+	harness.Cancel()
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_MaxQueueDepth(t *testing.T) {
+	t.Log("Oldest updates should be sent early if the queue overflows")
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithMaxQueueDepth(2))
+	defer cancel()
+
+	routeDel1 := routeUpdate("10.0.0.1/16", false, 2)
+	harness.RouteIn <- routeDel1
+	routeDel2 := routeUpdate("10.0.0.2/16", false, 2)
+	harness.RouteIn <- routeDel2
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Third DEL should push the first one out of the queue.")
+	routeDel3 := routeUpdate("10.0.0.3/16", false, 2)
+	harness.RouteIn <- routeDel3
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel1)))
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Remaining updates should come through after 100ms.")
+	harness.Time.IncrementTime(100 * time.Millisecond)
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel2)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel3)))
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
+}
+
+func TestUpdateFilter_FilterUpdates_FlapCallback(t *testing.T) {
+	t.Log("Flap callback should be called when a DEL is squashed by an ADD")
+	type flap struct {
+		IfaceIdx int
+		Addr     string
+		GoneFor  time.Duration
 	}
+	flapsC := make(chan flap, 10)
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithFlapCallback(
+		func(ifaceIdx int, addr net.IPNet, goneFor time.Duration) {
+			flapsC <- flap{IfaceIdx: ifaceIdx, Addr: addr.String(), GoneFor: goneFor}
+			panic("callback panics should be recovered")
+		},
+	))
+	defer cancel()
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	harness.RouteIn <- routeDel
+	// Make sure the filter has pulled the DEL off the channel before advancing time.
+	routeAdd2 := routeUpdate("10.0.0.2/16", true, 3)
+	harness.RouteIn <- routeAdd2
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+
+	harness.Time.IncrementTime(40 * time.Millisecond)
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	harness.RouteIn <- routeAdd
+	Eventually(flapsC, chanPollTime, chanPollIntvl).Should(Receive(Equal(flap{
+		IfaceIdx: 2,
+		Addr:     "10.0.0.1/16",
+		GoneFor:  40 * time.Millisecond,
+	})))
+
+	t.Log("Filter should survive the panic and send the ADD once the timer pops.")
+	harness.Time.IncrementTime(60 * time.Millisecond)
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
+}
+
+func TestUpdateFilter_FilterUpdates_LinkUpdateSquash(t *testing.T) {
+	t.Log("Queued link updates should be squashed by later link updates")
+	harness, cancel := setUpFilterTest(t)
+	defer cancel()
+
+	harness.LinkIn <- linkUpdateWithIndex(2)
+	// Need to let the filter receive the above update before we can advance time.
+	Consistently(harness.LinkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	harness.Time.IncrementTime(50 * time.Millisecond)
+	harness.LinkIn <- linkUpdateWithIndex(2)
+	linkUp := linkUpUpdateWithIndex(2)
+	harness.LinkIn <- linkUp
+	Consistently(harness.LinkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Only the final update should be sent, at the time the first update was due.")
+	harness.Time.IncrementTime(50 * time.Millisecond)
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkUp)))
+	Consistently(harness.LinkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
+}
+
+func TestUpdateFilter_FilterUpdates_DuplicateAdd(t *testing.T) {
+	t.Log("Duplicate ADDs should only be sent once")
+	harness, cancel := setUpFilterTest(t)
+	defer cancel()
+
+	// This DEL will block the following messages from being delivered.
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	harness.RouteIn <- routeDel
+	routeAdd := routeUpdate("10.0.0.2/16", true, 2)
+	harness.RouteIn <- routeAdd
+	harness.RouteIn <- routeAdd
+
+	// Make sure the filter has pulled the above off the channel.
+	routeAdd2 := routeUpdate("10.0.0.3/16", true, 3)
+	harness.RouteIn <- routeAdd2
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+
+	harness.Time.IncrementTime(100 * time.Millisecond)
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
+}
+
+func TestUpdateFilter_FilterUpdates_DampingDisabled(t *testing.T) {
+	t.Log("With damping disabled, updates should be passed straight through")
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithDampingEnabled(false))
+	defer cancel()
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	harness.RouteIn <- routeDel
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+	linkUpd := linkUpdateWithIndex(2)
+	harness.LinkIn <- linkUpd
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkUpd)))
+
+	t.Log("Non-local routes should still be filtered out.")
+	harness.RouteIn <- routeUpdate("10.0.0.255/16", true, 2)
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers when damping is disabled")
+
+	harness.Cancel()
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_IPv6FlapDoesNotDelayIPv4(t *testing.T) {
+	t.Log("A flapping IPv6 address shouldn't delay IPv4 updates on the same interface")
+	harness, cancel := setUpFilterTest(t)
+	defer cancel()
+
+	// This DEL will block later IPv6 updates for the interface.
+	v6Del := routeUpdate("fd00::1/64", false, 2)
+	harness.RouteIn <- v6Del
+	v6Add2 := routeUpdate("fd00::2/64", true, 2)
+	harness.RouteIn <- v6Add2
+
+	t.Log("IPv4 ADD on the same interface should go straight through.")
+	v4Add := routeUpdate("10.0.0.1/16", true, 2)
+	harness.RouteIn <- v4Add
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(v4Add)))
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("IPv6 flap resolves, should get the ADD once the timer pops.")
+	v6Add := routeUpdate("fd00::1/64", true, 2)
+	harness.RouteIn <- v6Add
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	harness.Time.IncrementTime(100 * time.Millisecond)
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(v6Add2)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(v6Add)))
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
+}
+
+func TestUpdateFilter_FilterUpdates_IfaceIndexReuse(t *testing.T) {
+	t.Log("Queued updates for a deleted interface shouldn't leak onto a new interface with the same index")
+	harness, cancel := setUpFilterTest(t)
+	defer cancel()
+
+	// Old interface loses an address and then gets deleted.
+	routeDel := routeUpdate("10.0.0.1/16", false, 12)
+	harness.RouteIn <- routeDel
+	routeAdd2 := routeUpdate("10.0.0.2/16", true, 12)
+	harness.RouteIn <- routeAdd2
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	linkDel := linkUpdateWithIndex(12)
+	linkDel.Header.Type = unix.RTM_DELLINK
+	harness.LinkIn <- linkDel
+
+	t.Log("Deletion should be sent immediately.")
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkDel)))
+
+	t.Log("New interface with the same index should see only its own updates.")
+	linkUp := linkUpUpdateWithIndex(12)
+	harness.LinkIn <- linkUp
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkUp)))
+	routeAdd3 := routeUpdate("10.0.0.3/16", true, 12)
+	harness.RouteIn <- routeAdd3
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd3)))
+
+	harness.Time.IncrementTime(100 * time.Millisecond)
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Consistently(harness.LinkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestUpdateFilter_FilterUpdates_DeletesOnInterfaceRemoval(t *testing.T) {
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithDeletesOnInterfaceRemoval())
+	defer cancel()
+
+	routeAddA := routeUpdate("10.0.0.1/16", true, 12)
+	routeAddB := routeUpdate("10.0.0.2/16", true, 12)
+	harness.RouteIn <- routeAddA
+	harness.RouteIn <- routeAddB
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAddA)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAddB)))
+
+	t.Log("Deletion of B should be damped.")
+	routeDelB := routeUpdate("10.0.0.2/16", false, 12)
+	harness.RouteIn <- routeDelB
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Deleting the interface should send the damped deletion and delete the other address.")
+	linkDel := linkUpdateWithIndex(12)
+	linkDel.Header.Type = unix.RTM_DELLINK
+	harness.LinkIn <- linkDel
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDelB)))
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(
+		routeUpdate("10.0.0.1/16", false, 12))))
+	Eventually(harness.LinkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkDel)))
+
+	harness.Time.IncrementTime(100 * time.Millisecond)
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Consistently(harness.LinkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestUpdateFilter_FilterUpdates_IgnoredScopes(t *testing.T) {
+	t.Log("Updates for addresses in an ignored scope should be dropped")
+	harness, cancel := setUpFilterTest(t, ifacemonitor.WithIgnoredScopes(netlink.SCOPE_LINK))
+	defer cancel()
+
+	harness.RouteIn <- routeUpdate("fe80::1/64", true, 2)
+	harness.RouteIn <- routeUpdate("fe80::1/64", false, 2)
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	harness.Time.IncrementTime(100 * time.Millisecond)
+	Consistently(harness.RouteOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	routeAdd := routeUpdate("fd00::1/64", true, 2)
+	harness.RouteIn <- routeAdd
+	Eventually(harness.RouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Expect(harness.Time.HasTimers()).To(BeFalse(), "Should be no timers left at end of test")
+}
+
+func TestUpdateFilter_FilterOne(t *testing.T) {
+	RegisterTestingT(t)
+	t.Log("FilterOne should allow the filter to be driven synchronously")
+	filter := ifacemonitor.NewUpdateFilter()
+	start := time.Now()
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	emit, nextWake := filter.FilterOne(start, routeDel)
+	Expect(emit).To(BeEmpty())
+	Expect(nextWake).To(Equal(start.Add(100 * time.Millisecond)))
+
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	emit, nextWake = filter.FilterOne(start.Add(50*time.Millisecond), routeAdd)
+	Expect(emit).To(BeEmpty())
+	Expect(nextWake).To(Equal(start.Add(100 * time.Millisecond)))
+
+	routeAdd2 := routeUpdate("10.0.0.2/16", true, 3)
+	emit, _ = filter.FilterOne(start.Add(60*time.Millisecond), routeAdd2)
+	Expect(emit).To(Equal([]interface{}{routeAdd2}))
+
+	emit, nextWake = filter.FilterOne(start.Add(100*time.Millisecond), nil)
+	Expect(emit).To(Equal([]interface{}{routeAdd}))
+	Expect(nextWake.IsZero()).To(BeTrue(), "Queue should be empty")
+}
+
+func TestUpdateFilter_QueueSnapshot(t *testing.T) {
+	RegisterTestingT(t)
+	filter := ifacemonitor.NewUpdateFilter()
+	start := time.Now()
+	Expect(filter.QueueSnapshot()).To(BeEmpty())
+
+	filter.FilterOne(start, routeUpdate("10.0.0.1/16", false, 2))
+	filter.FilterOne(start, routeUpdate("10.0.0.2/16", false, 2))
+	filter.FilterOne(start, routeUpdate("10.0.0.3/16", false, 3))
+	Expect(filter.QueueSnapshot()).To(Equal(map[int]int{2: 2, 3: 1}))
+
+	filter.FilterOne(start.Add(100*time.Millisecond), nil)
+	Expect(filter.QueueSnapshot()).To(BeEmpty())
+}
+
+func TestUpdateFilter_LinkAndAddrDelays(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithLinkDelay(50*time.Millisecond),
+		ifacemonitor.WithAddrDelay(200*time.Millisecond),
+	)
+
+	linkDown := linkUpdateWithIndex(2)
+	routeDel := routeUpdate("10.0.0.1/16", false, 3)
+	Expect(f.Send(linkDown)).To(BeEmpty())
+	Expect(f.Send(routeDel)).To(BeEmpty())
+
+	t.Log("The link update should be sent after the link delay.")
+	Expect(f.Advance(49 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(1 * time.Millisecond)).To(Equal([]interface{}{linkDown}))
+
+	t.Log("The address update should be sent after the address delay.")
+	Expect(f.Advance(149 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(1 * time.Millisecond)).To(Equal([]interface{}{routeDel}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_CoalescePolicy(t *testing.T) {
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	for _, tc := range []struct {
+		policy     ifacemonitor.CoalescePolicy
+		first      netlink.RouteUpdate
+		second     netlink.RouteUpdate
+		expected   netlink.RouteUpdate
+		expectedAt time.Duration
+	}{
+		{ifacemonitor.CoalesceAddWins, routeDel, routeAdd, routeAdd, 60 * time.Millisecond},
+		{ifacemonitor.CoalesceAddWins, routeAdd, routeDel, routeDel, 110 * time.Millisecond},
+		{ifacemonitor.CoalesceDeleteWins, routeDel, routeAdd, routeDel, 100 * time.Millisecond},
+		{ifacemonitor.CoalesceDeleteWins, routeAdd, routeDel, routeDel, 110 * time.Millisecond},
+		{ifacemonitor.CoalesceNewest, routeDel, routeAdd, routeAdd, 100 * time.Millisecond},
+		{ifacemonitor.CoalesceNewest, routeAdd, routeDel, routeDel, 50 * time.Millisecond},
+	} {
+		t.Run(fmt.Sprintf("%s/%s", tc.policy, routeTypeName(tc.first, tc.second)), func(t *testing.T) {
+			RegisterTestingT(t)
+			f := NewManualTestFilter(
+				ifacemonitor.WithCoalescePolicy(tc.policy),
+				ifacemonitor.WithDelayAdds(50*time.Millisecond),
+			)
+			Expect(f.Filter.Validate()).To(Succeed())
+
+			Expect(f.Send(tc.first)).To(BeEmpty())
+			f.Advance(10 * time.Millisecond)
+			Expect(f.Send(tc.second)).To(BeEmpty())
+			Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}))
+
+			Expect(f.Advance(tc.expectedAt - 11*time.Millisecond)).To(BeEmpty())
+			Expect(f.Advance(time.Millisecond)).To(Equal([]interface{}{tc.expected}))
+			f.ExpectQueueDrained()
+		})
+	}
+}
+
+func routeTypeName(upds ...netlink.RouteUpdate) string {
+	var names []string
+	for _, upd := range upds {
+		if upd.Type == unix.RTM_NEWROUTE {
+			names = append(names, "add")
+		} else {
+			names = append(names, "del")
+		}
+	}
+	return strings.Join(names, "-")
+}
+
+func TestUpdateFilter_LinkFlapDamping(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithLinkFlapDamping(500 * time.Millisecond))
+	Expect(f.Filter.Validate()).To(Succeed())
+
+	linkUp := linkUpUpdateWithIndex(2)
+	linkDown := linkUpdateWithIndex(2)
+	Expect(f.Send(linkUp)).To(Equal([]interface{}{linkUp}))
+
+	t.Log("A down→up bounce within the window should be suppressed entirely.")
+	Expect(f.Send(linkDown)).To(BeEmpty())
+	Expect(f.Advance(400 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Send(linkUp)).To(BeEmpty())
+	f.ExpectQueueDrained()
+
+	t.Log("A link down that lasts longer than the window should be sent.")
+	Expect(f.Send(linkDown)).To(BeEmpty())
+	Expect(f.Advance(499 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(time.Millisecond)).To(Equal([]interface{}{linkDown}))
+
+	t.Log("Once downstream has seen the link down, the link coming up should be sent.")
+	Expect(f.Send(linkUp)).To(Equal([]interface{}{linkUp}))
+	f.ExpectQueueDrained()
+}
+
+type neighUpdate struct {
+	ifaceIdx int
+}
+
+func TestUpdateFilter_TypedOutput(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithTypedOutput(neighUpdate{}, make(chan interface{})),
+	)
+
+	t.Log("Updates of a registered type should pass straight through, even with updates queued.")
+	Expect(f.Send(routeUpdate("10.0.0.1/16", false, 2))).To(BeEmpty())
+	Expect(f.Send(neighUpdate{ifaceIdx: 2})).To(Equal([]interface{}{neighUpdate{ifaceIdx: 2}}))
+
+	t.Log("Updates of an unknown type should be dropped.")
+	Expect(f.Send("unknown")).To(BeEmpty())
+	Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}))
+}
+
+type vlanUpdate struct {
+	ifaceIdx int
+}
+
+func TestUpdateFilter_FilterUpdates_TypedOutput(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	typedOut := make(chan interface{}, 10)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithTypedOutput(neighUpdate{}, typedOut),
+		ifacemonitor.WithTypedOutput(vlanUpdate{}, typedOut),
+	)
+	resultC := make(chan error, 1)
+	go func() {
+		resultC <- filter.FilterUpdates(ctx,
+			make(chan netlink.RouteUpdate, 10), make(chan netlink.RouteUpdate),
+			make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate))
+	}()
+
+	t.Log("Registered types should be sent to their channel.")
+	Expect(filter.InjectForTest(ctx, neighUpdate{ifaceIdx: 2})).To(Succeed())
+	Expect(filter.InjectForTest(ctx, vlanUpdate{ifaceIdx: 3})).To(Succeed())
+	Eventually(typedOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(neighUpdate{ifaceIdx: 2})))
+	Eventually(typedOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(vlanUpdate{ifaceIdx: 3})))
+
+	t.Log("Stopping the filter should close the channel, once, even though it's registered twice.")
+	cancel()
+	Eventually(resultC, chanPollTime, chanPollIntvl).Should(Receive())
+	Expect(typedOut).To(BeClosed())
+}
+
+type fakeAddrEvent struct {
+	idx  int
+	addr string
+	add  bool
+}
+
+func (e fakeAddrEvent) LinkIndex() int { return e.idx }
+func (e fakeAddrEvent) LinkAddress() net.IPNet {
+	return *routeUpdate(e.addr, e.add, e.idx).Dst
+}
+func (e fakeAddrEvent) NewAddr() bool { return e.add }
+
+type fakeLinkEvent struct {
+	idx     int32
+	up      bool
+	deleted bool
+	mac     string
+}
+
+func (e fakeLinkEvent) Index() int32 { return e.idx }
+func (e fakeLinkEvent) Name() string { return fmt.Sprintf("eth%d", e.idx) }
+func (e fakeLinkEvent) RawFlags() uint32 {
+	if e.up {
+		return unix.IFF_UP | unix.IFF_RUNNING
+	}
+	return unix.IFF_UP
+}
+func (e fakeLinkEvent) HardwareAddr() net.HardwareAddr {
+	mac, _ := net.ParseMAC(e.mac)
+	return mac
+}
+func (e fakeLinkEvent) Deleted() bool { return e.deleted }
+
+func TestUpdateFilter_EventAdapters(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+
+	t.Log("Converted address events should be damped like native updates.")
+	routeDel := ifacemonitor.AddrEventToRouteUpdate(fakeAddrEvent{idx: 2, addr: "10.0.0.1/16"})
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}))
+	routeAdd := ifacemonitor.AddrEventToRouteUpdate(fakeAddrEvent{idx: 2, addr: "10.0.0.1/16", add: true})
+	Expect(f.Send(routeAdd)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{routeAdd}))
+	f.ExpectQueueDrained()
+
+	t.Log("Converted link events should carry the link state.")
+	linkUp := ifacemonitor.LinkEventToLinkUpdate(fakeLinkEvent{idx: 3, up: true})
+	Expect(ifacemonitor.LinkIsOperUp(linkUp.Link)).To(BeTrue())
+	Expect(linkUp.Link.Attrs().Name).To(Equal("eth3"))
+	Expect(f.Send(linkUp)).To(Equal([]interface{}{linkUp}))
+	linkDown := ifacemonitor.LinkEventToLinkUpdate(fakeLinkEvent{idx: 3})
+	Expect(f.Send(linkDown)).To(BeEmpty())
+	linkDel := ifacemonitor.LinkEventToLinkUpdate(fakeLinkEvent{idx: 3, deleted: true})
+	Expect(f.Send(linkDel)).To(Equal([]interface{}{linkDel}))
+	Expect(f.Filter.QueueSnapshot()).To(BeEmpty())
+}
+
+func TestUpdateFilter_LinkEventMACChange(t *testing.T) {
+	RegisterTestingT(t)
+	macC := make(chan ifacemonitor.MACChangedEvent, 10)
+	f := NewManualTestFilter(ifacemonitor.WithMACChangeChan(macC))
+
+	first := ifacemonitor.LinkEventToLinkUpdate(fakeLinkEvent{idx: 3, up: true, mac: "00:11:22:33:44:55"})
+	f.Send(first)
+	Expect(macC).NotTo(Receive())
+
+	t.Log("A MAC change carried by a converted link event should be reported.")
+	second := ifacemonitor.LinkEventToLinkUpdate(fakeLinkEvent{idx: 3, up: true, mac: "00:11:22:33:44:66"})
+	f.Send(second)
+	Expect(macC).To(Receive(Equal(ifacemonitor.MACChangedEvent{
+		IfaceIdx:  3,
+		IfaceName: "eth3",
+		OldMAC:    first.Link.Attrs().HardwareAddr,
+		NewMAC:    second.Link.Attrs().HardwareAddr,
+	})))
+}
+
+func TestAdaptAddrEvents(t *testing.T) {
+	RegisterTestingT(t)
+	inC := make(chan ifacemonitor.AddrEvent, 1)
+	outC := make(chan netlink.RouteUpdate, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ifacemonitor.AdaptAddrEvents(context.Background(), inC, outC)
+	}()
+
+	e := fakeAddrEvent{idx: 2, addr: "10.0.0.1/16", add: true}
+	inC <- e
+	Eventually(outC).Should(Receive(Equal(ifacemonitor.AddrEventToRouteUpdate(e))))
+
+	t.Log("Closing the input should close the output.")
+	close(inC)
+	Eventually(done).Should(BeClosed())
+	Expect(outC).To(BeClosed())
+}
+
+func TestUpdateFilter_DeterministicIfaceOrder(t *testing.T) {
+	RegisterTestingT(t)
+	// Map iteration order is randomised so repeat to make sure that the order isn't down to luck.
+	for i := 0; i < 20; i++ {
+		f := NewManualTestFilter()
+		var expected []interface{}
+		for _, idx := range []int{5, 3, 9, 2, 7} {
+			Expect(f.Send(routeUpdate("10.0.0.1/16", false, idx))).To(BeEmpty())
+		}
+		for _, idx := range []int{2, 3, 5, 7, 9} {
+			expected = append(expected, routeUpdate("10.0.0.1/16", false, idx))
+		}
+		Expect(f.Advance(100*time.Millisecond)).To(Equal(expected), "Updates should be sent in interface index order")
+		f.ExpectQueueDrained()
+	}
+}
+
+func TestUpdateFilter_DampedDeleteStats(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+
+	t.Log("A deletion that is suppressed by a re-add was worth damping.")
+	Expect(f.Send(routeUpdate("10.0.0.1/16", false, 2))).To(BeEmpty())
+	Expect(f.Send(routeUpdate("10.0.0.1/16", true, 2))).To(BeEmpty())
+
+	t.Log("A deletion that is sent anyway was not.")
+	routeDel := routeUpdate("10.0.0.2/16", false, 3)
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(ContainElement(routeDel))
+	f.ExpectQueueDrained()
+
+	stats := f.Filter.Stats()
+	Expect(stats.DampedDeletesUseful).To(Equal(uint64(1)))
+	Expect(stats.DampedDeletesWasted).To(Equal(uint64(1)))
+}
+
+func TestUpdateFilter_FamilyDelay(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithFamilyDelay(unix.AF_INET, 50*time.Millisecond),
+		ifacemonitor.WithFamilyDelay(unix.AF_INET6, 300*time.Millisecond),
+	)
+	Expect(f.Filter.Validate()).To(Succeed())
+
+	v4Del := routeUpdate("10.0.0.1/16", false, 2)
+	v6Del := routeUpdate("fd00::1/64", false, 2)
+	Expect(f.Send(v6Del)).To(BeEmpty())
+	Expect(f.Send(v4Del)).To(BeEmpty())
+
+	t.Log("The IPv4 deletion should be sent after the IPv4 delay, without waiting for the IPv6 one.")
+	Expect(f.Advance(49 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(time.Millisecond)).To(Equal([]interface{}{v4Del}))
+
+	t.Log("The IPv6 deletion should wait for the longer IPv6 delay.")
+	Expect(f.Advance(249 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(time.Millisecond)).To(Equal([]interface{}{v6Del}))
+	f.ExpectQueueDrained()
+
+	t.Log("An unknown family should be rejected.")
+	Expect(ifacemonitor.NewUpdateFilter(ifacemonitor.WithFamilyDelay(unix.AF_UNIX, time.Second)).Validate()).
+		To(MatchError(ContainSubstring("unknown address family")))
+}
+
+func TestUpdateFilter_SecondaryAddrs(t *testing.T) {
+	secondaryAddr := net.ParseIP("10.0.0.2")
+	isSecondary := func(upd netlink.RouteUpdate) bool {
+		return upd.Dst.IP.Equal(secondaryAddr)
+	}
+	primaryDel := routeUpdate("10.0.0.1/16", false, 2)
+	secondaryDel := routeUpdate("10.0.0.2/16", false, 2)
+
+	t.Run("ignore", func(t *testing.T) {
+		RegisterTestingT(t)
+		f := NewManualTestFilter(
+			ifacemonitor.WithSecondaryAddrFunc(isSecondary),
+			ifacemonitor.WithIgnoreSecondary(true),
+		)
+		Expect(f.Filter.Validate()).To(Succeed())
+		Expect(f.Send(primaryDel)).To(BeEmpty())
+		Expect(f.Send(secondaryDel)).To(BeEmpty())
+		Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}), "Only the primary should be queued")
+		Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{primaryDel}))
+		f.ExpectQueueDrained()
+	})
+
+	t.Run("separate delay", func(t *testing.T) {
+		RegisterTestingT(t)
+		f := NewManualTestFilter(
+			ifacemonitor.WithSecondaryAddrFunc(isSecondary),
+			ifacemonitor.WithSeparateSecondaryDelay(300*time.Millisecond),
+		)
+		Expect(f.Filter.Validate()).To(Succeed())
+		Expect(f.Send(primaryDel)).To(BeEmpty())
+		Expect(f.Send(secondaryDel)).To(BeEmpty())
+		Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{primaryDel}))
+		Expect(f.Advance(199 * time.Millisecond)).To(BeEmpty())
+		Expect(f.Advance(time.Millisecond)).To(Equal([]interface{}{secondaryDel}))
+		f.ExpectQueueDrained()
+	})
+
+	t.Run("no secondary function", func(t *testing.T) {
+		RegisterTestingT(t)
+		filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithIgnoreSecondary(true))
+		Expect(filter.Validate()).To(MatchError(ContainSubstring("no secondary address function")))
+	})
+}
+
+func TestUpdateFilter_SuppressTentative(t *testing.T) {
+	tentative := map[string]bool{}
+	isTentative := func(upd netlink.RouteUpdate) bool {
+		return tentative[upd.Dst.String()]
+	}
+	addrAdd := routeUpdate("fd00::1/128", true, 2)
+	addrDel := routeUpdate("fd00::1/128", false, 2)
+
+	t.Run("suppress", func(t *testing.T) {
+		RegisterTestingT(t)
+		f := NewManualTestFilter(
+			ifacemonitor.WithTentativeAddrFunc(isTentative),
+			ifacemonitor.WithSuppressTentative(true),
+		)
+		Expect(f.Filter.Validate()).To(Succeed())
+
+		t.Log("Add of a tentative address should be held back.")
+		tentative["fd00::1/128"] = true
+		Expect(f.Send(addrAdd)).To(BeEmpty())
+		f.ExpectQueueDrained()
+
+		t.Log("Add should be sent once the address passes DAD.")
+		delete(tentative, "fd00::1/128")
+		Expect(f.Send(addrAdd)).To(Equal([]interface{}{addrAdd}))
+
+		t.Log("A tentative re-add shouldn't cancel a pending deletion.")
+		Expect(f.Send(addrDel)).To(BeEmpty())
+		tentative["fd00::1/128"] = true
+		Expect(f.Send(addrAdd)).To(BeEmpty())
+		Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{addrDel}))
+		f.ExpectQueueDrained()
+		delete(tentative, "fd00::1/128")
+	})
+
+	t.Run("pass through", func(t *testing.T) {
+		RegisterTestingT(t)
+		f := NewManualTestFilter(ifacemonitor.WithTentativeAddrFunc(isTentative))
+		tentative["fd00::1/128"] = true
+		defer delete(tentative, "fd00::1/128")
+		Expect(f.Send(addrAdd)).To(Equal([]interface{}{addrAdd}))
+	})
+
+	t.Run("no tentative function", func(t *testing.T) {
+		RegisterTestingT(t)
+		filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithSuppressTentative(true))
+		Expect(filter.Validate()).To(MatchError(ContainSubstring("no tentative address function")))
+	})
+}
+
+func TestUpdateFilter_CircuitBreaker(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithCircuitBreaker(100, 100*time.Millisecond),
+		ifacemonitor.WithFlapDampingDelay(time.Minute),
+	)
+
+	queuedDel := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(queuedDel)).To(BeEmpty())
+
+	t.Log("Driving 1000 updates per second for a window should trip the breaker.")
+	var emitted []interface{}
+	for i := 1; i <= 100; i++ {
+		Expect(f.Filter.Stats().CircuitBreakerOpen).To(BeFalse())
+		f.Advance(time.Millisecond)
+		emitted = append(emitted, f.Send(routeUpdate(fmt.Sprintf("10.1.0.%d/32", i), false, 3))...)
+	}
+	Expect(f.Filter.Stats().CircuitBreakerOpen).To(BeTrue())
+	Expect(emitted).To(HaveLen(101), "Queued updates should be flushed when the breaker trips")
+	Expect(emitted[0]).To(Equal(queuedDel))
+
+	t.Log("While the breaker is open, updates should pass straight through.")
+	routeDel := routeUpdate("10.0.0.2/16", false, 2)
+	Expect(f.Send(routeDel)).To(Equal([]interface{}{routeDel}))
+	f.ExpectQueueDrained()
+
+	t.Log("Once the rate drops, damping should resume.")
+	f.Advance(10 * time.Second)
+	Expect(f.Send(routeUpdate("10.0.0.3/16", false, 2))).To(BeEmpty())
+	Expect(f.Filter.Stats().CircuitBreakerOpen).To(BeFalse())
+}
+
+func TestUpdateFilter_CircuitBreakerWithAllowlist(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithCircuitBreaker(100, 100*time.Millisecond),
+		ifacemonitor.WithFlapDampingDelay(time.Minute),
+		ifacemonitor.WithInterfaceAllowlist(func(ifaceName string) bool {
+			return strings.HasPrefix(ifaceName, "eth")
+		}),
+	)
+	namedLinkUp := func(idx int, name string) netlink.LinkUpdate {
+		upd := linkUpUpdateWithIndex(idx)
+		upd.Link.Attrs().Name = name
+		return upd
+	}
+	Expect(f.Send(namedLinkUp(2, "eth0"))).To(HaveLen(1))
+	Expect(f.Send(namedLinkUp(3, "dummy0"))).To(BeEmpty())
+
+	t.Log("Driving 1000 updates per second for a window should trip the breaker.")
+	for i := 1; i <= 101; i++ {
+		f.Advance(time.Millisecond)
+		f.Send(routeUpdate(fmt.Sprintf("10.1.0.%d/32", i), false, 2))
+	}
+	Expect(f.Filter.Stats().CircuitBreakerOpen).To(BeTrue())
+
+	t.Log("While the breaker is open, allowed interfaces' updates should pass straight through...")
+	routeDel := routeUpdate("10.0.0.2/16", false, 2)
+	Expect(f.Send(routeDel)).To(Equal([]interface{}{routeDel}))
+
+	t.Log("...but the excluded interface's updates should still be dropped.")
+	Expect(f.Send(routeUpdate("10.0.1.1/16", false, 3))).To(BeEmpty())
+	Expect(f.Send(namedLinkUp(3, "dummy0"))).To(BeEmpty())
+
+	t.Log("Interface deletion should be forwarded and clean up the interface's state.")
+	linkDel := linkUpdateWithIndex(3)
+	linkDel.Header.Type = unix.RTM_DELLINK
+	Expect(f.Send(linkDel)).To(Equal([]interface{}{linkDel}))
+	addAfterReuse := routeUpdate("10.0.1.1/16", true, 3)
+	Expect(f.Send(addAfterReuse)).To(Equal([]interface{}{addAfterReuse}),
+		"Index 3 should no longer be ignored after its deletion")
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_InvalidIfaceIndex(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+
+	t.Log("The largest valid index should be handled normally.")
+	routeDel := routeUpdate("10.0.0.1/16", false, math.MaxInt32)
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{math.MaxInt32: 1}))
+
+	t.Log("Updates with invalid indexes should be dropped without touching the queue.")
+	negLink := linkUpdateWithIndex(2)
+	negLink.Index = -1
+	Expect(f.Send(negLink)).To(BeEmpty())
+	Expect(f.Send(routeUpdate("10.0.0.1/16", true, math.MinInt32))).To(BeEmpty())
+	if math.MaxInt > math.MaxInt32 {
+		// Would collide with index math.MaxInt32 if truncated to 32 bits.
+		tooBig := int64(math.MaxUint32) + math.MaxInt32 + 1
+		Expect(f.Send(routeUpdate("10.0.0.1/16", true, int(tooBig)))).To(BeEmpty())
+	}
+	Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{math.MaxInt32: 1}))
+
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{routeDel}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_PendingCIDRs(t *testing.T) {
+	RegisterTestingT(t)
+	filter := ifacemonitor.NewUpdateFilter()
+	start := time.Now()
+	Expect(filter.PendingCIDRs()).To(BeEmpty())
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	filter.FilterOne(start, routeDel)
+	pending := filter.PendingCIDRs()
+	Expect(pending).To(Equal(map[int][]net.IPNet{2: {*routeDel.Dst}}))
+
+	t.Log("Modifying the returned map shouldn't affect the filter.")
+	pending[2] = pending[2][:0]
+	Expect(filter.PendingCIDRs()).To(Equal(map[int][]net.IPNet{2: {*routeDel.Dst}}))
+
+	t.Log("Once the delete is sent, nothing should be pending.")
+	filter.FilterOne(start.Add(100*time.Millisecond), nil)
+	Expect(filter.PendingCIDRs()).To(BeEmpty())
+}
+
+func TestUpdateFilter_TimerJitter(t *testing.T) {
+	RegisterTestingT(t)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimerJitter(10*time.Millisecond),
+		ifacemonitor.WithRandSource(rand.NewSource(42)),
+	)
+	start := time.Now()
+	for idx := 2; idx < 10; idx++ {
+		filter.FilterOne(start, routeUpdate("10.0.0.1/16", false, idx))
+	}
+
+	t.Log("Updates should be released at different times, within the jitter window.")
+	var numReleased []int
+	total := 0
+	for ms := 100; ms < 110; ms++ {
+		emit, _ := filter.FilterOne(start.Add(time.Duration(ms)*time.Millisecond), nil)
+		numReleased = append(numReleased, len(emit))
+		total += len(emit)
+	}
+	Expect(total).To(Equal(8))
+	Expect(numReleased).NotTo(ContainElement(8), "All updates released at once")
+	Expect(filter.QueueSnapshot()).To(BeEmpty())
+}
+
+func TestUpdateFilter_RandSourceReproducible(t *testing.T) {
+	RegisterTestingT(t)
+	releaseTimes := func(seed int64) []int {
+		filter := ifacemonitor.NewUpdateFilter(
+			ifacemonitor.WithTimerJitter(10*time.Millisecond),
+			ifacemonitor.WithRandSource(rand.NewSource(seed)),
+		)
+		start := time.Now()
+		for idx := 2; idx < 10; idx++ {
+			filter.FilterOne(start, routeUpdate("10.0.0.1/16", false, idx))
+		}
+		var times []int
+		for ms := 100; ms < 110; ms++ {
+			emit, _ := filter.FilterOne(start.Add(time.Duration(ms)*time.Millisecond), nil)
+			for _, upd := range emit {
+				times = append(times, upd.(netlink.RouteUpdate).LinkIndex*1000+ms)
+			}
+		}
+		// Updates released at the same time come out in map order.
+		sort.Ints(times)
+		return times
+	}
+
+	t.Log("Two filters with the same seed should release the same updates at the same times.")
+	Expect(releaseTimes(42)).To(Equal(releaseTimes(42)))
+	Expect(releaseTimes(42)).To(HaveLen(8))
+}
+
+func TestUpdateFilter_DebugEventChan(t *testing.T) {
+	RegisterTestingT(t)
+	eventC := make(chan ifacemonitor.SuppressionEvent, 2)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithDebugEventChan(eventC))
+	start := time.Now()
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	filter.FilterOne(start, routeDel)
+	Expect(eventC).To(Receive(Equal(ifacemonitor.SuppressionEvent{
+		IfaceIdx:   2,
+		Addr:       routeDel.Dst,
+		Kind:       ifacemonitor.SuppressionKindDelayed,
+		OldReadyAt: start.Add(100 * time.Millisecond),
+	})))
+
+	t.Log("Re-adding the address should squash the delete.")
+	filter.FilterOne(start.Add(10*time.Millisecond), routeUpdate("10.0.0.1/16", true, 2))
+	Expect(eventC).To(Receive(Equal(ifacemonitor.SuppressionEvent{
+		IfaceIdx:   2,
+		Addr:       routeDel.Dst,
+		Kind:       ifacemonitor.SuppressionKindSquashed,
+		OldReadyAt: start.Add(100 * time.Millisecond),
+	})))
+
+	t.Log("Events should be dropped rather than blocking when the channel is full.")
+	for idx := 3; idx < 10; idx++ {
+		filter.FilterOne(start, linkUpdateWithIndex(idx))
+	}
+	Expect(eventC).To(HaveLen(2))
+}
+
+func TestUpdateFilter_FilterUpdates_SendTimeout(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Output channels are never read.
+	routeIn := make(chan netlink.RouteUpdate)
+	linkIn := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ifacemonitor.FilterUpdates(ctx, make(chan netlink.RouteUpdate), routeIn,
+			make(chan netlink.LinkUpdate), linkIn,
+			ifacemonitor.WithSendTimeout(10*time.Millisecond))
+	}()
+
+	t.Log("Filter should keep accepting input even though nothing is reading its output.")
+	for idx := 2; idx < 5; idx++ {
+		Eventually(routeIn, "1s").Should(BeSent(routeUpdate("10.0.0.1/16", true, idx)))
+	}
+	Eventually(linkIn, "1s").Should(BeSent(linkUpdateWithIndex(5)))
+
+	cancel()
+	Eventually(done, "1s").Should(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_RequeueOnSendTimeout(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate)
+	routeOut := make(chan netlink.RouteUpdate)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithSendTimeout(10*time.Millisecond),
+		ifacemonitor.WithRequeueOnSendTimeout())
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate), make(chan netlink.LinkUpdate))
+
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- routeAdd
+	t.Log("Update should be re-queued when the send times out.")
+	// The only timer that the idle filter arms is the send timeout.
+	Eventually(mockTime.HasTimers, "1s", chanPollIntvl).Should(BeTrue())
+	mockTime.IncrementTime(10 * time.Millisecond)
+	Eventually(filter.QueueSnapshot, "1s", chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+
+	t.Log("Update should be retried once the consumer starts reading.")
+	mockTime.IncrementTime(10 * time.Millisecond)
+	Eventually(routeOut, "1s", chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Eventually(filter.QueueSnapshot, "1s", chanPollIntvl).Should(BeEmpty())
+}
+
+func TestUpdateFilter_DelayAdds(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithDelayAdds(20 * time.Millisecond))
+
+	t.Log("Add should be delayed even though the queue is empty.")
+	newAddr := routeUpdate("10.0.0.2/16", true, 2)
+	Expect(f.Send(newAddr)).To(BeEmpty())
+
+	t.Log("Delete of the old address should be queued behind the add.")
+	oldAddr := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(oldAddr)).To(BeEmpty())
+
+	Expect(f.Advance(20 * time.Millisecond)).To(Equal([]interface{}{newAddr}))
+	Expect(f.Advance(80 * time.Millisecond)).To(Equal([]interface{}{oldAddr}))
+	f.ExpectQueueDrained()
+
+	t.Log("Delete followed by add of the same address should coalesce into the add.")
+	Expect(f.Send(routeUpdate("10.0.0.3/16", false, 3))).To(BeEmpty())
+	readd := routeUpdate("10.0.0.3/16", true, 3)
+	Expect(f.Send(readd)).To(BeEmpty())
+	Expect(f.Advance(20 * time.Millisecond)).To(Equal([]interface{}{readd}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_DoubleDelete(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+
+	t.Log("A second delete of a queued delete should be flagged but only one delete forwarded.")
+	del1 := routeUpdate("10.0.0.1/16", false, 2)
+	del2 := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(del1)).To(BeEmpty())
+	Expect(f.Advance(50 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Send(del2)).To(BeEmpty())
+	Expect(f.Filter.Stats().DoubleDeletes).To(BeEquivalentTo(1))
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{del2}))
+	f.ExpectQueueDrained()
+
+	t.Log("A genuine flap shouldn't be flagged.")
+	Expect(f.Send(routeUpdate("10.0.0.2/16", false, 2))).To(BeEmpty())
+	readd := routeUpdate("10.0.0.2/16", true, 2)
+	Expect(f.Send(readd)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{readd}))
+	Expect(f.Filter.Stats().DoubleDeletes).To(BeEquivalentTo(1))
+}
+
+func TestUpdateFilter_CollapseReAdds(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithCollapseReAdds())
+
+	t.Log("An add->del->add sequence should result in a single add.")
+	add := routeUpdate("10.0.0.1/16", true, 2)
+	var out []interface{}
+	out = append(out, f.Send(add)...)
+	out = append(out, f.Send(routeUpdate("10.0.0.1/16", false, 2))...)
+	out = append(out, f.Send(routeUpdate("10.0.0.1/16", true, 2))...)
+	out = append(out, f.Advance(100*time.Millisecond)...)
+	Expect(out).To(Equal([]interface{}{add}))
+	f.ExpectQueueDrained()
+
+	t.Log("Once the deletion has been sent, a re-add should be sent as normal.")
+	del := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(del)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{del}))
+	Expect(f.Send(add)).To(Equal([]interface{}{add}))
+
+	t.Log("A del->add sequence for an address that was never sent should still send the add.")
+	add2 := routeUpdate("10.0.0.2/16", true, 2)
+	Expect(f.Send(routeUpdate("10.0.0.2/16", false, 2))).To(BeEmpty())
+	Expect(f.Send(add2)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{add2}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_InitialDumpCount(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithInitialDumpCount(3))
+	Expect(f.Filter.Primed()).To(BeFalse())
+
+	t.Log("During the dump, a racing delete shouldn't be damped or hold back the adds.")
+	addA := routeUpdate("10.0.0.1/16", true, 2)
+	delX := routeUpdate("10.0.0.9/16", false, 2)
+	addB := routeUpdate("10.0.0.2/16", true, 2)
+	Expect(f.Send(addA)).To(Equal([]interface{}{addA}))
+	Expect(f.Send(delX)).To(Equal([]interface{}{delX}))
+	Expect(f.Send(addB)).To(Equal([]interface{}{addB}))
+	f.ExpectQueueDrained()
+	Expect(f.Filter.Primed()).To(BeTrue())
+
+	t.Log("After the dump, flaps should be damped as normal.")
+	delA := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(delA)).To(BeEmpty())
+	Expect(f.Send(addA)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{addA}))
+	Expect(f.Send(delA)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{delA}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_StartupComplete(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithInitialDumpCount(1000))
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	t.Log("Before startup is complete, deletes should be sent straight away.")
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- routeDel
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+
+	t.Log("After startup is complete, deletes should be damped.")
+	filter.StartupComplete()
+	Eventually(filter.Primed, chanPollTime, chanPollIntvl).Should(BeTrue())
+	routeIn <- routeUpdate("10.0.0.2/16", false, 2)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestUpdateFilter_LinkFlagFilter(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithLinkFlagFilter(0))
+	linkWithFlags := func(flags uint32) netlink.LinkUpdate {
+		upd := linkUpUpdateWithIndex(2)
+		upd.Link.Attrs().Name = "eth0"
+		upd.Link.Attrs().RawFlags = flags
+		return upd
+	}
+	sendAndWait := func(upd netlink.LinkUpdate) []interface{} {
+		return append(f.Send(upd), f.Advance(100*time.Millisecond)...)
+	}
+
+	t.Log("The first update for an interface should be sent.")
+	up := linkWithFlags(unix.IFF_UP | unix.IFF_LOWER_UP | unix.IFF_RUNNING)
+	Expect(sendAndWait(up)).To(Equal([]interface{}{up}))
+
+	t.Log("Updates that only flip IFF_RUNNING should be dropped.")
+	Expect(sendAndWait(linkWithFlags(unix.IFF_UP | unix.IFF_LOWER_UP))).To(BeEmpty())
+	Expect(sendAndWait(linkWithFlags(unix.IFF_UP | unix.IFF_LOWER_UP | unix.IFF_RUNNING))).To(BeEmpty())
+	f.ExpectQueueDrained()
+
+	t.Log("Losing carrier should be sent.")
+	noCarrier := linkWithFlags(unix.IFF_UP)
+	Expect(sendAndWait(noCarrier)).To(Equal([]interface{}{noCarrier}))
+
+	t.Log("A rename should be sent even if the flags are unchanged.")
+	renamed := linkWithFlags(unix.IFF_UP)
+	renamed.Link.Attrs().Name = "eth1"
+	Expect(sendAndWait(renamed)).To(Equal([]interface{}{renamed}))
+
+	t.Log("A deletion should be sent and forget the interface's flags.")
+	del := linkWithFlags(unix.IFF_UP)
+	del.Header.Type = unix.RTM_DELLINK
+	Expect(sendAndWait(del)).To(Equal([]interface{}{del}))
+	Expect(sendAndWait(noCarrier)).To(Equal([]interface{}{noCarrier}))
+}
+
+func TestUpdateFilter_LinkFlagFilterWithRunning(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithLinkFlagFilter(ifacemonitor.DefaultLinkFlagMask | unix.IFF_RUNNING))
+	linkWithFlags := func(flags uint32) netlink.LinkUpdate {
+		upd := linkUpUpdateWithIndex(2)
+		upd.Link.Attrs().Name = "eth0"
+		upd.Link.Attrs().RawFlags = flags
+		return upd
+	}
+	sendAndWait := func(upd netlink.LinkUpdate) []interface{} {
+		return append(f.Send(upd), f.Advance(100*time.Millisecond)...)
+	}
+
+	up := linkWithFlags(unix.IFF_UP | unix.IFF_LOWER_UP | unix.IFF_RUNNING)
+	Expect(sendAndWait(up)).To(Equal([]interface{}{up}))
+
+	t.Log("With IFF_RUNNING in the mask, updates that only flip it should be sent.")
+	notRunning := linkWithFlags(unix.IFF_UP | unix.IFF_LOWER_UP)
+	Expect(sendAndWait(notRunning)).To(Equal([]interface{}{notRunning}))
+	Expect(ifacemonitor.LinkIsOperUp(notRunning.Link)).To(BeFalse())
+	Expect(sendAndWait(up)).To(Equal([]interface{}{up}))
+	Expect(ifacemonitor.LinkIsOperUp(up.Link)).To(BeTrue())
+
+	t.Log("Repeating the same flags should still be dropped.")
+	Expect(sendAndWait(linkWithFlags(unix.IFF_UP | unix.IFF_LOWER_UP | unix.IFF_RUNNING))).To(BeEmpty())
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_InterfaceGrouping(t *testing.T) {
+	RegisterTestingT(t)
+	// Group each workload's host-side "cali" interface with its "veth" peer.
+	f := NewManualTestFilter(ifacemonitor.WithInterfaceGrouping(func(name string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(name, "cali"), "veth")
+	}))
+	for idx, name := range map[int]string{2: "cali1234", 3: "veth1234"} {
+		link := linkUpUpdateWithIndex(idx)
+		link.Link.Attrs().Name = name
+		Expect(f.Send(link)).To(Equal([]interface{}{link}))
+	}
+
+	t.Log("A ready delete should wait for the rest of its group.")
+	delA := routeUpdate("10.0.0.1/32", false, 2)
+	delB := routeUpdate("10.0.0.2/32", false, 3)
+	Expect(f.Send(delA)).To(BeEmpty())
+	Expect(f.Advance(50 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Send(delB)).To(BeEmpty())
+	Expect(f.Advance(50 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(50 * time.Millisecond)).To(ConsistOf(delA, delB))
+	f.ExpectQueueDrained()
+
+	t.Log("When the pair flaps in lockstep, the re-adds should be sent together.")
+	addA := routeUpdate("10.0.0.1/32", true, 2)
+	addB := routeUpdate("10.0.0.2/32", true, 3)
+	Expect(f.Send(delA)).To(BeEmpty())
+	Expect(f.Send(delB)).To(BeEmpty())
+	Expect(f.Advance(20 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Send(addA)).To(BeEmpty())
+	Expect(f.Advance(20 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Send(addB)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(ConsistOf(addA, addB))
+	f.ExpectQueueDrained()
+
+	t.Log("While the group has a flap in progress, an add shouldn't skip the queue.")
+	addC := routeUpdate("10.0.0.3/32", true, 3)
+	Expect(f.Send(delA)).To(BeEmpty())
+	Expect(f.Send(addC)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(ConsistOf(delA, addC))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_StartupGracePeriod(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithStartupGracePeriod(time.Second))
+	go filter.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn)
+
+	t.Log("During the grace period, updates should be held and coalesced.")
+	linkIn <- linkUpdateWithIndex(2)
+	link := linkUpUpdateWithIndex(2)
+	linkIn <- link
+	add1 := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- add1
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- add1
+	add2 := routeUpdate("10.0.0.2/16", true, 3)
+	routeIn <- add2
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 2, 3: 1}))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(linkOut).NotTo(Receive())
+
+	t.Log("When the grace period ends, the final states should be sent.")
+	mockTime.IncrementTime(time.Second)
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(link)))
+	var released []netlink.RouteUpdate
+	for i := 0; i < 2; i++ {
+		var upd netlink.RouteUpdate
+		Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(&upd))
+		released = append(released, upd)
+	}
+	Expect(released).To(ConsistOf(add1, add2))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(linkOut).NotTo(Receive())
+
+	t.Log("After the grace period, adds should be sent straight away.")
+	add3 := routeUpdate("10.0.0.3/16", true, 3)
+	routeIn <- add3
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(add3)))
+}
+
+func TestUpdateFilter_InterfaceSettledCallback(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	type settledEvent struct {
+		idx        int
+		numPending int
+	}
+	settledC := make(chan settledEvent, 10)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithInterfaceSettledCallback(func(idx int) {
+			settledC <- settledEvent{idx: idx, numPending: len(routeOut)}
+		}))
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	t.Log("While a flap is in progress, the interface shouldn't be settled.")
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- routeDel
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+	Consistently(settledC, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Once the flap resolves, the callback should fire after the add has been sent.")
+	routeIn <- routeAdd
+	Eventually(filter.PendingCIDRs, chanPollTime, chanPollIntvl).Should(BeEmpty())
+	Consistently(settledC, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(settledC, chanPollTime, chanPollIntvl).Should(Receive(Equal(settledEvent{idx: 2, numPending: 1})))
+	Expect(routeOut).To(Receive(Equal(routeAdd)))
+
+	t.Log("A deletion that is sent when the timer pops should settle the interface too.")
+	routeIn <- routeDel
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(settledC, chanPollTime, chanPollIntvl).Should(Receive(Equal(settledEvent{idx: 2, numPending: 1})))
+	Expect(routeOut).To(Receive(Equal(routeDel)))
+	Consistently(settledC, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestUpdateFilter_InjectForTest(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, routeOut, make(chan netlink.RouteUpdate),
+		linkOut, make(chan netlink.LinkUpdate))
+
+	t.Log("Injected updates should be damped like updates from the input channels.")
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(filter.InjectForTest(ctx, routeDel)).To(Succeed())
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+
+	linkUp := linkUpUpdateWithIndex(3)
+	Expect(filter.InjectForTest(ctx, linkUp)).To(Succeed())
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkUp)))
+
+	t.Log("Other types should be rejected.")
+	Expect(filter.InjectForTest(ctx, "unknown")).To(MatchError(ContainSubstring("unsupported update type")))
+}
+
+func TestUpdateFilter_InjectForTestNotRunning(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	filter := ifacemonitor.NewUpdateFilter()
+	resultC := make(chan error, 1)
+	go func() {
+		resultC <- filter.FilterUpdates(ctx,
+			make(chan netlink.RouteUpdate, 10), make(chan netlink.RouteUpdate),
+			make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate))
+	}()
+	cancel()
+	Eventually(resultC, chanPollTime, chanPollIntvl).Should(Receive())
+
+	t.Log("Injecting into a stopped filter should fail rather than block.")
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	for i := 0; i < 20; i++ {
+		Expect(filter.InjectForTest(context.Background(), routeDel)).To(MatchError("filter has stopped"))
+	}
+
+	t.Log("Injecting into a filter that never starts should fail once the context is done.")
+	filter = ifacemonitor.NewUpdateFilter()
+	injectCtx, injectCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer injectCancel()
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		err = filter.InjectForTest(injectCtx, routeDel)
+	}
+	Expect(err).To(MatchError(context.DeadlineExceeded))
+}
+
+func TestUpdateFilter_InjectForTestDampingDisabled(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithDampingEnabled(false))
+	go filter.FilterUpdates(ctx, routeOut, make(chan netlink.RouteUpdate),
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate))
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(filter.InjectForTest(ctx, routeDel)).To(Succeed())
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+}
+
+func TestUpdateFilter_FilterUpdatesWithGenerations(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	outC := make(chan ifacemonitor.GenerationUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdatesWithGenerations(ctx, outC, routeIn, linkIn)
+	Expect(filter.Generation()).To(BeZero())
+
+	linkIn <- linkUpUpdateWithIndex(2)
+	routeIn <- routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- routeUpdate("10.0.0.2/16", false, 3)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{3: 1}))
+	mockTime.IncrementTime(100 * time.Millisecond)
+
+	t.Log("Generations should be strictly increasing, with no gaps.")
+	var gens []uint64
+	var upds []interface{}
+	for i := 0; i < 3; i++ {
+		var gu ifacemonitor.GenerationUpdate
+		Eventually(outC, chanPollTime, chanPollIntvl).Should(Receive(&gu))
+		gens = append(gens, gu.Generation)
+		upds = append(upds, gu.Update)
+	}
+	Expect(gens).To(Equal([]uint64{1, 2, 3}))
+	// The link and route updates arrive on different channels so their order isn't defined.
+	Expect(upds).To(ConsistOf(
+		linkUpUpdateWithIndex(2),
+		routeUpdate("10.0.0.1/16", true, 2),
+		routeUpdate("10.0.0.2/16", false, 3),
+	))
+	Expect(filter.Generation()).To(Equal(uint64(3)))
+}
+
+func TestUpdateFilter_StopAndDrain(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	errC := make(chan error, 1)
+	go func() {
+		errC <- filter.FilterUpdates(ctx, routeOut, routeIn,
+			make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+	}()
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- routeDel
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+
+	t.Log("StopAndDrain should time out while the delete is still damped.")
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer stopCancel()
+	Expect(filter.StopAndDrain(stopCtx)).To(MatchError(context.DeadlineExceeded))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Updates that arrive after the stop request should be left unread.")
+	routeIn <- routeUpdate("10.0.0.2/16", true, 3)
+
+	t.Log("Once the delete is ready, it should be sent and the filter should stop.")
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+	Eventually(errC, chanPollTime, chanPollIntvl).Should(Receive(BeNil()))
+	Expect(filter.StopAndDrain(context.Background())).To(Succeed())
+	Expect(routeIn).To(HaveLen(1))
+	Expect(routeOut).NotTo(Receive())
+}
+
+func TestUpdateFilter_StopAndDrainForced(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithForcedDrainOnStop(),
+	)
+	filter.Pause()
+	errC := make(chan error, 1)
+	go func() {
+		errC <- filter.FilterUpdates(ctx, routeOut, routeIn,
+			make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+	}()
+
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeDel := routeUpdate("10.0.0.2/16", false, 3)
+	routeIn <- routeAdd
+	routeIn <- routeDel
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{3: 1}))
+
+	t.Log("A forced drain should resume the filter and send the delete without waiting for the timer.")
+	Expect(filter.StopAndDrain(context.Background())).To(Succeed())
+	Eventually(errC, chanPollTime, chanPollIntvl).Should(Receive(BeNil()))
+	var upds []netlink.RouteUpdate
+	for len(routeOut) > 0 {
+		upds = append(upds, <-routeOut)
+	}
+	Expect(upds).To(Equal([]netlink.RouteUpdate{routeAdd, routeDel}))
+}
+
+func TestUpdateFilter_PauseResume(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	filter.Pause()
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	t.Log("While paused, updates should be queued but nothing sent.")
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeDel := routeUpdate("10.0.0.2/16", false, 3)
+	routeIn <- routeAdd
+	routeIn <- routeDel
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{3: 1}))
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("On resume, the held and ready updates should be sent in order.")
+	filter.Resume()
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(BeEmpty())
+
+	t.Log("After resuming, updates should flow as normal.")
+	routeAdd2 := routeUpdate("10.0.0.3/16", true, 2)
+	routeIn <- routeAdd2
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+}
+
+func TestUpdateFilter_FreezeChan(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	// Unbuffered, so that each send returns once the filter has read it.
+	freezeC := make(chan bool)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithFreezeChan(freezeC),
+	)
+	filter.Pause()
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+	freezeC <- true
+
+	t.Log("While frozen, updates should be queued but nothing sent.")
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeDel := routeUpdate("10.0.0.2/16", false, 3)
+	routeIn <- routeAdd
+	routeIn <- routeDel
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{3: 1}))
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Resuming shouldn't send anything while still frozen.")
+	filter.Resume()
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("On thaw, the held and ready updates should be sent in order.")
+	freezeC <- false
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel)))
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(BeEmpty())
+
+	t.Log("Closing the channel should thaw the filter.")
+	freezeC <- true
+	routeAdd2 := routeUpdate("10.0.0.3/16", true, 2)
+	routeIn <- routeAdd2
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	close(freezeC)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+}
+
+func TestUpdateFilter_Tap(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tapped := make(chan interface{}, 10)
+	unblockTap := make(chan struct{})
+	defer close(unblockTap)
+	tap := func(upd interface{}) {
+		tapped <- upd
+		switch upd.(netlink.RouteUpdate).Dst.String() {
+		case "10.0.0.0/16":
+			panic("bad tap")
+		case "10.1.0.0/16":
+			<-unblockTap
+		}
+	}
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10),
+		ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithTap(tap))
+
+	t.Log("The tap should see emitted updates and a panic from the tap should be ignored.")
+	add1 := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- add1
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(add1)))
+	Eventually(tapped, chanPollTime, chanPollIntvl).Should(Receive(Equal(add1)))
+
+	t.Log("The tap shouldn't see suppressed updates.")
+	routeIn <- routeUpdate("10.2.0.1/16", false, 3)
+	Consistently(tapped, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("A stalled tap shouldn't hold up the output.")
+	add2 := routeUpdate("10.1.0.1/16", true, 2)
+	routeIn <- add2
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(add2)))
+	Eventually(tapped, chanPollTime, chanPollIntvl).Should(Receive(Equal(add2)))
+	add3 := routeUpdate("10.0.0.3/16", true, 2)
+	routeIn <- add3
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(add3)))
+}
+
+func TestUpdateFilter_FlushInterface(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mocktime.New()))
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	routeDel2 := routeUpdate("10.0.0.1/16", false, 2)
+	routeDel3 := routeUpdate("10.0.0.2/16", false, 3)
+	routeIn <- routeDel2
+	routeIn <- routeDel3
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1, 3: 1}))
+
+	t.Log("Flushing an interface should send its updates without waiting for time to pass.")
+	filter.FlushInterface(2)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeDel2)))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(filter.QueueSnapshot()).To(Equal(map[int]int{3: 1}))
+}
+
+func TestUpdateFilter_SetInterfaceMode(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mocktime.New()))
+	go filter.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn)
+	Expect(filter.ModeForInterface(2)).To(Equal(ifacemonitor.InterfaceModeDamped))
+
+	queuedDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- queuedDel
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+
+	t.Log("Damped -> pass-through: new updates should bypass the queue, queued ones should stay queued.")
+	Expect(filter.SetInterfaceMode(2, ifacemonitor.InterfaceModePassThrough)).To(Succeed())
+	Eventually(func() ifacemonitor.InterfaceMode { return filter.ModeForInterface(2) },
+		chanPollTime, chanPollIntvl).Should(Equal(ifacemonitor.InterfaceModePassThrough))
+	passedDel := routeUpdate("10.0.0.2/16", false, 2)
+	routeIn <- passedDel
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(passedDel)))
+	linkDown := linkUpdateWithIndex(2)
+	linkIn <- linkDown
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkDown)))
+	Expect(filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}))
+
+	t.Log("Pass-through -> dropped: new updates should be dropped.")
+	Expect(filter.SetInterfaceMode(2, ifacemonitor.InterfaceModeDropped)).To(Succeed())
+	Eventually(func() ifacemonitor.InterfaceMode { return filter.ModeForInterface(2) },
+		chanPollTime, chanPollIntvl).Should(Equal(ifacemonitor.InterfaceModeDropped))
+	routeIn <- routeUpdate("10.0.0.3/16", false, 2)
+	linkIn <- linkUpUpdateWithIndex(2)
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Consistently(linkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}))
+
+	t.Log("Dropped -> damped: new updates should be queued again.")
+	Expect(filter.SetInterfaceMode(2, ifacemonitor.InterfaceModeDamped)).To(Succeed())
+	Eventually(func() ifacemonitor.InterfaceMode { return filter.ModeForInterface(2) },
+		chanPollTime, chanPollIntvl).Should(Equal(ifacemonitor.InterfaceModeDamped))
+	routeIn <- routeUpdate("10.0.0.4/16", false, 2)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 2}))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Damped -> dropped -> pass-through, then deleting the interface should reset its mode.")
+	Expect(filter.SetInterfaceMode(3, ifacemonitor.InterfaceModeDropped)).To(Succeed())
+	Expect(filter.SetInterfaceMode(3, ifacemonitor.InterfaceModePassThrough)).To(Succeed())
+	Eventually(func() ifacemonitor.InterfaceMode { return filter.ModeForInterface(3) },
+		chanPollTime, chanPollIntvl).Should(Equal(ifacemonitor.InterfaceModePassThrough))
+	routeAdd3 := routeUpdate("10.0.1.1/16", true, 3)
+	routeIn <- routeAdd3
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd3)))
+	linkDel3 := linkUpdateWithIndex(3)
+	linkDel3.Header.Type = unix.RTM_DELLINK
+	linkIn <- linkDel3
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkDel3)))
+	Expect(filter.ModeForInterface(3)).To(Equal(ifacemonitor.InterfaceModeDamped))
+}
+
+func TestUpdateFilter_SetInterfaceModeUnknown(t *testing.T) {
+	RegisterTestingT(t)
+	filter := ifacemonitor.NewUpdateFilter()
+	Expect(filter.SetInterfaceMode(2, "bogus")).To(MatchError(ContainSubstring("unknown interface mode")))
+	Expect(filter.ModeForInterface(2)).To(Equal(ifacemonitor.InterfaceModeDamped))
+}
+
+func TestUpdateFilter_LinkAndAddrOrdering(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+
+	delA := routeUpdate("10.0.0.1/16", false, 2)
+	linkDown := linkUpdateWithIndex(2)
+	delB := routeUpdate("10.0.0.2/16", false, 2)
+	addA := routeUpdate("10.0.0.1/16", true, 2)
+	linkUp := linkUpUpdateWithIndex(2)
+	for _, upd := range []interface{}{delA, linkDown, delB, addA, linkUp} {
+		Expect(f.Send(upd)).To(BeEmpty())
+		f.Advance(10 * time.Millisecond)
+	}
+
+	t.Log("Updates should be emitted in input order, less the squashed delA and linkDown.")
+	Expect(f.Advance(70 * time.Millisecond)).To(Equal([]interface{}{delB, addA, linkUp}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_WithLogger(t *testing.T) {
+	RegisterTestingT(t)
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithLogger(logger.WithField("test", "logger")))
+
+	filter.FilterOne(time.Now(), routeUpdate("10.0.0.1/16", false, 2))
+	Expect(hook.AllEntries()).NotTo(BeEmpty())
+	for _, e := range hook.AllEntries() {
+		Expect(e.Data).To(HaveKeyWithValue("test", "logger"))
+	}
+}
+
+func TestUpdateFilter_PassSummaryLogging(t *testing.T) {
+	RegisterTestingT(t)
+	logger, hook := logtest.NewNullLogger()
+	f := NewManualTestFilter(
+		ifacemonitor.WithLogger(logrus.NewEntry(logger)),
+		ifacemonitor.WithPassSummaryLogging(true),
+	)
+	start := f.Now()
+
+	f.Send(routeUpdate("10.0.0.1/16", false, 2))
+	f.Send(routeUpdate("10.0.0.2/16", false, 3))
+	f.Advance(50 * time.Millisecond)
+	f.Send(routeUpdate("10.0.0.3/16", false, 3))
+	Expect(hook.AllEntries()).To(BeEmpty(), "Only timer-driven passes should be summarised")
+
+	Expect(f.Advance(50 * time.Millisecond)).To(HaveLen(2))
+	Expect(hook.AllEntries()).To(HaveLen(1))
+	e := hook.LastEntry()
+	Expect(e.Level).To(Equal(logrus.InfoLevel))
+	Expect(e.Message).To(Equal(ifacemonitor.LogMsgPassSummary))
+	Expect(e.Data).To(And(
+		HaveKeyWithValue("numEmitted", 2),
+		HaveKeyWithValue("numQueued", 1),
+		HaveKeyWithValue("numIfacesTouched", 2),
+		HaveKeyWithValue("nextWake", start.Add(150*time.Millisecond)),
+	))
+}
+
+func TestUpdateFilter_DecisionLogs(t *testing.T) {
+	RegisterTestingT(t)
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	f := NewManualTestFilter(
+		ifacemonitor.WithLogger(logger.WithField("test", "logger")),
+		ifacemonitor.WithMaxQueueDepth(2),
+	)
+	start := f.Now()
+
+	// decisionLogs returns the fields of the decision logs with the given message, dropping the
+	// fields that vary between entries.
+	decisionLogs := func(msg string) []logrus.Fields {
+		var fields []logrus.Fields
+		for _, e := range hook.AllEntries() {
+			if e.Message != msg {
+				continue
+			}
+			Expect(e.Data).To(HaveKey("ifaceIdx"))
+			Expect(e.Data).To(HaveKey("addr"))
+			Expect(e.Data).To(HaveKey("decision"))
+			Expect(e.Data).To(HaveKey("readyAt"))
+			Expect(e.Data).To(HaveKey("queueDepth"))
+			fields = append(fields, logrus.Fields{
+				"addr":       e.Data["addr"],
+				"decision":   e.Data["decision"],
+				"readyAt":    e.Data["readyAt"],
+				"queueDepth": e.Data["queueDepth"],
+			})
+		}
+		return fields
+	}
+
+	f.Send(routeUpdate("10.0.0.1/16", false, 2))
+	f.Send(routeUpdate("10.0.0.1/16", true, 2))
+	Expect(decisionLogs(ifacemonitor.LogMsgDelay)).To(Equal([]logrus.Fields{{
+		"addr":       "10.0.0.1/16",
+		"decision":   ifacemonitor.DecisionDelay,
+		"readyAt":    start.Add(100 * time.Millisecond),
+		"queueDepth": 0,
+	}}))
+	Expect(decisionLogs(ifacemonitor.LogMsgSquash)).To(Equal([]logrus.Fields{{
+		"addr":       "10.0.0.1/16",
+		"decision":   ifacemonitor.DecisionSquash,
+		"readyAt":    start.Add(100 * time.Millisecond),
+		"queueDepth": 1,
+	}}))
+
+	f.Send(routeUpdate("10.0.0.2/16", false, 2))
+	f.Send(routeUpdate("10.0.0.3/16", false, 2))
+	Expect(decisionLogs(ifacemonitor.LogMsgOverflow)).To(Equal([]logrus.Fields{{
+		"addr":       "10.0.0.1/16",
+		"decision":   ifacemonitor.DecisionOverflow,
+		"readyAt":    start,
+		"queueDepth": 3,
+	}}))
+	Expect(decisionLogs(ifacemonitor.LogMsgEmit)).To(Equal([]logrus.Fields{{
+		"addr":       "10.0.0.1/16",
+		"decision":   ifacemonitor.DecisionEmit,
+		"readyAt":    start,
+		"queueDepth": 2,
+	}}))
+}
+
+func TestUpdateFilter_NetlinkHeaderLogging(t *testing.T) {
+	RegisterTestingT(t)
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	f := NewManualTestFilter(
+		ifacemonitor.WithLogger(logrus.NewEntry(logger)),
+		ifacemonitor.WithNetlinkHeaderLogging(),
+	)
+
+	// ingressIDs returns the ingress IDs logged with the given message, in order.
+	ingressIDs := func(msg string) []interface{} {
+		var ids []interface{}
+		for _, e := range hook.AllEntries() {
+			if e.Message == msg {
+				ids = append(ids, e.Data["ingressID"])
+			}
+		}
+		return ids
+	}
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeAdd := routeUpdate("10.0.0.2/16", true, 2)
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Send(routeAdd)).To(BeEmpty())
+	Expect(ingressIDs(ifacemonitor.LogMsgDelay)).To(Equal([]interface{}{uint64(1)}))
+
+	t.Log("Queued updates should be logged with their own IDs when they're emitted.")
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{routeDel, routeAdd}))
+	Expect(ingressIDs(ifacemonitor.LogMsgEmit)).To(Equal([]interface{}{uint64(1), uint64(2)}))
+
+	t.Log("Link updates should also be logged with their netlink header.")
+	hook.Reset()
+	linkUp := linkUpUpdateWithIndex(3)
+	linkUp.Header.Seq = 42
+	linkUp.Header.Pid = 7
+	Expect(f.Send(linkUp)).To(Equal([]interface{}{linkUp}))
+	Expect(hook.LastEntry().Message).To(Equal(ifacemonitor.LogMsgEmit))
+	Expect(hook.LastEntry().Data).To(And(
+		HaveKeyWithValue("ingressID", uint64(3)),
+		HaveKeyWithValue("nlSeq", uint32(42)),
+		HaveKeyWithValue("nlPid", uint32(7)),
+	))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_RecordAndReplay(t *testing.T) {
+	RegisterTestingT(t)
+	var capture bytes.Buffer
+	f := NewManualTestFilter(ifacemonitor.WithRecorder(&capture))
+
+	linkUp := linkUpUpdateWithIndex(2)
+	linkUp.Link.Attrs().Name = "eth0"
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	f.Send(linkUp)
+	f.Send(routeDel)
+	f.Advance(30 * time.Millisecond)
+	f.Send(routeAdd)
+
+	upds, err := ifacemonitor.LoadCapture(bytes.NewReader(capture.Bytes()))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(upds).To(Equal([]ifacemonitor.CapturedUpdate{
+		{Time: mocktime.StartTime, Update: linkUp},
+		{Time: mocktime.StartTime, Update: routeDel},
+		{Time: mocktime.StartTime.Add(30 * time.Millisecond), Update: routeAdd},
+	}))
+
+	t.Log("Replaying the capture should reproduce the squash.")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn)
+	Expect(ifacemonitor.ReplayCapture(ctx, upds, mockTime, 10, routeIn, linkIn)).To(Succeed())
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(HaveField("SuppressedFlaps", BeEquivalentTo(1)))
+	Expect(linkOut).To(Receive(Equal(linkUp)))
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestLoadCapture_UnsupportedVersion(t *testing.T) {
+	RegisterTestingT(t)
+	_, err := ifacemonitor.LoadCapture(strings.NewReader(`{"version":99}` + "\n"))
+	Expect(err).To(MatchError(ContainSubstring("unsupported capture version 99")))
+}
+
+func TestBatchingUpdateFilter_FilterUpdates(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan []netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	linkOut := make(chan []netlink.LinkUpdate, 10)
+	filter := ifacemonitor.NewBatchingUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn)
+
+	t.Log("Updates that don't need to be delayed should be sent in a batch of one.")
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- routeAdd
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal([]netlink.RouteUpdate{routeAdd})))
+
+	t.Log("Updates that become ready together should be sent together.")
+	var routeDels []netlink.RouteUpdate
+	for idx := 2; idx < 5; idx++ {
+		routeDel := routeUpdate("10.0.0.1/16", false, idx)
+		routeDels = append(routeDels, routeDel)
+		routeIn <- routeDel
+	}
+	linkIn <- linkUpdateWithIndex(5)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(HaveLen(4))
+	mockTime.IncrementTime(100 * time.Millisecond)
+
+	var batch []netlink.RouteUpdate
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(&batch))
+	Expect(batch).To(ConsistOf(routeDels))
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(HaveLen(1)))
+}
+
+func TestSnapshotUpdateFilter_FilterUpdates(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	snapOut := make(chan ifacemonitor.LinkAddrSnapshot, 10)
+	filter := ifacemonitor.NewSnapshotUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, snapOut, routeIn, linkIn)
+
+	t.Log("Each update that's sent straight away should produce a snapshot.")
+	link := linkUpUpdateWithIndex(2)
+	linkIn <- link
+	Eventually(snapOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.LinkAddrSnapshot{
+		IfaceIdx: 2,
+		Link:     &link,
+	})))
+	addrA := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- addrA
+	Eventually(snapOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.LinkAddrSnapshot{
+		IfaceIdx: 2,
+		Link:     &link,
+		Addrs:    []netlink.RouteUpdate{addrA},
+	})))
+
+	t.Log("Updates that are sent together should produce a single snapshot per interface.")
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	addrB := routeUpdate("10.0.0.2/16", true, 2)
+	routeIn <- addrB
+	addrC := routeUpdate("10.0.0.3/16", true, 3)
+	routeIn <- routeUpdate("10.0.0.3/16", false, 3)
+	routeIn <- addrC
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 2, 3: 1}))
+	mockTime.IncrementTime(100 * time.Millisecond)
+	var snaps []ifacemonitor.LinkAddrSnapshot
+	for i := 0; i < 2; i++ {
+		var snap ifacemonitor.LinkAddrSnapshot
+		Eventually(snapOut, chanPollTime, chanPollIntvl).Should(Receive(&snap))
+		snaps = append(snaps, snap)
+	}
+	Expect(snaps).To(ConsistOf(
+		ifacemonitor.LinkAddrSnapshot{IfaceIdx: 2, Link: &link, Addrs: []netlink.RouteUpdate{addrB}},
+		ifacemonitor.LinkAddrSnapshot{IfaceIdx: 3, Addrs: []netlink.RouteUpdate{addrC}},
+	))
+	Consistently(snapOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Deleting the interface should clear its addresses.")
+	linkDel := linkUpdateWithIndex(2)
+	linkDel.Header.Type = unix.RTM_DELLINK
+	linkIn <- linkDel
+	Eventually(snapOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.LinkAddrSnapshot{
+		IfaceIdx: 2,
+		Link:     &linkDel,
+	})))
+}
+
+func TestSnapshotUpdateFilter_StaggeredReadyTimes(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	snapOut := make(chan ifacemonitor.LinkAddrSnapshot, 10)
+	filter := ifacemonitor.NewSnapshotUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, snapOut, routeIn, make(chan netlink.LinkUpdate))
+
+	addrA := routeUpdate("10.0.0.1/16", true, 2)
+	addrB := routeUpdate("10.0.0.2/16", true, 2)
+	routeIn <- addrA
+	routeIn <- addrB
+	for _, addrs := range [][]netlink.RouteUpdate{{addrA}, {addrA, addrB}} {
+		Eventually(snapOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.LinkAddrSnapshot{
+			IfaceIdx: 2,
+			Addrs:    addrs,
+		})))
+	}
+
+	t.Log("Deletions that become ready at different times should produce a snapshot each.")
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+	mockTime.IncrementTime(50 * time.Millisecond)
+	routeIn <- routeUpdate("10.0.0.2/16", false, 2)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 2}))
+
+	mockTime.IncrementTime(50 * time.Millisecond)
+	Eventually(snapOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.LinkAddrSnapshot{
+		IfaceIdx: 2,
+		Addrs:    []netlink.RouteUpdate{addrB},
+	})))
+	Expect(filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}), "Second deletion should still be queued")
+
+	mockTime.IncrementTime(50 * time.Millisecond)
+	Eventually(snapOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.LinkAddrSnapshot{
+		IfaceIdx: 2,
+	})))
+	Consistently(snapOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestBufferedUpdateFilter_BurstyProducerSlowConsumer(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 20)
+	filter := ifacemonitor.NewBufferedUpdateFilter(4, ifacemonitor.WithTimeShim(mockTime))
+	Expect(filter.Validate()).To(Succeed())
+	errC := make(chan error, 1)
+	go func() {
+		errC <- filter.FilterUpdates(ctx, routeIn, make(chan netlink.LinkUpdate))
+	}()
+
+	t.Log("A burst larger than the buffer, with a stalled consumer, should drop the oldest updates.")
+	var adds []netlink.RouteUpdate
+	for i := 1; i <= 10; i++ {
+		add := routeUpdate(fmt.Sprintf("10.0.0.%d/16", i), true, 2)
+		adds = append(adds, add)
+		routeIn <- add
+	}
+	Eventually(filter.Dropped, chanPollTime, chanPollIntvl).Should(BeEquivalentTo(6))
+	for _, add := range adds[6:] {
+		Expect(filter.Updates()).To(Receive(Equal(add)))
+	}
+	Expect(filter.Updates()).NotTo(Receive())
+
+	t.Log("A burst that fits in the buffer should drain the queue straight away and reach a slow consumer intact.")
+	received := make(chan interface{}, 10)
+	go func() {
+		for upd := range filter.Updates() {
+			time.Sleep(5 * time.Millisecond)
+			received <- upd
+		}
+		close(received)
+	}()
+	var dels []netlink.RouteUpdate
+	for i := 1; i <= 4; i++ {
+		del := routeUpdate(fmt.Sprintf("10.0.1.%d/16", i), false, 3)
+		dels = append(dels, del)
+		routeIn <- del
+	}
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{3: 4}))
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(BeEmpty())
+	for _, del := range dels {
+		Eventually(received, "1s", chanPollIntvl).Should(Receive(Equal(del)))
+	}
+	Expect(filter.Dropped()).To(BeEquivalentTo(6))
+
+	t.Log("Stopping the filter should close the buffer.")
+	cancel()
+	Eventually(errC, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(received, chanPollTime, chanPollIntvl).Should(BeClosed())
+}
+
+func TestFilterVariants_RejectUnsupportedOutputs(t *testing.T) {
+	RegisterTestingT(t)
+	for msg, opt := range map[string]func() ifacemonitor.UpdateFilterOp{
+		"additional outputs": func() ifacemonitor.UpdateFilterOp {
+			return ifacemonitor.WithAdditionalOutput(make(chan netlink.RouteUpdate), make(chan netlink.LinkUpdate))
+		},
+		"typed outputs": func() ifacemonitor.UpdateFilterOp {
+			return ifacemonitor.WithTypedOutput(neighUpdate{}, make(chan interface{}))
+		},
+	} {
+		for name, validate := range map[string]func() error{
+			"batching": ifacemonitor.NewBatchingUpdateFilter(opt()).Validate,
+			"snapshot": ifacemonitor.NewSnapshotUpdateFilter(opt()).Validate,
+			"diff":     ifacemonitor.NewDiffUpdateFilter(opt()).Validate,
+			"buffered": ifacemonitor.NewBufferedUpdateFilter(1, opt()).Validate,
+		} {
+			Expect(validate()).To(MatchError(ContainSubstring(msg)), name)
+		}
+
+		t.Log("FilterUpdates should refuse to run, closing its outputs, rather than ignore the outputs.")
+		ctx := context.Background()
+		routeIn, linkIn := make(chan netlink.RouteUpdate), make(chan netlink.LinkUpdate)
+		batchRouteOut, batchLinkOut := make(chan []netlink.RouteUpdate), make(chan []netlink.LinkUpdate)
+		snapshotOut := make(chan ifacemonitor.LinkAddrSnapshot)
+		diffOut := make(chan ifacemonitor.AddressDiff)
+		generationOut := make(chan ifacemonitor.GenerationUpdate)
+		buffered := ifacemonitor.NewBufferedUpdateFilter(1, opt())
+		for name, run := range map[string]func() error{
+			"batching": func() error {
+				return ifacemonitor.NewBatchingUpdateFilter(opt()).FilterUpdates(ctx, batchRouteOut, routeIn, batchLinkOut, linkIn)
+			},
+			"snapshot": func() error {
+				return ifacemonitor.NewSnapshotUpdateFilter(opt()).FilterUpdates(ctx, snapshotOut, routeIn, linkIn)
+			},
+			"diff": func() error {
+				return ifacemonitor.NewDiffUpdateFilter(opt()).FilterUpdates(ctx, diffOut, routeIn, linkIn)
+			},
+			"buffered": func() error {
+				return buffered.FilterUpdates(ctx, routeIn, linkIn)
+			},
+			"generations": func() error {
+				return ifacemonitor.NewUpdateFilter(opt()).FilterUpdatesWithGenerations(ctx, generationOut, routeIn, linkIn)
+			},
+		} {
+			Expect(run()).To(MatchError(ContainSubstring(msg)), name)
+		}
+		Expect(batchRouteOut).To(BeClosed())
+		Expect(batchLinkOut).To(BeClosed())
+		Expect(snapshotOut).To(BeClosed())
+		Expect(diffOut).To(BeClosed())
+		Expect(buffered.Updates()).To(BeClosed())
+		Expect(generationOut).To(BeClosed())
+
+		Expect(ifacemonitor.NewUpdateFilter(opt()).Validate()).To(Succeed())
+	}
+}
+
+func TestBufferedUpdateFilter_Validate(t *testing.T) {
+	RegisterTestingT(t)
+	filter := ifacemonitor.NewBufferedUpdateFilter(0)
+	Expect(filter.Validate()).To(MatchError(ContainSubstring("buffer size must be positive")))
+	Expect(filter.FilterUpdates(context.Background(), nil, nil)).NotTo(Succeed())
+}
+
+func TestDiffUpdateFilter_FilterUpdates(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	diffOut := make(chan ifacemonitor.AddressDiff, 10)
+	filter := ifacemonitor.NewDiffUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, diffOut, routeIn, linkIn)
+	cidr := func(s string) net.IPNet {
+		return *routeUpdate(s, true, 2).Dst
+	}
+
+	t.Log("Each add that's sent straight away should produce a diff.")
+	routeIn <- routeUpdate("10.0.0.1/16", true, 2)
+	Eventually(diffOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.AddressDiff{
+		IfaceIdx: 2,
+		Added:    []net.IPNet{cidr("10.0.0.1/16")},
+	})))
+	routeIn <- routeUpdate("10.0.0.2/16", true, 2)
+	Eventually(diffOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.AddressDiff{
+		IfaceIdx: 2,
+		Added:    []net.IPNet{cidr("10.0.0.2/16")},
+	})))
+
+	t.Log("Link updates that don't delete the interface shouldn't produce a diff.")
+	linkIn <- linkUpUpdateWithIndex(2)
+	Consistently(diffOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Updates that are sent together should produce their net change.")
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- routeUpdate("10.0.0.2/16", false, 2)
+	routeIn <- routeUpdate("10.0.0.2/16", true, 2)
+	routeIn <- routeUpdate("10.0.0.3/16", true, 2)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 3}))
+	Consistently(diffOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(diffOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.AddressDiff{
+		IfaceIdx: 2,
+		Added:    []net.IPNet{cidr("10.0.0.3/16")},
+		Removed:  []net.IPNet{cidr("10.0.0.1/16")},
+	})))
+
+	t.Log("Deleting the interface should remove all of its addresses.")
+	linkDel := linkUpdateWithIndex(2)
+	linkDel.Header.Type = unix.RTM_DELLINK
+	linkIn <- linkDel
+	Eventually(diffOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.AddressDiff{
+		IfaceIdx: 2,
+		Removed:  []net.IPNet{cidr("10.0.0.2/16"), cidr("10.0.0.3/16")},
+	})))
+	Consistently(diffOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestDiffUpdateFilter_StaggeredReadyTimes(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	diffOut := make(chan ifacemonitor.AddressDiff, 10)
+	filter := ifacemonitor.NewDiffUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, diffOut, routeIn, make(chan netlink.LinkUpdate))
+	cidr := func(s string) net.IPNet {
+		return *routeUpdate(s, true, 2).Dst
+	}
+
+	for _, addr := range []string{"10.0.0.1/16", "10.0.0.2/16"} {
+		routeIn <- routeUpdate(addr, true, 2)
+		Eventually(diffOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.AddressDiff{
+			IfaceIdx: 2,
+			Added:    []net.IPNet{cidr(addr)},
+		})))
+	}
+
+	t.Log("Deletions that become ready at different times should produce a diff each.")
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+	mockTime.IncrementTime(50 * time.Millisecond)
+	routeIn <- routeUpdate("10.0.0.2/16", false, 2)
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 2}))
+
+	mockTime.IncrementTime(50 * time.Millisecond)
+	Eventually(diffOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.AddressDiff{
+		IfaceIdx: 2,
+		Removed:  []net.IPNet{cidr("10.0.0.1/16")},
+	})))
+	Expect(filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}), "Second deletion should still be queued")
+
+	mockTime.IncrementTime(50 * time.Millisecond)
+	Eventually(diffOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(ifacemonitor.AddressDiff{
+		IfaceIdx: 2,
+		Removed:  []net.IPNet{cidr("10.0.0.2/16")},
+	})))
+	Consistently(diffOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+}
+
+func TestUpdateFilter_IgnoreLifetimeOnlyChanges(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithIgnoreLifetimeOnlyChanges())
+
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	Expect(f.Send(routeAdd)).To(Equal([]interface{}{routeAdd}))
+
+	t.Log("Repeated add should be dropped.")
+	Expect(f.Send(routeAdd)).To(BeEmpty())
+
+	t.Log("Add with a different source address should be forwarded.")
+	changedAdd := routeUpdate("10.0.0.1/16", true, 2)
+	changedAdd.Src = net.ParseIP("10.0.0.1")
+	Expect(f.Send(changedAdd)).To(Equal([]interface{}{changedAdd}))
+
+	t.Log("Add after a delete should be forwarded.")
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{routeDel}))
+	Expect(f.Send(routeAdd)).To(Equal([]interface{}{routeAdd}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_MicroCoalesceWindow(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	Expect(f.Send(routeAdd)).To(Equal([]interface{}{routeAdd}))
+
+	t.Log("A tight burst of duplicate adds should be coalesced into the first.")
+	Expect(f.Send(routeAdd)).To(BeEmpty())
+	Expect(f.Send(routeAdd)).To(BeEmpty())
+
+	t.Log("A duplicate should be dropped even if something else is queued for the interface.")
+	otherDel := routeUpdate("10.0.0.2/16", false, 2)
+	Expect(f.Send(otherDel)).To(BeEmpty())
+	Expect(f.Send(routeAdd)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{otherDel}))
+
+	t.Log("Once the window has passed, a repeated add should be forwarded.")
+	routeAdd3 := routeUpdate("10.0.0.3/16", true, 2)
+	Expect(f.Send(routeAdd3)).To(Equal([]interface{}{routeAdd3}))
+	Expect(f.Advance(time.Millisecond)).To(BeEmpty())
+	Expect(f.Send(routeAdd3)).To(Equal([]interface{}{routeAdd3}))
+
+	t.Log("An add that differs from the one sent should be forwarded.")
+	changedAdd := routeUpdate("10.0.0.3/16", true, 2)
+	changedAdd.Src = net.ParseIP("10.0.0.3")
+	Expect(f.Send(changedAdd)).To(Equal([]interface{}{changedAdd}))
+	f.ExpectQueueDrained()
+
+	t.Log("With the window disabled, duplicates should be forwarded.")
+	f = NewManualTestFilter(ifacemonitor.WithMicroCoalesceWindow(0))
+	Expect(f.Send(routeAdd)).To(Equal([]interface{}{routeAdd}))
+	Expect(f.Send(routeAdd)).To(Equal([]interface{}{routeAdd}))
+	f.ExpectQueueDrained()
+}
+
+// nilAfterTime is a time shim whose After method always returns a nil channel, as do the Chan
+// methods of its timers.
+type nilAfterTime struct {
+	*mocktime.MockTime
+}
+
+func (n nilAfterTime) After(time.Duration) <-chan time.Time {
+	return nil
+}
+
+func (n nilAfterTime) NewTimer(d time.Duration) timeshim.Timer {
+	return nilChanTimer{n.MockTime.NewTimer(d)}
+}
+
+type nilChanTimer struct {
+	timeshim.Timer
+}
+
+func (nilChanTimer) Chan() <-chan time.Time {
+	return nil
+}
+
+// countingTime is a mock time shim that counts the timers that it creates, including those behind
+// After.
+type countingTime struct {
+	*mocktime.MockTime
+	numTimers *atomic.Int32
+}
+
+func (c countingTime) NewTimer(d time.Duration) timeshim.Timer {
+	c.numTimers.Add(1)
+	return c.MockTime.NewTimer(d)
+}
+
+func (c countingTime) After(d time.Duration) <-chan time.Time {
+	c.numTimers.Add(1)
+	return c.MockTime.After(d)
+}
+
+func TestUpdateFilter_FilterUpdates_ReusesSendTimer(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var numTimers atomic.Int32
+	shim := countingTime{MockTime: mocktime.New(), numTimers: &numTimers}
+	routeIn := make(chan netlink.RouteUpdate)
+	routeOut := make(chan netlink.RouteUpdate)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate),
+		ifacemonitor.WithTimeShim(shim), ifacemonitor.WithSendTimeout(time.Second))
+
+	t.Log("Each send has a timeout but they should share one timer.")
+	for i := 0; i < 20; i++ {
+		routeAdd := routeUpdate(fmt.Sprintf("10.0.0.%d/32", i+1), true, 2)
+		routeIn <- routeAdd
+		Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	}
+	Expect(numTimers.Load()).To(BeEquivalentTo(1))
+	Eventually(shim.HasTimers, chanPollTime, chanPollIntvl).Should(BeFalse(),
+		"Send timer should be stopped once the send completes")
+}
+
+func TestUpdateFilter_FilterUpdates_NilTimerChannel(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, hook := logtest.NewNullLogger()
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10),
+		ifacemonitor.WithTimeShim(nilAfterTime{mockTime}),
+		ifacemonitor.WithLogger(logrus.NewEntry(logger)))
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- routeDel
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("Filter should still process input.")
+	routeAdd := routeUpdate("10.0.0.2/16", true, 3)
+	routeIn <- routeAdd
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+
+	t.Log("Filter should notice that the delete is ready without a timer.")
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(routeOut, "1s", chanPollIntvl).Should(Receive(Equal(routeDel)))
+
+	t.Log("Filter should only warn about the time shim once.")
+	numWarnings := 0
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel {
+			numWarnings++
+		}
+	}
+	Expect(numWarnings).To(Equal(1))
+}
+
+// steppedClockTime is a time shim whose wall clock can be stepped independently of its timers,
+// which, like real timers, keep firing after the requested duration.
+type steppedClockTime struct {
+	*mocktime.MockTime
+	offset *atomic.Int64
+}
+
+func (s steppedClockTime) Now() time.Time {
+	return s.MockTime.Now().Add(time.Duration(s.offset.Load()))
+}
+
+func (s steppedClockTime) Since(t time.Time) time.Duration {
+	return s.Now().Sub(t)
+}
+
+func (s steppedClockTime) Until(t time.Time) time.Duration {
+	return t.Sub(s.Now())
+}
+
+func TestUpdateFilter_FilterUpdates_ClockStepsBackwards(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	clock := steppedClockTime{MockTime: mockTime, offset: &atomic.Int64{}}
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10),
+		ifacemonitor.WithTimeShim(clock))
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- routeDel
+	Eventually(mockTime.HasTimers, "1s", chanPollIntvl).Should(BeTrue())
+
+	t.Log("Stepping the clock backwards shouldn't release the delete early.")
+	clock.offset.Store(int64(-time.Hour))
+	mockTime.IncrementTime(50 * time.Millisecond)
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+
+	t.Log("The delete should be released within one more delay, not an hour later.  The filter " +
+		"can't tell how much of the step was real time passing so it loses up to one delay.")
+	for i := 0; i < 2; i++ {
+		Eventually(mockTime.HasTimers, "1s", chanPollIntvl).Should(BeTrue())
+		mockTime.IncrementTime(100 * time.Millisecond)
+	}
+	Eventually(routeOut, "1s", chanPollIntvl).Should(Receive(Equal(routeDel)))
+}
+
+func TestUpdateFilter_NextWakeAfterClockStep(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	clock := steppedClockTime{MockTime: mockTime, offset: &atomic.Int64{}}
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(clock))
+	go filter.FilterUpdates(ctx, make(chan netlink.RouteUpdate, 10), routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	Eventually(filter.NextWake, "1s", chanPollIntvl).Should(BeTemporally("==", clock.Now().Add(100*time.Millisecond)))
+
+	t.Log("After a backwards step, NextWake should be on the shim's clock, not the filter's own.")
+	clock.offset.Store(int64(-time.Hour))
+	mockTime.IncrementTime(50 * time.Millisecond)
+	routeIn <- routeUpdate("10.0.0.2/16", false, 3)
+	Eventually(filter.QueueSnapshot, "1s", chanPollIntvl).Should(Equal(map[int]int{2: 1, 3: 1}))
+	// The filter's clock stood still during the step so the first delete is still 100ms away.
+	Expect(filter.NextWake()).To(BeTemporally("==", clock.Now().Add(100*time.Millisecond)))
+}
+
+func TestUpdateFilter_Stats(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+	Expect(filter.Stats()).To(Equal(ifacemonitor.FilterStats{}))
+
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- routeUpdate("10.0.0.2/16", false, 2)
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(Equal(ifacemonitor.FilterStats{
+		DelayedUpdates:       2,
+		CurrentQueuedUpdates: 2,
+	}))
+
+	routeIn <- routeUpdate("10.0.0.1/16", true, 2)
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(Equal(ifacemonitor.FilterStats{
+		SuppressedFlaps:      1,
+		DelayedUpdates:       2,
+		CurrentQueuedUpdates: 2,
+		DampedDeletesUseful:  1,
+	}))
+
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(Equal(ifacemonitor.FilterStats{
+		SuppressedFlaps:     1,
+		DelayedUpdates:      2,
+		ForwardedUpdates:    2,
+		DampedDeletesUseful: 1,
+		DampedDeletesWasted: 1,
+	}))
+}
+
+func TestUpdateFilter_LastActive(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mockTime),
+		ifacemonitor.WithHeartbeatInterval(time.Second),
+	)
+	Expect(filter.LastActive().IsZero()).To(BeTrue(), "LastActive should be zero before starting")
+
+	go filter.FilterUpdates(ctx, make(chan netlink.RouteUpdate, 10), make(chan netlink.RouteUpdate, 10),
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+	Eventually(filter.LastActive, chanPollTime, chanPollIntvl).Should(BeTemporally("==", mocktime.StartTime))
+
+	t.Log("Heartbeat should keep LastActive advancing while idle.")
+	mockTime.IncrementTime(time.Second)
+	Eventually(filter.LastActive, chanPollTime, chanPollIntvl).Should(
+		BeTemporally("==", mocktime.StartTime.Add(time.Second)))
+	mockTime.IncrementTime(time.Second)
+	Eventually(filter.LastActive, chanPollTime, chanPollIntvl).Should(
+		BeTemporally("==", mocktime.StartTime.Add(2*time.Second)))
+}
+
+func TestUpdateFilter_Heartbeat(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime), ifacemonitor.WithHeartbeat(time.Second))
+	go filter.FilterUpdates(ctx, routeOut, routeIn, linkOut, make(chan netlink.LinkUpdate, 10))
+	Eventually(mockTime.HasTimers, chanPollTime, chanPollIntvl).Should(BeTrue())
+
+	t.Log("An idle filter should send a heartbeat.")
+	mockTime.IncrementTime(time.Second)
+	var upd netlink.LinkUpdate
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(&upd))
+	Expect(ifacemonitor.IsHeartbeat(upd)).To(BeTrue())
+	Expect(upd.Link.Type()).To(Equal(ifacemonitor.HeartbeatLinkType))
+	Expect(filter.Stats().ForwardedUpdates).To(BeZero())
+
+	t.Log("Sending an update should postpone the next heartbeat.")
+	mockTime.IncrementTime(500 * time.Millisecond)
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeIn <- routeAdd
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	// The filter notes the time of the send before it updates the stats.
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(HaveField("ForwardedUpdates", BeEquivalentTo(1)))
+	mockTime.IncrementTime(500 * time.Millisecond)
+	Consistently(linkOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	mockTime.IncrementTime(500 * time.Millisecond)
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(&upd))
+	Expect(ifacemonitor.IsHeartbeat(upd)).To(BeTrue())
+
+	t.Log("A real link update isn't a heartbeat.")
+	Expect(ifacemonitor.IsHeartbeat(linkUpUpdateWithIndex(2))).To(BeFalse())
+}
+
+func TestUpdateFilter_AdaptiveDamping(t *testing.T) {
+	RegisterTestingT(t)
+	eventC := make(chan ifacemonitor.SuppressionEvent, 100)
+	f := NewManualTestFilter(
+		ifacemonitor.WithAdaptiveDamping(50*time.Millisecond, time.Second),
+		ifacemonitor.WithDebugEventChan(eventC),
+	)
+	// flap deletes the address, re-adds it after goneFor and then lets the queue drain.  Returns the
+	// damping delay that the filter applied to the delete and the updates that it emitted.
+	flap := func(goneFor time.Duration) (time.Duration, []interface{}) {
+		var emitted []interface{}
+		emitted = append(emitted, f.Send(routeUpdate("10.0.0.1/16", false, 2))...)
+		var delay time.Duration
+		for len(eventC) > 0 {
+			if ev := <-eventC; ev.Kind == ifacemonitor.SuppressionKindDelayed {
+				delay = ev.OldReadyAt.Sub(f.Now())
+			}
+		}
+		emitted = append(emitted, f.Advance(goneFor)...)
+		emitted = append(emitted, f.Send(routeUpdate("10.0.0.1/16", true, 2))...)
+		emitted = append(emitted, f.Advance(time.Second)...)
+		return delay, emitted
+	}
+
+	t.Log("With no history, the static delay should be used and a 250ms flap should leak through.")
+	delay, emitted := flap(250 * time.Millisecond)
+	Expect(delay).To(Equal(100 * time.Millisecond))
+	Expect(emitted).To(HaveLen(2))
+
+	t.Log("Consistent 250ms flaps should make the delay converge on a window that suppresses them.")
+	for i := 0; i < 10; i++ {
+		delay, emitted = flap(250 * time.Millisecond)
+	}
+	Expect(delay).To(BeNumerically("~", 375*time.Millisecond, time.Millisecond))
+	Expect(emitted).To(Equal([]interface{}{routeUpdate("10.0.0.1/16", true, 2)}))
+	f.ExpectQueueDrained()
+
+	t.Log("Deletions that aren't re-added should shrink the delay towards the minimum.")
+	for i := 0; i < 20; i++ {
+		f.Send(routeUpdate("10.0.1.1/16", false, 2))
+		f.Advance(2 * time.Second)
+		f.Send(routeUpdate("10.0.1.1/16", true, 2))
+	}
+	delay, _ = flap(10 * time.Millisecond)
+	Expect(delay).To(Equal(50 * time.Millisecond))
+}
+
+func TestUpdateFilter_FilterUpdatesFromSource(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := ifacemonitor.NewFakeLinkAddrSource()
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	var numCallbacks atomic.Int32
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithSourceErrorCallback(func(err error, fatal bool) {
+			Expect(fatal).To(BeFalse())
+			numCallbacks.Add(1)
+		}),
+	)
+	resultC := make(chan error, 1)
+	go func() {
+		resultC <- filter.FilterUpdatesFromSource(ctx, routeOut, linkOut, src)
+	}()
+
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	src.RouteC <- routeAdd
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	linkUp := linkUpUpdateWithIndex(2)
+	src.LinkC <- linkUp
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkUp)))
+
+	t.Log("Transient errors shouldn't stop the filter.")
+	src.ErrC <- errors.New("netlink error")
+	Eventually(numCallbacks.Load, chanPollTime, chanPollIntvl).Should(BeEquivalentTo(1))
+	routeAdd2 := routeUpdate("10.0.0.2/16", true, 2)
+	src.RouteC <- routeAdd2
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd2)))
+
+	t.Log("Closing the source should close the outputs.")
+	close(src.RouteC)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(BeClosed())
+	Eventually(resultC, chanPollTime, chanPollIntvl).Should(Receive(MatchError(ifacemonitor.ErrInputClosed)))
+}
+
+func TestUpdateFilter_FilterUpdatesFromSource_FatalError(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := ifacemonitor.NewFakeLinkAddrSource()
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	callbackC := make(chan bool, 1)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithSourceErrorCallback(func(err error, fatal bool) {
+			callbackC <- fatal
+		}),
+	)
+	resultC := make(chan error, 1)
+	go func() {
+		resultC <- filter.FilterUpdatesFromSource(ctx, routeOut, linkOut, src)
+	}()
+
+	src.ErrC <- fmt.Errorf("subscription socket closed: %w", ifacemonitor.ErrSourceFailed)
+	Eventually(callbackC, chanPollTime, chanPollIntvl).Should(Receive(BeTrue()))
+	Eventually(resultC, chanPollTime, chanPollIntvl).Should(Receive(MatchError(ifacemonitor.ErrSourceFailed)))
+	Expect(routeOut).To(BeClosed())
+	Expect(linkOut).To(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdatesFromNetlinkSource(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nl := &netlinkTest{userSubscribed: make(chan int, 1)}
+	src, err := ifacemonitor.NewNetlinkLinkAddrSourceWithStub(nl)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(nl.userSubscribed).To(Receive())
+
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	callbackC := make(chan bool, 1)
+	filter := ifacemonitor.NewUpdateFilter(
+		ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithSourceErrorCallback(func(err error, fatal bool) {
+			callbackC <- fatal
+		}),
+	)
+	resultC := make(chan error, 1)
+	go func() {
+		resultC <- filter.FilterUpdatesFromSource(ctx, routeOut, linkOut, src)
+	}()
+
+	t.Log("Updates from the netlink subscription should reach the filter.")
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	nl.routeUpdates <- routeAdd
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	linkUp := linkUpUpdateWithIndex(2)
+	nl.linkUpdates <- linkUp
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(linkUp)))
+
+	t.Log("Netlink errors should be reported as transient.")
+	nl.errorCallback(errors.New("unexpected message"))
+	Eventually(callbackC, chanPollTime, chanPollIntvl).Should(Receive(BeFalse()))
+
+	t.Log("Close should cancel the subscription.")
+	src.Close()
+	Expect(nl.cancel).To(BeClosed())
+	Consistently(resultC).ShouldNot(Receive())
+}
+
+func TestUpdateFilter_IsAddressPresent(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	addr := routeUpdate("10.0.0.5/32", true, 7)
+	Expect(filter.IsAddressPresent(7, *addr.Dst)).To(BeFalse())
+	routeIn <- addr
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(func() bool { return filter.IsAddressPresent(7, *addr.Dst) }, chanPollTime, chanPollIntvl).Should(BeTrue())
+
+	t.Log("The address should only match on the same interface and with the same mask.")
+	Expect(filter.IsAddressPresent(8, *addr.Dst)).To(BeFalse())
+	_, otherMask, _ := net.ParseCIDR("10.0.0.5/24")
+	otherMask.IP = addr.Dst.IP
+	Expect(filter.IsAddressPresent(7, *otherMask)).To(BeFalse())
+
+	t.Log("The address should stay present until its deletion is forwarded.")
+	routeIn <- routeUpdate("10.0.0.5/32", false, 7)
+	Eventually(mockTime.HasTimers, chanPollTime, chanPollIntvl).Should(BeTrue())
+	Expect(filter.IsAddressPresent(7, *addr.Dst)).To(BeTrue())
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(func() bool { return filter.IsAddressPresent(7, *addr.Dst) }, chanPollTime, chanPollIntvl).Should(BeFalse())
+}
+
+func TestUpdateFilter_AddressesForInterface(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn)
+	Expect(filter.AddressesForInterface(2)).To(BeEmpty())
+
+	addrA := routeUpdate("10.0.0.1/16", true, 2)
+	addrB := routeUpdate("10.0.0.2/16", true, 2)
+	routeIn <- addrA
+	routeIn <- addrB
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(func() []net.IPNet { return filter.AddressesForInterface(2) }, chanPollTime, chanPollIntvl).Should(
+		ConsistOf(*addrA.Dst, *addrB.Dst))
+
+	t.Log("A flap that the filter suppresses shouldn't affect the emitted state.")
+	routeIn <- routeUpdate("10.0.0.1/16", false, 2)
+	routeIn <- addrA
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(HaveField("SuppressedFlaps", BeEquivalentTo(1)))
+	Expect(filter.AddressesForInterface(2)).To(ConsistOf(*addrA.Dst, *addrB.Dst))
+	// Wait for the filter to schedule its timer; otherwise it would be scheduled relative to the
+	// advanced clock.
+	Eventually(mockTime.HasTimers, chanPollTime, chanPollIntvl).Should(BeTrue())
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(addrA)))
+	Expect(filter.AddressesForInterface(2)).To(ConsistOf(*addrA.Dst, *addrB.Dst))
+
+	t.Log("A delete should only take effect once it has been forwarded.")
+	routeIn <- routeUpdate("10.0.0.2/16", false, 2)
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(HaveField("DelayedUpdates", BeEquivalentTo(2)))
+	Expect(filter.AddressesForInterface(2)).To(ConsistOf(*addrA.Dst, *addrB.Dst))
+	Eventually(mockTime.HasTimers, chanPollTime, chanPollIntvl).Should(BeTrue())
+	mockTime.IncrementTime(100 * time.Millisecond)
+	Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(func() []net.IPNet { return filter.AddressesForInterface(2) }, chanPollTime, chanPollIntvl).Should(
+		ConsistOf(*addrA.Dst))
+
+	t.Log("Deleting the interface should clear its addresses.")
+	linkDel := linkUpdateWithIndex(2)
+	linkDel.Header.Type = syscall.RTM_DELLINK
+	linkIn <- linkDel
+	Eventually(linkOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(func() []net.IPNet { return filter.AddressesForInterface(2) }, chanPollTime, chanPollIntvl).Should(
+		BeEmpty())
+}
+
+func TestUpdateFilter_TriggerResync(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockTime := mocktime.New()
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithTimeShim(mockTime))
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10))
+
+	addrA := routeUpdate("10.0.0.1/16", true, 2)
+	addrB := routeUpdate("10.0.0.2/16", true, 2)
+	addrC := routeUpdate("10.0.0.3/16", true, 3)
+	routeIn <- addrA
+	routeIn <- addrB
+	routeIn <- addrC
+	for i := 0; i < 3; i++ {
+		Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive())
+	}
+
+	t.Log("Queue a deletion and a new address, which the resync should flush.")
+	delB := routeUpdate("10.0.0.2/16", false, 2)
+	routeIn <- delB
+	Eventually(filter.QueueSnapshot, chanPollTime, chanPollIntvl).Should(Equal(map[int]int{2: 1}))
+	addrD := routeUpdate("10.0.0.4/16", true, 3)
+	routeIn <- routeUpdate("10.0.0.4/16", false, 3)
+	routeIn <- addrD
+	// The queue depths are the same before and after the add squashes the delete so wait for the
+	// squash itself.
+	Eventually(filter.Stats, chanPollTime, chanPollIntvl).Should(HaveField("SuppressedFlaps", BeEquivalentTo(1)))
+	Expect(filter.QueueSnapshot()).To(Equal(map[int]int{2: 1, 3: 1}))
+
+	filter.TriggerResync()
+	var got []netlink.RouteUpdate
+	for i := 0; i < 5; i++ {
+		var upd netlink.RouteUpdate
+		Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(&upd))
+		got = append(got, upd)
+	}
+	Consistently(routeOut, chanPollTime, chanPollIntvl).ShouldNot(Receive())
+	Expect(filter.QueueSnapshot()).To(BeEmpty())
+
+	t.Log("The queued updates should come first, followed by an add for every address.")
+	Expect(got).To(Equal([]netlink.RouteUpdate{delB, addrD, addrA, addrC, addrD}))
+	Expect(filter.AddressesForInterface(2)).To(ConsistOf(*addrA.Dst))
+	Expect(filter.AddressesForInterface(3)).To(ConsistOf(*addrC.Dst, *addrD.Dst))
+}
+
+func TestUpdateFilter_SuppressDownInterfaces(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithSuppressDownInterfaces(true))
+
+	addrB := routeUpdate("10.0.0.2/16", true, 2)
+	Expect(f.Send(addrB)).To(Equal([]interface{}{addrB}))
+
+	t.Log("Address updates should be held back while the interface is admin down.")
+	linkDown := linkUpdateWithIndex(2)
+	linkDown.Header.Type = unix.RTM_NEWLINK
+	Expect(f.Send(linkDown)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{linkDown}))
+	addrA := routeUpdate("10.0.0.1/16", true, 2)
+	Expect(f.Send(addrA)).To(BeEmpty())
+	Expect(f.Send(routeUpdate("10.0.0.3/16", true, 2))).To(BeEmpty())
+	Expect(f.Send(routeUpdate("10.0.0.3/16", false, 2))).To(BeEmpty())
+	delB := routeUpdate("10.0.0.2/16", false, 2)
+	Expect(f.Send(delB)).To(BeEmpty())
+	Expect(f.Advance(time.Second)).To(BeEmpty())
+	f.ExpectQueueDrained()
+
+	t.Log("Coming back up should replay the latest update for each address.")
+	linkUp := linkUpUpdateWithIndex(2)
+	linkUp.Link.Attrs().RawFlags |= unix.IFF_UP
+	Expect(f.Send(linkUp)).To(Equal([]interface{}{linkUp, addrA}))
+	delC := routeUpdate("10.0.0.3/16", false, 2)
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{delC, delB}))
+	f.ExpectQueueDrained()
+
+	t.Log("Once up, address updates should flow as normal.")
+	addrD := routeUpdate("10.0.0.4/16", true, 2)
+	Expect(f.Send(addrD)).To(Equal([]interface{}{addrD}))
+}
+
+func TestUpdateFilter_InterfaceNameTTL(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithInterfaceNameTTL(time.Minute),
+		ifacemonitor.WithPerInterfaceDelay(func(ifaceName string) time.Duration {
+			if ifaceName != "" {
+				return 500 * time.Millisecond
+			}
+			return 0
+		}),
+	)
+	namedLinkUp := func(idx int, name string) netlink.LinkUpdate {
+		upd := linkUpUpdateWithIndex(idx)
+		upd.Link.Attrs().Name = name
+		return upd
+	}
+
+	t.Log("Once the name is known, the per-interface delay should apply.")
+	f.Send(namedLinkUp(2, "eth0"))
+	delA := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(delA)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(400 * time.Millisecond)).To(Equal([]interface{}{delA}))
+	f.Send(routeUpdate("10.0.0.1/16", true, 2))
+
+	t.Log("Activity on another interface shouldn't keep the name alive.")
+	f.Advance(50 * time.Second)
+	f.Send(namedLinkUp(3, "eth1"))
+	f.Advance(30 * time.Second)
+	f.Send(routeUpdate("10.0.1.1/16", true, 3))
+
+	t.Log("Expired name should have been evicted so the global delay applies.")
+	Expect(f.Send(delA)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{delA}))
+
+	t.Log("Recently-seen name should have been kept.")
+	delB := routeUpdate("10.0.1.1/16", false, 3)
+	Expect(f.Send(delB)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(400 * time.Millisecond)).To(Equal([]interface{}{delB}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_BypassInterfaces(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithBypassInterfaces(func(ifaceName string) bool {
+		return ifaceName == "eth0"
+	}))
+	namedLinkUp := func(idx int, name string) netlink.LinkUpdate {
+		upd := linkUpUpdateWithIndex(idx)
+		upd.Link.Attrs().Name = name
+		return upd
+	}
+	eth0Up := namedLinkUp(1, "eth0")
+	Expect(f.Send(eth0Up)).To(Equal([]interface{}{eth0Up}))
+	Expect(f.Send(namedLinkUp(2, "cali1234"))).To(HaveLen(1))
+
+	t.Log("Flapping interface should be damped.")
+	flapDel := routeUpdate("10.0.1.1/16", false, 2)
+	Expect(f.Send(flapDel)).To(BeEmpty())
+
+	t.Log("Bypassed interface's updates should be sent straight away, even deletions.")
+	eth0Del := routeUpdate("10.0.0.1/16", false, 1)
+	Expect(f.Send(eth0Del)).To(Equal([]interface{}{eth0Del}))
+	eth0Add := routeUpdate("10.0.0.2/16", true, 1)
+	Expect(f.Send(eth0Add)).To(Equal([]interface{}{eth0Add}))
+	eth0Down := linkUpdateWithIndex(1)
+	eth0Down.Header.Type = unix.RTM_NEWLINK
+	Expect(f.Send(eth0Down)).To(Equal([]interface{}{eth0Down}))
+	Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}))
+
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{flapDel}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_MaxTrackedInterfaces(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithMaxTrackedInterfaces(2))
+
+	t.Log("Deletions should be damped for the first two interfaces.")
+	del1 := routeUpdate("10.0.0.1/16", false, 1)
+	del2 := routeUpdate("10.0.0.2/16", false, 2)
+	Expect(f.Send(del1)).To(BeEmpty())
+	Expect(f.Send(del2)).To(BeEmpty())
+
+	t.Log("Once the limit is reached, further interfaces should be passed through.")
+	del3 := routeUpdate("10.0.0.3/16", false, 3)
+	Expect(f.Send(del3)).To(Equal([]interface{}{del3}))
+	linkDown4 := linkUpdateWithIndex(4)
+	Expect(f.Send(linkDown4)).To(Equal([]interface{}{linkDown4}))
+	Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{1: 1, 2: 1}))
+
+	t.Log("Interfaces that are already tracked should still be damped.")
+	del1b := routeUpdate("10.0.1.1/16", false, 1)
+	Expect(f.Send(del1b)).To(BeEmpty())
+
+	t.Log("An update that isn't queued shouldn't make its interface untracked.")
+	add5 := routeUpdate("10.0.0.5/16", true, 5)
+	Expect(f.Send(add5)).To(Equal([]interface{}{add5}))
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{del1, del1b, del2}))
+	del5 := routeUpdate("10.0.0.5/16", false, 5)
+	Expect(f.Send(del5)).To(BeEmpty())
+
+	t.Log("Once the queue is back below the limit, untracked interfaces should be damped again.")
+	Expect(f.Send(del3)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{del3, del5}))
+
+	t.Log("Back at the limit, a further interface should be passed through again.")
+	Expect(f.Send(del1)).To(BeEmpty())
+	Expect(f.Send(del2)).To(BeEmpty())
+	Expect(f.Send(del3)).To(Equal([]interface{}{del3}))
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{del1, del2}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_InterfaceAllowlist(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithInterfaceAllowlist(func(ifaceName string) bool {
+		return strings.HasPrefix(ifaceName, "eth")
+	}))
+	namedLinkUp := func(idx int, name string) netlink.LinkUpdate {
+		upd := linkUpUpdateWithIndex(idx)
+		upd.Link.Attrs().Name = name
+		return upd
+	}
+	eth0Up := namedLinkUp(1, "eth0")
+	Expect(f.Send(eth0Up)).To(Equal([]interface{}{eth0Up}))
+	Expect(f.Send(namedLinkUp(2, "dummy0"))).To(BeEmpty())
+
+	t.Log("Updates for the ignored interface should be dropped without being queued.")
+	Expect(f.Send(routeUpdate("10.0.1.1/16", false, 2))).To(BeEmpty())
+	Expect(f.Send(routeUpdate("10.0.1.2/16", true, 2))).To(BeEmpty())
+	Expect(f.Filter.QueueSnapshot()).To(BeEmpty())
+
+	t.Log("Allowed interface should be damped as normal.")
+	eth0Del := routeUpdate("10.0.0.1/16", false, 1)
+	Expect(f.Send(eth0Del)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{eth0Del}))
+
+	t.Log("Interface deletion should always be forwarded.")
+	linkDel := linkUpdateWithIndex(2)
+	linkDel.Header.Type = unix.RTM_DELLINK
+	Expect(f.Send(linkDel)).To(Equal([]interface{}{linkDel}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_MACChangeChan(t *testing.T) {
+	RegisterTestingT(t)
+	macC := make(chan ifacemonitor.MACChangedEvent, 10)
+	f := NewManualTestFilter(ifacemonitor.WithMACChangeChan(macC))
+	linkUpWithMAC := func(mac string) netlink.LinkUpdate {
+		upd := linkUpUpdateWithIndex(2)
+		upd.Link.Attrs().Name = "eth0"
+		upd.Link.Attrs().HardwareAddr, _ = net.ParseMAC(mac)
+		return upd
+	}
+
+	t.Log("First sighting of the interface isn't a change.")
+	first := linkUpWithMAC("00:11:22:33:44:55")
+	Expect(f.Send(first)).To(Equal([]interface{}{first}))
+	Expect(macC).NotTo(Receive())
+
+	t.Log("Changing the MAC should generate an event.")
+	second := linkUpWithMAC("00:11:22:33:44:66")
+	Expect(f.Send(second)).To(Equal([]interface{}{second}))
+	Expect(macC).To(Receive(Equal(ifacemonitor.MACChangedEvent{
+		IfaceIdx:  2,
+		IfaceName: "eth0",
+		OldMAC:    first.Link.Attrs().HardwareAddr,
+		NewMAC:    second.Link.Attrs().HardwareAddr,
+	})))
+
+	t.Log("Repeating the same MAC shouldn't.")
+	f.Send(linkUpWithMAC("00:11:22:33:44:66"))
+	Expect(macC).NotTo(Receive())
+}
+
+func TestUpdateFilter_NextWake(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+	Expect(f.Filter.NextWake().IsZero()).To(BeTrue(), "Idle filter should have no wake time")
+
+	f.Send(routeUpdate("10.0.0.1/16", false, 2))
+	Expect(f.Filter.NextWake()).To(BeTemporally("==", f.Now().Add(100*time.Millisecond)))
+	f.Advance(50 * time.Millisecond)
+	f.Send(routeUpdate("10.0.0.2/16", false, 2))
+	Expect(f.Filter.NextWake()).To(BeTemporally("==", f.Now().Add(50*time.Millisecond)))
+
+	f.Advance(50 * time.Millisecond)
+	Expect(f.Filter.NextWake()).To(BeTemporally("==", f.Now().Add(50*time.Millisecond)))
+	f.Advance(50 * time.Millisecond)
+	Expect(f.Filter.NextWake().IsZero()).To(BeTrue(), "Filter should be idle once the queue drains")
+}
+
+func TestUpdateFilter_MaxDeferral(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithFlapDampingDelay(time.Second),
+		ifacemonitor.WithMaxDeferral(200*time.Millisecond),
+	)
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(BeEmpty())
+	routeAdd := routeUpdate("10.0.0.2/16", true, 2)
+	Expect(f.Send(routeAdd)).To(BeEmpty(), "Add should be queued behind the delete")
+
+	t.Log("Delete should be forced out at the cap, releasing the add behind it.")
+	Expect(f.Advance(99 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(time.Millisecond)).To(Equal([]interface{}{routeDel, routeAdd}))
+	f.ExpectQueueDrained()
+}
+
+// countingTracerProvider wraps a no-op tracer, counting the spans that are started.
+type countingTracerProvider struct {
+	trace.TracerProvider
+	tracer *countingTracer
+}
+
+func (p *countingTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return p.tracer
+}
+
+type countingTracer struct {
+	trace.Tracer
+	numSpans atomic.Int32
+}
+
+func (c *countingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	c.numSpans.Add(1)
+	return c.Tracer.Start(ctx, name, opts...)
+}
+
+func TestUpdateFilter_FilterUpdates_TracerProvider(t *testing.T) {
+	noopTP := noop.NewTracerProvider()
+	tp := &countingTracerProvider{
+		TracerProvider: noopTP,
+		tracer:         &countingTracer{Tracer: noopTP.Tracer("")},
+	}
+	h, cancel := setUpFilterTest(t, ifacemonitor.WithTracerProvider(tp))
+	defer cancel()
+
+	h.RouteIn <- routeUpdate("10.0.0.1/16", true, 2)
+	h.RouteIn <- routeUpdate("10.0.0.2/16", true, 2)
+	Eventually(h.RouteOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(h.RouteOut, chanPollTime, chanPollIntvl).Should(Receive())
+	Eventually(tp.tracer.numSpans.Load, chanPollTime, chanPollIntvl).Should(BeNumerically("==", 2))
+}
+
+func TestUpdateFilter_CoalesceKey(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(ifacemonitor.WithCoalesceKey(func(upd netlink.RouteUpdate) string {
+		return upd.Dst.IP.Mask(net.CIDRMask(64, 128)).String()
+	}))
+
+	t.Log("Flap between two addresses in the same /64 should be squashed.")
+	Expect(f.Send(routeUpdate("fd00::1/128", false, 2))).To(BeEmpty())
+	newAddr := routeUpdate("fd00::2/128", true, 2)
+	Expect(f.Send(newAddr)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{newAddr}))
+	f.ExpectQueueDrained()
+
+	t.Log("A queued add should be replaced by a later add with the same key.")
+	Expect(f.Send(routeUpdate("fd00::1/128", false, 2))).To(BeEmpty())
+	Expect(f.Send(routeUpdate("fd00::2/128", true, 2))).To(BeEmpty())
+	newerAddr := routeUpdate("fd00::3/128", true, 2)
+	Expect(f.Send(newerAddr)).To(BeEmpty())
+	Expect(f.Filter.QueueSnapshot()).To(Equal(map[int]int{2: 1}))
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{newerAddr}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_CoalesceSameIPDifferentMask(t *testing.T) {
+	RegisterTestingT(t)
+
+	t.Log("By default, a mask change should be sent as a delete and an add.")
+	f := NewManualTestFilter()
+	del32 := routeUpdate("10.0.0.1/32", false, 2)
+	add24 := routeUpdate("10.0.0.1/24", true, 2)
+	Expect(f.Send(del32)).To(BeEmpty())
+	Expect(f.Send(add24)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{del32, add24}))
+	f.ExpectQueueDrained()
+
+	t.Log("With the option, the delete should be squashed by the add with the new mask.")
+	f = NewManualTestFilter(ifacemonitor.WithCoalesceSameIPDifferentMask())
+	Expect(f.Send(del32)).To(BeEmpty())
+	Expect(f.Send(add24)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{add24}))
+	f.ExpectQueueDrained()
+
+	t.Log("Different IPs should still be treated separately.")
+	del32b := routeUpdate("10.0.0.2/32", false, 2)
+	Expect(f.Send(del32b)).To(BeEmpty())
+	Expect(f.Send(add24)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{del32b, add24}))
+	f.ExpectQueueDrained()
+}
+
+func TestUpdateFilter_FlapStormCallback(t *testing.T) {
+	RegisterTestingT(t)
+	var numCalls, lastNumFlaps int
+	f := NewManualTestFilter(
+		ifacemonitor.WithFlapStormThreshold(3, time.Second),
+		ifacemonitor.WithFlapStormCallback(func(ifaceIdx int, addr net.IPNet, numFlaps int) {
+			Expect(ifaceIdx).To(Equal(2))
+			Expect(addr.String()).To(Equal("10.0.0.1/16"))
+			numCalls++
+			lastNumFlaps = numFlaps
+		}),
+	)
+	flap := func() {
+		f.Send(routeUpdate("10.0.0.1/16", false, 2))
+		f.Send(routeUpdate("10.0.0.1/16", true, 2))
+		f.Advance(100 * time.Millisecond)
+	}
+
+	t.Log("Flapping up to the threshold shouldn't trigger the callback.")
+	for i := 0; i < 3; i++ {
+		flap()
+	}
+	Expect(numCalls).To(Equal(0))
+
+	flap()
+	Expect(numCalls).To(Equal(1))
+	Expect(lastNumFlaps).To(Equal(4))
+
+	t.Log("Flaps that fall outside the window shouldn't count.")
+	f.Advance(time.Second)
+	for i := 0; i < 3; i++ {
+		flap()
+	}
+	Expect(numCalls).To(Equal(1))
+}
+
+func TestUpdateFilter_SequenceFunc(t *testing.T) {
+	RegisterTestingT(t)
+	// Local routes don't use the priority field so the test uses it to carry a sequence number.
+	f := NewManualTestFilter(ifacemonitor.WithSequenceFunc(func(upd netlink.RouteUpdate) (uint64, bool) {
+		return uint64(upd.Priority), upd.Priority != 0
+	}))
+	withSeq := func(upd netlink.RouteUpdate, seq int) netlink.RouteUpdate {
+		upd.Priority = seq
+		return upd
+	}
+
+	t.Log("Stale delete that arrives after a newer add should be dropped.")
+	routeAdd := withSeq(routeUpdate("10.0.0.1/16", true, 2), 2)
+	Expect(f.Send(routeAdd)).To(Equal([]interface{}{routeAdd}))
+	Expect(f.Send(withSeq(routeUpdate("10.0.0.1/16", false, 2), 1))).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(BeEmpty())
+	f.ExpectQueueDrained()
+
+	t.Log("Stale add that arrives after a newer delete should be dropped, leaving the delete queued.")
+	routeDel := withSeq(routeUpdate("10.0.0.2/16", false, 2), 4)
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Send(withSeq(routeUpdate("10.0.0.2/16", true, 2), 3))).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{routeDel}))
+	f.ExpectQueueDrained()
+
+	t.Log("Updates without a sequence number should be processed as normal.")
+	noSeqDel := routeUpdate("10.0.0.2/16", false, 2)
+	Expect(f.Send(noSeqDel)).To(BeEmpty())
+	Expect(f.Advance(100 * time.Millisecond)).To(Equal([]interface{}{noSeqDel}))
+}
+
+func TestUpdateFilter_MinEmitInterval(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter(
+		ifacemonitor.WithMinEmitInterval(10*time.Millisecond),
+		ifacemonitor.WithMaxDeferral(125*time.Millisecond),
+	)
+	var routeDels []interface{}
+	for idx := 2; idx < 6; idx++ {
+		routeDel := routeUpdate("10.0.0.1/16", false, idx)
+		routeDels = append(routeDels, routeDel)
+		Expect(f.Send(routeDel)).To(BeEmpty())
+	}
+
+	t.Log("Updates should be released one at a time.")
+	var released []interface{}
+	for _, step := range []struct {
+		advance time.Duration
+		numEmit int
+	}{
+		{100 * time.Millisecond, 1},
+		{9 * time.Millisecond, 0},
+		{time.Millisecond, 1},
+		{10 * time.Millisecond, 1},
+		// Max deferral cap should override the rate limit.
+		{5 * time.Millisecond, 1},
+	} {
+		emit := f.Advance(step.advance)
+		Expect(emit).To(HaveLen(step.numEmit))
+		released = append(released, emit...)
+	}
+	f.ExpectQueueDrained()
+	Expect(released).To(ConsistOf(routeDels...))
+}
+
+func TestUpdateFilter_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		opts        []ifacemonitor.UpdateFilterOp
+		expectedErr string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "damping disabled",
+			opts: []ifacemonitor.UpdateFilterOp{ifacemonitor.WithDampingEnabled(false)},
+		},
+		{
+			name: "damping disabled with delay",
+			opts: []ifacemonitor.UpdateFilterOp{
+				ifacemonitor.WithDampingEnabled(false),
+				ifacemonitor.WithFlapDampingDelay(time.Second),
+				ifacemonitor.WithFlushOnShutdown(),
+			},
+			expectedErr: "flap damping delay is set but damping is disabled\n" +
+				"flush on shutdown is set but damping is disabled",
+		},
+		{
+			name:        "re-queue without timeout",
+			opts:        []ifacemonitor.UpdateFilterOp{ifacemonitor.WithRequeueOnSendTimeout()},
+			expectedErr: "re-queue on send timeout is set but there is no send timeout",
+		},
+		{
+			name: "flap storm callback with detection disabled",
+			opts: []ifacemonitor.UpdateFilterOp{
+				ifacemonitor.WithFlapStormThreshold(0, 0),
+				ifacemonitor.WithFlapStormCallback(func(int, net.IPNet, int) {}),
+			},
+			expectedErr: "flap storm callback is set but flap storm detection is disabled",
+		},
+		{
+			name:        "shutdown timeout without flush",
+			opts:        []ifacemonitor.UpdateFilterOp{ifacemonitor.WithShutdownTimeout(time.Second)},
+			expectedErr: "shutdown timeout is set but flush on shutdown is not",
+		},
+		{
+			name:        "adaptive damping with min greater than max",
+			opts:        []ifacemonitor.UpdateFilterOp{ifacemonitor.WithAdaptiveDamping(time.Second, time.Millisecond)},
+			expectedErr: "adaptive damping minimum delay (1s) is greater than its maximum (1ms)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+			err := ifacemonitor.NewUpdateFilter(tc.opts...).Validate()
+			if tc.expectedErr == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(tc.expectedErr))
+			}
+		})
+	}
+}
+
+func TestUpdateFilter_FilterUpdates_ConflictingOptions(t *testing.T) {
+	RegisterTestingT(t)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	err := ifacemonitor.FilterUpdates(context.Background(),
+		routeOut, make(chan netlink.RouteUpdate), linkOut, make(chan netlink.LinkUpdate),
+		ifacemonitor.WithRequeueOnSendTimeout())
+	Expect(err).To(MatchError(ContainSubstring("re-queue on send timeout is set but there is no send timeout")))
+	Expect(routeOut).To(BeClosed())
+	Expect(linkOut).To(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_AdditionalOutput(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Uses real time so that the send timeout fires.
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	otherRouteOut := make(chan netlink.RouteUpdate, 10)
+	otherLinkOut := make(chan netlink.LinkUpdate, 10)
+	stalledRouteOut := make(chan netlink.RouteUpdate)
+	stalledLinkOut := make(chan netlink.LinkUpdate)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn,
+		ifacemonitor.WithAdditionalOutput(otherRouteOut, otherLinkOut),
+		ifacemonitor.WithAdditionalOutput(stalledRouteOut, stalledLinkOut),
+		ifacemonitor.WithSendTimeout(time.Millisecond),
+		ifacemonitor.WithFlapDampingDelay(10*time.Millisecond),
+	)
+
+	t.Log("Both consumers should receive every update, despite the stalled consumer.")
+	routeAdd := routeUpdate("10.0.0.1/16", true, 2)
+	routeDel := routeUpdate("10.0.0.2/16", false, 2)
+	linkUpd := linkUpUpdateWithIndex(3)
+	routeIn <- routeAdd
+	routeIn <- routeDel
+	linkIn <- linkUpd
+	for _, c := range []chan netlink.RouteUpdate{routeOut, otherRouteOut} {
+		var upds []netlink.RouteUpdate
+		for i := 0; i < 2; i++ {
+			var upd netlink.RouteUpdate
+			Eventually(c, "1s").Should(Receive(&upd))
+			upds = append(upds, upd)
+		}
+		Expect(upds).To(ConsistOf(routeAdd, routeDel))
+	}
+	for _, c := range []chan netlink.LinkUpdate{linkOut, otherLinkOut} {
+		Eventually(c, "1s").Should(Receive(Equal(linkUpd)))
+	}
+
+	cancel()
+	Eventually(otherRouteOut, "1s").Should(BeClosed())
+	Eventually(stalledRouteOut, "1s").Should(BeClosed())
+}
+
+func TestUpdateFilter_FilterUpdates_AdditionalOutputNoSendTimeout(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+	otherRouteOut := make(chan netlink.RouteUpdate, 10)
+	stalledRouteOut := make(chan netlink.RouteUpdate)
+	stalledLinkOut := make(chan netlink.LinkUpdate)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate, 10), make(chan netlink.LinkUpdate, 10),
+		ifacemonitor.WithTimeShim(mocktime.New()),
+		ifacemonitor.WithAdditionalOutput(stalledRouteOut, stalledLinkOut),
+		ifacemonitor.WithAdditionalOutput(otherRouteOut, make(chan netlink.LinkUpdate, 10)),
+	)
+
+	t.Log("A stalled consumer with no send timeout shouldn't hold up the others.")
+	for i := 1; i <= 5; i++ {
+		routeAdd := routeUpdate(fmt.Sprintf("10.0.0.%d/16", i), true, 2)
+		routeIn <- routeAdd
+		Eventually(routeOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+		Eventually(otherRouteOut, chanPollTime, chanPollIntvl).Should(Receive(Equal(routeAdd)))
+	}
+
+	t.Log("Shutting down shouldn't wait for the stalled consumer.")
+	cancel()
+	Eventually(routeOut, "1s").Should(BeClosed())
+	Eventually(stalledRouteOut, "1s").Should(BeClosed())
+}
+
+func TestUpdateFilter_ManualTestFilter(t *testing.T) {
+	RegisterTestingT(t)
+	f := NewManualTestFilter()
+
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+	Expect(f.Send(routeDel)).To(BeEmpty())
+	Expect(f.Advance(99 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Advance(time.Millisecond)).To(Equal([]interface{}{routeDel}))
+	f.ExpectQueueDrained()
+
+	linkDown := linkUpdateWithIndex(3)
+	linkUp := linkUpUpdateWithIndex(3)
+	Expect(f.Send(linkDown)).To(BeEmpty())
+	Expect(f.Advance(50 * time.Millisecond)).To(BeEmpty())
+	Expect(f.Send(linkUp)).To(BeEmpty())
+	Expect(f.Advance(50 * time.Millisecond)).To(Equal([]interface{}{linkUp}))
+	f.ExpectQueueDrained()
+}
+
+type filterUpdatesHarness struct {
+	Time *mocktime.MockTime
+
+	Ctx    context.Context
+	Cancel context.CancelFunc
+
+	LinkIn   chan netlink.LinkUpdate
+	LinkOut  chan netlink.LinkUpdate
+	RouteIn  chan netlink.RouteUpdate
+	RouteOut chan netlink.RouteUpdate
+
+	// Result receives FilterUpdates' return value.
+	Result chan error
+}
+
+func setUpFilterTest(t *testing.T, opts ...ifacemonitor.UpdateFilterOp) (*filterUpdatesHarness, context.CancelFunc) {
+	RegisterTestingT(t)
+	mockTime := mocktime.New()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	linkIn := make(chan netlink.LinkUpdate, 10)
+	routeIn := make(chan netlink.RouteUpdate, 10)
+	linkOut := make(chan netlink.LinkUpdate, 10)
+	routeOut := make(chan netlink.RouteUpdate, 10)
+
+	opts = append([]ifacemonitor.UpdateFilterOp{ifacemonitor.WithTimeShim(mockTime)}, opts...)
+	resultC := make(chan error, 1)
+	go func() {
+		resultC <- ifacemonitor.FilterUpdates(ctx, routeOut, routeIn, linkOut, linkIn, opts...)
+	}()
+	return &filterUpdatesHarness{
+		Ctx:    ctx,
+		Cancel: cancel,
+		Time:   mockTime,
+
+		LinkIn:   linkIn,
+		LinkOut:  linkOut,
+		RouteIn:  routeIn,
+		RouteOut: routeOut,
+
+		Result: resultC,
+	}, cancel
+}
+
+func routeUpdate(cidrStr string, up bool, ifaceIdx int) netlink.RouteUpdate {
+	ip, cidr, _ := net.ParseCIDR(cidrStr)
+	if ip4 := ip.To4(); ip4 != nil {
+		cidr.IP = ip4
+	} else {
+		cidr.IP = ip
+	}
+	routeUpd := netlink.RouteUpdate{}
+	routeUpd.Dst = cidr
+	if strings.Contains(cidrStr, ".255") {
+		routeUpd.Route.Type = unix.RTN_BROADCAST
+	} else {
+		routeUpd.Route.Type = unix.RTN_LOCAL
+	}
+	routeUpd.LinkIndex = ifaceIdx
+	if up {
+		routeUpd.Type = unix.RTM_NEWROUTE
+	} else {
+		routeUpd.Type = unix.RTM_DELROUTE
+	}
+	return routeUpd
+}
+
+func linkUpUpdateWithIndex(idx int) netlink.LinkUpdate {
+	upd := linkUpdateWithIndex(idx)
+	upd.Header.Type = unix.RTM_NEWLINK
+	upd.Link.Attrs().RawFlags = unix.IFF_RUNNING
+	return upd
+}
+
+func linkUpdateWithIndex(idx int) netlink.LinkUpdate {
+	la := netlink.NewLinkAttrs()
+	la.Index = idx
+	return netlink.LinkUpdate{
+		Link: &netlink.Device{LinkAttrs: la},
+		IfInfomsg: nl.IfInfomsg{
+			IfInfomsg: unix.IfInfomsg{
+				Index: int32(idx),
+			},
+		},
+	}
+}
+
+func BenchmarkUpdateFilter_FilterUpdates(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	routeDels := benchmarkRouteDels()
+	routeIn := make(chan netlink.RouteUpdate)
+	routeOut := make(chan netlink.RouteUpdate, len(routeDels))
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate), make(chan netlink.LinkUpdate),
+		ifacemonitor.WithFlapDampingDelay(time.Millisecond), benchmarkLogger())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, upd := range routeDels {
+			routeIn <- upd
+		}
+		for range routeDels {
+			<-routeOut
+		}
+	}
+}
+
+// BenchmarkUpdateFilter_TimerRearm measures the cost, including allocations, of a damped deletion
+// that the filter has to arm its timer for.
+func BenchmarkUpdateFilter_TimerRearm(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	routeIn := make(chan netlink.RouteUpdate)
+	routeOut := make(chan netlink.RouteUpdate, 1)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate), make(chan netlink.LinkUpdate),
+		ifacemonitor.WithFlapDampingDelay(time.Microsecond), benchmarkLogger())
+	routeDel := routeUpdate("10.0.0.1/16", false, 2)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		routeIn <- routeDel
+		<-routeOut
+	}
+}
+
+// BenchmarkUpdateFilter_SendTimeout measures the cost, including allocations, of an update that is
+// sent with a send timeout.
+func BenchmarkUpdateFilter_SendTimeout(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	routeIn := make(chan netlink.RouteUpdate)
+	routeOut := make(chan netlink.RouteUpdate, 1)
+	go ifacemonitor.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan netlink.LinkUpdate), make(chan netlink.LinkUpdate),
+		ifacemonitor.WithSendTimeout(time.Second), benchmarkLogger())
+	// Use a different address each time; the filter may drop repeated adds.
+	routeAdds := make([]netlink.RouteUpdate, b.N)
+	for i := range routeAdds {
+		routeAdds[i] = routeUpdate(fmt.Sprintf("10.%d.%d.1/32", i/250%250, i%250), true, 2)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		routeIn <- routeAdds[i]
+		<-routeOut
+	}
+}
+
+func BenchmarkBatchingUpdateFilter_FilterUpdates(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	routeDels := benchmarkRouteDels()
+	routeIn := make(chan netlink.RouteUpdate)
+	routeOut := make(chan []netlink.RouteUpdate, len(routeDels))
+	filter := ifacemonitor.NewBatchingUpdateFilter(ifacemonitor.WithFlapDampingDelay(time.Millisecond), benchmarkLogger())
+	go filter.FilterUpdates(ctx, routeOut, routeIn,
+		make(chan []netlink.LinkUpdate), make(chan netlink.LinkUpdate))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, upd := range routeDels {
+			routeIn <- upd
+		}
+		for numReceived := 0; numReceived < len(routeDels); {
+			numReceived += len(<-routeOut)
+		}
+	}
+}
+
+// BenchmarkUpdateFilter_InterfaceAllowlist measures the work done for a flap on each of 100
+// interfaces, with and without an allowlist that excludes most of them.
+func BenchmarkUpdateFilter_InterfaceAllowlist(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []ifacemonitor.UpdateFilterOp
+	}{
+		{name: "no allowlist"},
+		{name: "5 of 100 allowed", opts: []ifacemonitor.UpdateFilterOp{
+			ifacemonitor.WithInterfaceAllowlist(func(ifaceName string) bool {
+				return ifaceName < "if05"
+			}),
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			routeDels := benchmarkRouteDels()
+			var routeAdds []netlink.RouteUpdate
+			for _, upd := range routeDels {
+				upd.Type = unix.RTM_NEWROUTE
+				routeAdds = append(routeAdds, upd)
+			}
+			// Every iteration flaps every address, which would otherwise be reported as a flap storm.
+			opts := append([]ifacemonitor.UpdateFilterOp{
+				ifacemonitor.WithFlapStormThreshold(0, 0),
+				benchmarkLogger(),
+			}, bc.opts...)
+			filter := ifacemonitor.NewUpdateFilter(opts...)
+			now := time.Now()
+			for idx := 1; idx <= len(routeDels); idx++ {
+				upd := linkUpUpdateWithIndex(idx)
+				upd.Link.Attrs().Name = fmt.Sprintf("if%02d", idx-1)
+				filter.FilterOne(now, upd)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, upd := range routeDels {
+					filter.FilterOne(now, upd)
+				}
+				for _, upd := range routeAdds {
+					filter.FilterOne(now, upd)
+				}
+				now = now.Add(time.Second)
+				filter.FilterOne(now, nil)
+			}
+		})
+	}
+}
+
+// BenchmarkUpdateFilter_AddrUpdateQueueDepth measures the cost of an address update that squashes
+// a queued update, for various depths of the interface's queue.
+func BenchmarkUpdateFilter_AddrUpdateQueueDepth(b *testing.B) {
+	for _, depth := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("depth %d", depth), func(b *testing.B) {
+			filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithFlapStormThreshold(0, 0), benchmarkLogger())
+			var dels, adds []netlink.RouteUpdate
+			for i := 0; i < depth; i++ {
+				cidr := fmt.Sprintf("10.0.%d.%d/32", i/256, i%256)
+				dels = append(dels, routeUpdate(cidr, false, 2))
+				adds = append(adds, routeUpdate(cidr, true, 2))
+			}
+			// Time doesn't advance so the queue stays at the given depth.
+			now := time.Now()
+			for _, upd := range dels {
+				filter.FilterOne(now, upd)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				filter.FilterOne(now, adds[i%depth])
+				filter.FilterOne(now, dels[i%depth])
+			}
+		})
+	}
+}
+
+// BenchmarkUpdateFilter_DuplicateAddBurst measures the cost of a burst of duplicate adds on each of
+// 100 interfaces, with and without the micro-coalescing window.
+func BenchmarkUpdateFilter_DuplicateAddBurst(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		window time.Duration
+	}{
+		{name: "window disabled"},
+		{name: "default window", window: ifacemonitor.DefaultMicroCoalesceWindow},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var routeAdds []netlink.RouteUpdate
+			for _, upd := range benchmarkRouteDels() {
+				upd.Type = unix.RTM_NEWROUTE
+				routeAdds = append(routeAdds, upd)
+			}
+			filter := ifacemonitor.NewUpdateFilter(ifacemonitor.WithMicroCoalesceWindow(bc.window), benchmarkLogger())
+			now := time.Now()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, upd := range routeAdds {
+					for j := 0; j < 3; j++ {
+						filter.FilterOne(now, upd)
+					}
+				}
+				now = now.Add(time.Second)
+			}
+		})
+	}
+}
+
+func benchmarkRouteDels() []netlink.RouteUpdate {
+	var upds []netlink.RouteUpdate
+	for idx := 1; idx <= 100; idx++ {
+		upds = append(upds, routeUpdate("10.0.0.1/16", false, idx))
+	}
+	return upds
+}
+
+// benchmarkLogger returns an option that gives the filter under benchmark a logger that discards
+// its output, so that logging doesn't dominate the results.
+func benchmarkLogger() ifacemonitor.UpdateFilterOp {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.InfoLevel)
+	return ifacemonitor.WithLogger(logrus.NewEntry(logger))
 }
@@ -73,6 +73,8 @@ func (m *mockTimer) Stop() bool {
 }
 
 func (m *mockTimer) Reset(duration timeshim.Duration) {
+	// Like a real timer, a pending timer is rescheduled rather than firing twice.
+	m.mockTime.stopTimer(m)
 	m.mockTime.scheduleTimer(m, duration)
 }
 
@@ -0,0 +1,60 @@
+// Copyright (c) 2026 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocktime
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestMockTimer_ResetPending(t *testing.T) {
+	RegisterTestingT(t)
+	mockTime := New()
+	timer := mockTime.NewTimer(10 * time.Second)
+
+	t.Log("Resetting a pending timer should reschedule it rather than scheduling it twice.")
+	timer.Reset(20 * time.Second)
+	mockTime.IncrementTime(10 * time.Second)
+	Expect(timer.Chan()).NotTo(Receive())
+	mockTime.IncrementTime(10 * time.Second)
+	Expect(timer.Chan()).To(Receive(Equal(StartTime.Add(20 * time.Second))))
+	Expect(mockTime.HasTimers()).To(BeFalse())
+}
+
+func TestMockTimer_ResetFired(t *testing.T) {
+	RegisterTestingT(t)
+	mockTime := New()
+	timer := mockTime.NewTimer(10 * time.Second)
+	mockTime.IncrementTime(10 * time.Second)
+	Expect(timer.Chan()).To(Receive())
+
+	t.Log("Resetting a timer that has fired should schedule it again.")
+	timer.Reset(5 * time.Second)
+	Expect(mockTime.HasTimers()).To(BeTrue())
+	mockTime.IncrementTime(5 * time.Second)
+	Expect(timer.Chan()).To(Receive(Equal(StartTime.Add(15 * time.Second))))
+}
+
+func TestMockTimer_Stop(t *testing.T) {
+	RegisterTestingT(t)
+	mockTime := New()
+	timer := mockTime.NewTimer(10 * time.Second)
+	Expect(timer.Stop()).To(BeTrue())
+	Expect(timer.Stop()).To(BeFalse())
+	mockTime.IncrementTime(10 * time.Second)
+	Expect(timer.Chan()).NotTo(Receive())
+}